@@ -1,17 +1,73 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // This is where we start the server
 func main() {
+	rdbFile := flag.String("rdb", "", "load the cache from a redis RDB file instead of the snapshot or append only file")
+	flag.Parse()
+
 	// we check for some diagnostic information
 	// like the Go version and number of CPUs available
 	fmt.Printf("Starting Gored cache with Go version %s\n", runtime.Version())
 	fmt.Printf("System has %d CPUs\n", runtime.NumCPU())
 
+	// the append only file or the last snapshot warms up the cache before we take any connections
+	switch {
+	case *rdbFile != "":
+		start := time.Now()
+		n, err := cache.LoadRDB(*rdbFile)
+		if err != nil {
+			fmt.Println("Error loading the RDB file:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Loaded %d keys from %s in %v\n", n, *rdbFile, time.Since(start))
+		if appendOnly {
+			// the old log has nothing to do with the data we just loaded
+			if err := createAppendOnlyFile(appendFilename); err != nil {
+				fmt.Println("Error creating the append only file:", err)
+				os.Exit(1)
+			}
+		}
+	case appendOnly:
+		if err := startAppendOnlyFile(); err != nil {
+			fmt.Println("Error loading the append only file:", err)
+			os.Exit(1)
+		}
+	default:
+		loadSnapshot()
+	}
+	go runSaveRules()
+	go runReplicationPing()
+
+	// REPLICAOF="host port" starts us as a replica, after the local data is loaded: the
+	// primary decides whether it is kept
+	if primary := strings.Fields(os.Getenv("REPLICAOF")); len(primary) == 2 {
+		cache.ReplicaOf(net.JoinHostPort(primary[0], primary[1]))
+	} else if len(primary) != 0 {
+		fmt.Println("Ignoring REPLICAOF: expected \"host port\"")
+	}
+
+	// a deploy stops us with SIGTERM, we save one last time so the next start is warm too
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		saveOnShutdown()
+		cache.aof.Flush()
+		os.Exit(0)
+	}()
+
 	// and then we start our resp server on port 7171
 	StartServer()
 }
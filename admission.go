@@ -0,0 +1,232 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// W-TinyLFU admission
+//
+// An eviction policy only decides who leaves, so a burst of keys that are read once (think
+// a batch job walking the whole catalog) still pushes hot keys out: each new key gets in
+// and evicts somebody. With the admission filter enabled a new key first lands in a small
+// window (windowPercent of maxmemory) that is plain LRU. When the window is full its oldest
+// key has to compete with the eviction policy's victim from the main area: whichever of the
+// two has been accessed more often stays, the other one is evicted. Access frequencies come
+// from a count-min sketch that counts every access, including the ones to keys that are not
+// (or no longer) in the cache, and is aged periodically so old popularity fades away.
+const (
+	windowPercent = 1 // share of maxmemory given to the admission window
+
+	sketchDepth   = 4                // rows of the count-min sketch, one hash each
+	sketchWidth   = 1 << 16          // counters per row, a power of two
+	sketchMax     = 15               // counters saturate here, enough to rank frequencies
+	sketchSamples = 10 * sketchWidth // increments between two agings of the sketch
+)
+
+// countMinSketch estimates how often keys were accessed in a fixed amount of memory.
+// Each key bumps one counter per row and the estimate is the smallest of those, so
+// collisions can only make a key look more popular, never less
+type countMinSketch struct {
+	counters  [sketchDepth][]atomic.Uint32
+	additions atomic.Int64
+	aging     sync.Mutex
+}
+
+func newCountMinSketch() *countMinSketch {
+	s := &countMinSketch{}
+	for row := range s.counters {
+		s.counters[row] = make([]atomic.Uint32, sketchWidth)
+	}
+	return s
+}
+
+// indexes returns the counter of each row for key, derived from one 64 bit hash
+// by double hashing
+func (s *countMinSketch) indexes(key string) [sketchDepth]uint32 {
+	h := scanHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	var idx [sketchDepth]uint32
+	for row := range idx {
+		idx[row] = (h1 + uint32(row)*h2) & (sketchWidth - 1)
+	}
+	return idx
+}
+
+// increment records an access to key
+func (s *countMinSketch) increment(key string) {
+	for row, i := range s.indexes(key) {
+		counter := &s.counters[row][i]
+		for {
+			v := counter.Load()
+			if v >= sketchMax || counter.CompareAndSwap(v, v+1) {
+				break
+			}
+		}
+	}
+	if s.additions.Add(1) == sketchSamples {
+		// callers hold a shard lock, the aging pass is too long to run under it
+		go s.age()
+	}
+}
+
+// estimate returns how often key was accessed, give or take collisions and aging
+func (s *countMinSketch) estimate(key string) uint32 {
+	lowest := uint32(sketchMax)
+	for row, i := range s.indexes(key) {
+		if v := s.counters[row][i].Load(); v < lowest {
+			lowest = v
+		}
+	}
+	return lowest
+}
+
+// age halves every counter so the sketch follows changes in popularity
+func (s *countMinSketch) age() {
+	if !s.aging.TryLock() {
+		return
+	}
+	defer s.aging.Unlock()
+
+	for row := range s.counters {
+		for i := range s.counters[row] {
+			counter := &s.counters[row][i]
+			counter.Store(counter.Load() / 2)
+		}
+	}
+	s.additions.Add(-sketchSamples / 2)
+}
+
+// tinyLFU is the admission filter, it is only set while admission is enabled
+type tinyLFU struct {
+	sketch   *countMinSketch
+	admitted atomic.Int64 // window keys that won against the main victim
+	rejected atomic.Int64 // window keys that lost and were evicted
+}
+
+// recordAccess counts an access to key in the sketch, if admission is enabled
+func (c *LRUCache) recordAccess(key string) {
+	if f := c.admission.Load(); f != nil {
+		f.sketch.increment(key)
+	}
+}
+
+// AdmissionEnabled reports whether the W-TinyLFU admission filter is on
+func (c *LRUCache) AdmissionEnabled() bool {
+	return c.admission.Load() != nil
+}
+
+// AdmissionFilter returns the admission-filter setting: tinylfu or none
+func (c *LRUCache) AdmissionFilter() string {
+	if c.AdmissionEnabled() {
+		return "tinylfu"
+	}
+	return "none"
+}
+
+// SetAdmissionFilter switches the admission filter by its admission-filter name
+func (c *LRUCache) SetAdmissionFilter(name string) bool {
+	switch name {
+	case "tinylfu":
+		c.SetAdmission(true)
+	case "none":
+		c.SetAdmission(false)
+	default:
+		return false
+	}
+	return true
+}
+
+// SetAdmission turns the admission filter on or off. Turning it off moves every key
+// still in the window over to the main area
+func (c *LRUCache) SetAdmission(enabled bool) {
+	if enabled {
+		c.admission.CompareAndSwap(nil, &tinyLFU{sketch: newCountMinSketch()})
+		return
+	}
+	if c.admission.Swap(nil) == nil {
+		return
+	}
+	for _, shard := range c.shards {
+		shard.mutex.Lock()
+		for shard.window.Len() > 0 {
+			shard.leaveWindow(shard.window.Back().Value.(*list.Element))
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// leaveWindow moves an entry from the window to the main area.
+// Callers must hold the shard write lock
+func (s *cacheShard) leaveWindow(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	if entry.windowElem == nil {
+		return
+	}
+	s.cache.windowMemory.Add(-entry.size)
+	s.window.Remove(entry.windowElem)
+	entry.windowElem = nil
+}
+
+// windowCandidate returns the least recently used window key of a shard
+func windowCandidate(shard *cacheShard, now int64) (string, int64, bool) {
+	back := shard.window.Back()
+	if back == nil {
+		return "", 0, false
+	}
+	entry := back.Value.(*list.Element).Value.(*cacheEntry)
+	return entry.key, entry.lastAccess, true
+}
+
+// drainWindow moves keys over the window budget to the main area for as long as the
+// cache has room for them, there is no need to pick a loser before memory runs out
+func (c *LRUCache) drainWindow(limit int64) {
+	if !c.AdmissionEnabled() {
+		return
+	}
+	for c.windowMemory.Load() > limit*windowPercent/100 && (limit <= 0 || c.usedMemory.Load() <= limit) {
+		shard, key, ok := c.pickVictim(windowCandidate)
+		if !ok {
+			return
+		}
+		c.promote(shard, key)
+	}
+}
+
+// evictFromWindow lets the oldest window key compete with the policy's victim, see the
+// top of the file. It returns false when nothing could be evicted or promoted
+func (c *LRUCache) evictFromWindow(f *tinyLFU, policy evictionPolicy) bool {
+	wShard, wKey, ok := c.pickVictim(windowCandidate)
+	if !ok {
+		return false
+	}
+
+	mShard, mKey, ok := c.pickVictim(policy.candidate)
+	if !ok {
+		// the policy can't evict anything from the main area (it is empty, or volatile-*
+		// finds no keys with a TTL). The window key moves on without a contest, if memory
+		// still runs out the caller reports it once the window is within its budget
+		c.promote(wShard, wKey)
+		return true
+	}
+
+	if f.sketch.estimate(wKey) > f.sketch.estimate(mKey) {
+		c.evictKey(mShard, mKey)
+		c.promote(wShard, wKey)
+		f.admitted.Add(1)
+	} else {
+		c.evictKey(wShard, wKey)
+		f.rejected.Add(1)
+	}
+	return true
+}
+
+// promote moves key from the window to the main area, if it is still in the window
+func (c *LRUCache) promote(shard *cacheShard, key string) {
+	shard.mutex.Lock()
+	if elem, ok := shard.items[key]; ok {
+		shard.leaveWindow(elem)
+	}
+	shard.mutex.Unlock()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// zipfScanTrace returns n keys: mostly a Zipf distributed hot set, with a scan of keys
+// never seen before every now and then, the pattern the admission filter is meant for
+func zipfScanTrace(n int) []string {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, 100_000)
+	trace := make([]string, 0, n)
+	scanned := 0
+	for len(trace) < n {
+		if len(trace)%50_000 < 10_000 && len(trace) >= 50_000 {
+			// a batch job walking the catalog
+			trace = append(trace, "scan:"+strconv.Itoa(scanned))
+			scanned++
+			continue
+		}
+		trace = append(trace, "key:"+strconv.FormatUint(zipf.Uint64(), 10))
+	}
+	return trace
+}
+
+// BenchmarkAdmission replays the same trace as a read-through cache with plain LRU and
+// with the W-TinyLFU admission window in front of it, reporting the hit rate next to ns/op
+func BenchmarkAdmission(b *testing.B) {
+	trace := zipfScanTrace(500_000)
+	for _, filter := range []string{"none", "tinylfu"} {
+		b.Run(filter, func(b *testing.B) {
+			// room for about 5000 of the 100000 keys
+			c := NewLRUCache(5000*(entryOverhead+16), 16, "fnv")
+			defer c.Close()
+			c.SetAdmissionFilter(filter)
+			hits := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := trace[i%len(trace)]
+				if _, ok, _ := c.Get(key); ok {
+					hits++
+					continue
+				}
+				c.Put(key, "value", putOptions{})
+				c.evictIfNeeded()
+			}
+			b.ReportMetric(100*float64(hits)/float64(b.N), "hit%")
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Append only file
+//
+// With appendonly enabled the stream of write commands (see propagate.go) is appended to a
+// log, which is replayed through processCommand at startup. BGREWRITEAOF replaces the log
+// with the shortest list of commands that recreates the current content of the cache.
+const (
+	defaultAOFFilename = "appendonly.aof"
+	rewriteBatch       = 64 // members per command when a rewrite recreates a collection
+)
+
+var errRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// fsync policies, as in redis: after every write, once a second, or whenever the OS likes
+var appendFsyncPolicies = map[string]bool{"always": true, "everysec": true, "no": true}
+
+// appendonly and appendfilename are read at startup only, appendfsync can be changed any time
+var (
+	appendOnly     = strings.EqualFold(envOr("appendonly", "no"), "yes")
+	appendFilename = envOr("appendfilename", defaultAOFFilename)
+	appendFsync    = newSetting(fsyncFromEnv())
+)
+
+// fsyncFromEnv returns the appendfsync policy found in the environment, or everysec
+func fsyncFromEnv() string {
+	policy := strings.ToLower(envOr("appendfsync", "everysec"))
+	if !appendFsyncPolicies[policy] {
+		fmt.Printf("Ignoring APPENDFSYNC: unknown policy %q\n", policy)
+		return "everysec"
+	}
+	return policy
+}
+
+// appendOnlyFile is the open log. A nil *appendOnlyFile is a disabled one,
+// all of its methods can be called on it and do nothing
+type appendOnlyFile struct {
+	cache *LRUCache
+	path  string
+
+	mutex      sync.Mutex
+	file       *os.File
+	rewriteBuf []byte // writes logged while a rewrite runs, nil when none does
+	dirty      bool   // written since the last fsync
+	rewriting  atomic.Bool
+}
+
+// openAppendOnlyFile opens the log at path for appending, creating it if needed
+func openAppendOnlyFile(c *LRUCache, path string) (*appendOnlyFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &appendOnlyFile{cache: c, path: path, file: file}
+	go a.runFsync()
+	return a, nil
+}
+
+// write appends commands to the log, callers hold the propagator mutex
+func (a *appendOnlyFile) write(buf []byte) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.rewriteBuf != nil {
+		a.rewriteBuf = append(a.rewriteBuf, buf...)
+	}
+	if _, err := a.file.Write(buf); err != nil {
+		fmt.Println("Error writing the append only file:", err)
+		return
+	}
+	a.dirty = true
+	if *appendFsync.Load() == "always" {
+		a.syncLocked()
+	}
+}
+
+// syncLocked flushes the log to disk, callers hold a.mutex
+func (a *appendOnlyFile) syncLocked() {
+	if !a.dirty {
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		fmt.Println("Error syncing the append only file:", err)
+		return
+	}
+	a.dirty = false
+}
+
+// Flush writes the log to disk whatever appendfsync says, before shutting down
+func (a *appendOnlyFile) Flush() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	a.syncLocked()
+	a.mutex.Unlock()
+}
+
+// runFsync syncs the log once a second for appendfsync everysec
+func (a *appendOnlyFile) runFsync() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if *appendFsync.Load() != "everysec" {
+			continue
+		}
+		a.mutex.Lock()
+		a.syncLocked()
+		a.mutex.Unlock()
+	}
+}
+
+// Rewrite replaces the log with the commands that recreate the current content of the
+// cache. It runs in the background: the cache is encoded in memory one shard at a time,
+// holding up only the writes to the shard being encoded (see capture in propagate.go).
+// The new log is then written to disk, the writes logged meanwhile are appended to it
+// before it replaces the old one
+func (a *appendOnlyFile) Rewrite() error {
+	if !a.rewriting.CompareAndSwap(false, true) {
+		return errRewriteInProgress
+	}
+
+	go func() {
+		defer a.rewriting.Store(false)
+		var base []byte
+		a.cache.propagation.capture((*cacheShard).encodeCommands, func(shards, tail []byte) {
+			// from here on the writes go to rewriteBuf, the ones before are in base
+			base = shards
+			a.mutex.Lock()
+			a.rewriteBuf = append([]byte{}, tail...)
+			a.mutex.Unlock()
+		})
+		if err := a.finishRewrite(base); err != nil {
+			fmt.Println("Background append only file rewrite failed:", err)
+			a.mutex.Lock()
+			a.rewriteBuf = nil
+			a.mutex.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Rewriting reports whether a BGREWRITEAOF is running
+func (a *appendOnlyFile) Rewriting() bool {
+	return a != nil && a.rewriting.Load()
+}
+
+// finishRewrite writes the new log and swaps it in for the old one
+func (a *appendOnlyFile) finishRewrite(base []byte) error {
+	tmp := fmt.Sprintf("%s.rewrite-%d", a.path, os.Getpid())
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // a no-op once the rename went through
+
+	if _, err := file.Write(base); err != nil {
+		file.Close()
+		return err
+	}
+
+	// from here on nothing is logged until the new file took over
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	_, err = file.Write(a.rewriteBuf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, a.path)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file.Close()
+	a.file, a.rewriteBuf, a.dirty = file, nil, false
+	return nil
+}
+
+// encodeCommands returns the commands that recreate the content of a shard, in RESP
+func (s *cacheShard) encodeCommands() []byte {
+	var buf []byte
+	now := nowMillis()
+	s.mutex.RLock()
+	for elem := s.evictionQ.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*cacheEntry)
+		if entry.isExpired(now) {
+			continue
+		}
+		for _, cmd := range entry.commands() {
+			buf = append(buf, cmd.Marshal()...)
+		}
+	}
+	s.mutex.RUnlock()
+	return buf
+}
+
+// commands returns the commands that recreate an entry: the value, big collections in
+// batches of rewriteBatch members, and its TTL
+func (e *cacheEntry) commands() []Value {
+	var cmds []Value
+	var args []string
+	batch := func(cmd string, members ...string) {
+		if args == nil {
+			args = []string{cmd, e.key}
+		}
+		args = append(args, members...)
+		if len(args) >= 2+rewriteBatch {
+			cmds = append(cmds, command(args...))
+			args = nil
+		}
+	}
+
+	switch v := e.value.(type) {
+	case string:
+		cmds = append(cmds, command("SET", e.key, v))
+	case hashValue:
+		for field, value := range v {
+			batch("HSET", field, value)
+		}
+	case *listValue:
+		for i := 0; i < v.size; i++ {
+			batch("RPUSH", v.at(i))
+		}
+	case setValue:
+		for member := range v {
+			batch("SADD", member)
+		}
+	case *zsetValue:
+		for member, score := range v.dict {
+			batch("ZADD", formatScore(score), member)
+		}
+	}
+	if args != nil {
+		cmds = append(cmds, command(args...))
+	}
+
+	if e.expireAt != 0 {
+		cmds = append(cmds, command("PEXPIREAT", e.key, strconv.FormatInt(e.expireAt, 10)))
+	}
+	return cmds
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// replayAppendOnlyFile runs every command of the log at path through processCommand.
+// A log that ends in the middle of a command (the server died while writing it) is
+// truncated after the last complete one. Anything else that can't be parsed is an error,
+// we'd rather not start than silently drop the rest of the log. It returns the number of
+// commands replayed
+func replayAppendOnlyFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	resp := &Resp{reader: bufio.NewReader(counter)}
+	replayed := 0
+	var good int64 // offset right after the last complete command
+	for {
+		value, err := resp.Read()
+		if err == io.EOF && counter.n-int64(resp.Buffered()) == good {
+			return replayed, nil
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			fmt.Printf("The append only file ends in the middle of a command, truncating it to %d bytes\n", good)
+			return replayed, os.Truncate(path, good)
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("%s: bad command after %d bytes: %w", path, good, err)
+		}
+		good = counter.n - int64(resp.Buffered())
+
+		if response := processCommand(value); response.typ == "error" {
+			fmt.Printf("Replaying %s: %s\n", strings.Join(arrayStrings(value), " "), response.str)
+		}
+		replayed++
+	}
+}
+
+// startAppendOnlyFile replays the log at startup and opens it for appending. The log has
+// every write, so the snapshot is only loaded without one (the first start with appendonly
+// enabled), a log is then written from what the snapshot loaded
+func startAppendOnlyFile() error {
+	path := appendFilename
+	start := time.Now()
+	n, err := replayAppendOnlyFile(path)
+	exists := !errors.Is(err, os.ErrNotExist)
+	if err != nil && exists {
+		return err
+	}
+	if !exists {
+		loadSnapshot()
+		return createAppendOnlyFile(path)
+	}
+	fmt.Printf("Replayed %d commands from %s in %v\n", n, path, time.Since(start))
+
+	a, err := openAppendOnlyFile(cache, path)
+	if err != nil {
+		return err
+	}
+	cache.aof = a
+	return nil
+}
+
+// createAppendOnlyFile starts a new log at path, replacing the one there, and writes it
+// from the content of the cache
+func createAppendOnlyFile(path string) error {
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		return err
+	}
+	a, err := openAppendOnlyFile(cache, path)
+	if err != nil {
+		return err
+	}
+	cache.aof = a
+	return a.Rewrite()
+}
+
+// bgrewriteaofCommand handles BGREWRITEAOF
+func bgrewriteaofCommand(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'BGREWRITEAOF' command"}
+	}
+	if cache.aof == nil {
+		return Value{typ: "error", str: "ERR append only file is disabled, set appendonly yes at startup"}
+	}
+	if err := cache.aof.Rewrite(); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "string", str: "Background append only file rewriting started"}
+}
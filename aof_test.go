@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cacheContent returns every live key of c with its type and value in a form that
+// compares equal whatever order the members were added in
+func cacheContent(c *LRUCache) map[string]string {
+	content := make(map[string]string)
+	now := nowMillis()
+	for _, shard := range c.shards {
+		shard.mutex.RLock()
+		for key, elem := range shard.items {
+			entry := elem.Value.(*cacheEntry)
+			if entry.isExpired(now) {
+				continue
+			}
+			var members []string
+			switch v := entry.value.(type) {
+			case string:
+				members = []string{v}
+			case hashValue:
+				for field, value := range v {
+					members = append(members, field+"="+value)
+				}
+				slices.Sort(members)
+			case *listValue:
+				for i := 0; i < v.size; i++ {
+					members = append(members, v.at(i))
+				}
+			case setValue:
+				for member := range v {
+					members = append(members, member)
+				}
+				slices.Sort(members)
+			case *zsetValue:
+				for member, score := range v.dict {
+					members = append(members, member+"="+formatScore(score))
+				}
+				slices.Sort(members)
+			}
+			content[key] = entry.typeName() + ":" + strings.Join(members, ",")
+		}
+		shard.mutex.RUnlock()
+	}
+	return content
+}
+
+// openTestAOF makes a fresh cache with an append only file in a temporary directory the
+// global cache, and returns the path of the log
+func openTestAOF(t *testing.T, maxMemory int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	cache = NewLRUCache(maxMemory, 16, "fnv")
+	t.Cleanup(cache.Close)
+	a, err := openAppendOnlyFile(cache, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.aof = a
+	return path
+}
+
+// replayInto replays the log at path into a fresh cache without a memory limit
+func replayInto(t *testing.T, path string) *LRUCache {
+	t.Helper()
+	cache = NewLRUCache(0, 16, "fnv")
+	t.Cleanup(cache.Close)
+	if _, err := replayAppendOnlyFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+// run runs a command the way a client connection does
+func run(args ...string) Value {
+	return processCommand(command(args...))
+}
+
+func TestRewriteUnderWrites(t *testing.T) {
+	path := openTestAOF(t, 0)
+	live := cache
+	// enough keys that the writers get to run while the shards are encoded
+	for i := 0; i < 50000; i++ {
+		run("SET", "key:"+strconv.Itoa(i), "v")
+		run("RPUSH", "list:"+strconv.Itoa(i%10), strconv.Itoa(i))
+	}
+
+	// writes to one and to several shards keep going during the rewrite
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				n := strconv.Itoa(i % 500)
+				run("INCR", "counter:"+n)
+				run("MSET", "a:"+n, strconv.Itoa(w), "b:"+n, strconv.Itoa(w))
+				run("LMOVE", "list:"+strconv.Itoa(i%10), "list:"+strconv.Itoa((i+w)%10), "LEFT", "RIGHT")
+				run("SADD", "set:"+n, strconv.Itoa(i))
+				run("SMOVE", "set:"+n, "set:"+strconv.Itoa((i+1)%500), strconv.Itoa(i))
+			}
+		}(w)
+	}
+
+	for r := 0; r < 5; r++ {
+		if err := live.aof.Rewrite(); err != nil {
+			t.Fatal(err)
+		}
+		for live.aof.Rewriting() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	live.aof.Flush()
+
+	want := cacheContent(live)
+	got := cacheContent(replayInto(t, path))
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d keys, want %d", len(got), len(want))
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("%s: replayed %q, want %q", key, got[key], value)
+		}
+	}
+}
+
+func TestEvictionsAndExpirationsAreLogged(t *testing.T) {
+	path := openTestAOF(t, 64<<10)
+	live := cache
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 2000; i++ {
+		run("SET", "key:"+strconv.Itoa(i), value)
+	}
+	if _, _, _, _, evictions, _ := live.totals(); evictions == 0 {
+		t.Fatal("nothing was evicted, the test needs a smaller maxmemory")
+	}
+
+	run("SET", "short", "lived", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	if v := run("GET", "short"); !v.null {
+		t.Fatalf("GET of an expired key = %+v", v)
+	}
+	live.aof.Flush()
+
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), string(command("DEL", "short").Marshal())) {
+		t.Fatal("the expired key was not logged as a DEL")
+	}
+
+	// without a memory limit the replay would keep every key if the evictions weren't logged
+	want := cacheContent(live)
+	got := cacheContent(replayInto(t, path))
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d keys, want %d", len(got), len(want))
+	}
+	for key := range want {
+		if _, ok := got[key]; !ok {
+			t.Fatalf("%s is missing after the replay", key)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configParam is a setting exposed through CONFIG GET and CONFIG SET. Settings are read
+// from the environment at startup (MAXMEMORY for maxmemory and so on), CONFIG SET changes
+// them at runtime. Settings without set can only be chosen at startup
+type configParam struct {
+	get func() string
+	set func(value string) error
+}
+
+var errImmutableConfig = errors.New("can't set immutable config")
+
+var configParams = map[string]configParam{
+	"maxmemory": {
+		get: func() string { return strconv.FormatInt(cache.maxMemory.Load(), 10) },
+		set: func(value string) error {
+			limit, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			// the keys over the new budget are evicted before the next command
+			cache.maxMemory.Store(limit)
+			return nil
+		},
+	},
+	"maxmemory-policy": {
+		get: func() string { return cache.Policy().name() },
+		set: func(value string) error {
+			if !cache.SetPolicy(strings.ToLower(value)) {
+				return fmt.Errorf("unknown policy %q", value)
+			}
+			return nil
+		},
+	},
+	"storage-engine": {
+		get: func() string { return cache.StorageEngine() },
+		set: func(value string) error {
+			if !cache.SetStorageEngine(strings.ToLower(value)) {
+				return fmt.Errorf("unknown storage engine %q", value)
+			}
+			return nil
+		},
+	},
+	"max-key-size":       limitParam(maxKeySize),
+	"max-value-size":     limitParam(maxValueSize),
+	"proto-max-bulk-len": limitParam(maxBulkLen),
+	"dbfilename": {
+		get: func() string { return *dbFilename.Load() },
+		set: func(value string) error {
+			if value == "" {
+				return errors.New("dbfilename can't be empty")
+			}
+			dbFilename.Store(&value)
+			return nil
+		},
+	},
+	"snapshot-format": {
+		get: func() string { return *snapshotFormat.Load() },
+		set: func(value string) error {
+			value = strings.ToLower(value)
+			if !snapshotFormats[value] {
+				return fmt.Errorf("unknown snapshot format %q", value)
+			}
+			snapshotFormat.Store(&value)
+			return nil
+		},
+	},
+	"save": {
+		get: func() string { return formatSaveRules(*saveRules.Load()) },
+		set: func(value string) error {
+			rules, err := parseSaveRules(value)
+			if err != nil {
+				return err
+			}
+			saveRules.Store(&rules)
+			return nil
+		},
+	},
+	"appendonly": {
+		get: func() string {
+			if appendOnly {
+				return "yes"
+			}
+			return "no"
+		},
+	},
+	"appendfilename": {
+		get: func() string { return appendFilename },
+	},
+	"appendfsync": {
+		get: func() string { return *appendFsync.Load() },
+		set: func(value string) error {
+			value = strings.ToLower(value)
+			if !appendFsyncPolicies[value] {
+				return fmt.Errorf("unknown appendfsync policy %q", value)
+			}
+			appendFsync.Store(&value)
+			return nil
+		},
+	},
+	"replica-read-only": {
+		get: func() string { return *replicaReadOnly.Load() },
+		set: func(value string) error {
+			value = strings.ToLower(value)
+			if value != "yes" && value != "no" {
+				return fmt.Errorf("argument must be 'yes' or 'no'")
+			}
+			replicaReadOnly.Store(&value)
+			return nil
+		},
+	},
+	"repl-backlog-size": {
+		get: func() string { return strconv.FormatInt(replBacklogSize, 10) },
+	},
+	"shards": {
+		get: func() string { return strconv.Itoa(cache.shardCount) },
+	},
+	"shard-hash": {
+		get: func() string { return cache.shardHash },
+	},
+	"admission-filter": {
+		get: func() string { return cache.AdmissionFilter() },
+		set: func(value string) error {
+			if !cache.SetAdmissionFilter(strings.ToLower(value)) {
+				return fmt.Errorf("unknown admission filter %q", value)
+			}
+			return nil
+		},
+	},
+}
+
+// envName returns the environment variable a setting is read from at startup
+func envName(param string) string {
+	return strings.ToUpper(strings.ReplaceAll(param, "-", "_"))
+}
+
+// newCacheFromEnv creates the global cache, applying the settings found in the environment
+// (MAXMEMORY=512mb, MAXMEMORY_POLICY=allkeys-lfu, ADMISSION_FILTER=tinylfu, STORAGE_ENGINE=read-buffer, ...) on top of the defaults
+func newCacheFromEnv() *LRUCache {
+	shardCount, shardHash := defaultShardCount, defaultShardHash
+	if value := os.Getenv(envName("shards")); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && validShardCount(n) {
+			shardCount = n
+		} else {
+			fmt.Printf("Ignoring SHARDS: %q is not a power of two between 1 and %d\n", value, maxShardCount)
+		}
+	}
+	if value := os.Getenv(envName("shard-hash")); value != "" {
+		if _, ok := shardHashes[strings.ToLower(value)]; ok {
+			shardHash = strings.ToLower(value)
+		} else {
+			fmt.Println("Ignoring SHARD_HASH: unknown hash", value)
+		}
+	}
+
+	c := NewLRUCache(defaultMaxMemory, shardCount, shardHash)
+
+	if value := os.Getenv(envName("maxmemory")); value != "" {
+		if limit, err := parseMemory(value); err == nil {
+			c.maxMemory.Store(limit)
+		} else {
+			fmt.Println("Ignoring MAXMEMORY:", err)
+		}
+	}
+	if value := os.Getenv(envName("maxmemory-policy")); value != "" && !c.SetPolicy(strings.ToLower(value)) {
+		fmt.Println("Ignoring MAXMEMORY_POLICY: unknown policy", value)
+	}
+	if value := os.Getenv(envName("admission-filter")); value != "" && !c.SetAdmissionFilter(strings.ToLower(value)) {
+		fmt.Println("Ignoring ADMISSION_FILTER: unknown admission filter", value)
+	}
+	if value := os.Getenv(envName("storage-engine")); value != "" && !c.SetStorageEngine(strings.ToLower(value)) {
+		fmt.Println("Ignoring STORAGE_ENGINE: unknown storage engine", value)
+	}
+	return c
+}
+
+// configCommand handles CONFIG GET pattern [pattern ...] and CONFIG SET parameter value [parameter value ...]
+func configCommand(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'CONFIG' command"}
+	}
+
+	switch sub := strings.ToUpper(argString(args[0])); sub {
+	case "GET":
+		if len(args) < 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'CONFIG|GET' command"}
+		}
+		names := make([]string, 0, len(configParams))
+		for name := range configParams {
+			for _, pattern := range args[1:] {
+				if globMatch(strings.ToLower(argString(pattern)), name) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		sort.Strings(names)
+
+		reply := make([]string, 0, 2*len(names))
+		for _, name := range names {
+			reply = append(reply, name, configParams[name].get())
+		}
+		return bulkArray(reply)
+
+	case "SET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'CONFIG|SET' command"}
+		}
+		// check every name first so a typo doesn't leave half of the settings applied
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(argString(args[i]))
+			param, ok := configParams[name]
+			if !ok {
+				return Value{typ: "error", str: fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", argString(args[i]))}
+			}
+			if param.set == nil {
+				return Value{typ: "error", str: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, errImmutableConfig)}
+			}
+		}
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(argString(args[i]))
+			if err := configParams[name].set(argString(args[i+1])); err != nil {
+				return Value{typ: "error", str: fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, err)}
+			}
+		}
+		return Value{typ: "string", str: "OK"}
+
+	default:
+		return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG GET or CONFIG SET", sub)}
+	}
+}
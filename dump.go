@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DUMP and RESTORE
+//
+// DUMP serializes the value of a single key so RESTORE can recreate it, on the same server
+// or another one. The payload is laid out like the redis one, with our snapshot encoding
+// inside: the value type, the value (see appendValue), the snapshot format version as two
+// bytes and a CRC-64 of everything before it, both little endian. RESTORE refuses payloads
+// from a newer format version or with a wrong checksum, so a payload mangled on its way
+// between servers is never half loaded.
+const dumpTrailer = 10 // version(2) crc64(8)
+
+var (
+	errBadDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+	errBadDataFormat  = errors.New("ERR Bad data format")
+	errBusyKey        = errors.New("BUSYKEY Target key name already exists.")
+)
+
+// Dump returns the serialized value of key, see the top of the file
+func (c *LRUCache) Dump(key string) (string, bool) {
+	shard := c.getShard(key)
+	shard.mutex.RLock()
+	elem, ok := shard.items[key]
+	if !ok {
+		shard.mutex.RUnlock()
+		return "", false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.isExpired(nowMillis()) {
+		shard.mutex.RUnlock()
+		c.expireKey(shard, key)
+		return "", false
+	}
+	payload := appendValue([]byte{valueType(entry.value)}, entry.value)
+	shard.mutex.RUnlock()
+
+	payload = binary.LittleEndian.AppendUint16(payload, snapshotVersion)
+	payload = binary.LittleEndian.AppendUint64(payload, crc64.Checksum(payload, crcTable))
+	return string(payload), true
+}
+
+// decodeDump checks a DUMP payload and decodes the value it holds
+func decodeDump(payload string) (interface{}, error) {
+	b := []byte(payload)
+	if len(b) < 1+dumpTrailer {
+		return nil, errBadDumpPayload
+	}
+	body, trailer := b[:len(b)-8], b[len(b)-8:]
+	if binary.LittleEndian.Uint64(trailer) != crc64.Checksum(body, crcTable) {
+		return nil, errBadDumpPayload
+	}
+	version := binary.LittleEndian.Uint16(body[len(body)-2:])
+	if version > snapshotVersion {
+		return nil, errBadDumpPayload
+	}
+
+	data := body[:len(body)-2]
+	d := &decoder{r: bufio.NewReader(bytes.NewReader(data[1:]))}
+	value := d.value(data[0])
+	if _, err := d.r.ReadByte(); d.err != nil || err != io.EOF {
+		// a value we couldn't decode, or one followed by bytes that don't belong to it
+		return nil, errBadDataFormat
+	}
+	return value, nil
+}
+
+// Restore creates key with a value decoded from a DUMP payload. expireAt is the unix time
+// in milliseconds the key expires at (0 for none), idle how many seconds ago the key was
+// last used (-1 for now). Without replace an existing key is an error. A key restored with
+// an expire time in the past is not created at all, but still replaces the existing one
+func (c *LRUCache) Restore(key string, value interface{}, expireAt int64, idle int64, replace bool) error {
+	shard := c.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if elem, exists := c.liveElement(shard, key); exists {
+		if !replace {
+			return errBusyKey
+		}
+		shard.removeElement(elem)
+	}
+
+	now := nowMillis()
+	if expireAt != 0 && expireAt <= now {
+		return nil
+	}
+
+	entry := &cacheEntry{key: key, value: value, expireAt: expireAt}
+	elem := c.addEntry(shard, entry)
+	if idle >= 0 {
+		entry.lastAccess = now - idle*1000
+		shard.placeByRecency(elem)
+	}
+	c.serveNewList(shard, elem)
+	return nil
+}
+
+// placeByRecency moves an element whose lastAccess was set back in time behind the entries
+// used more recently, so LRU eviction sees it as idle as it is. Callers must hold the
+// shard write lock
+func (s *cacheShard) placeByRecency(elem *list.Element) {
+	lastAccess := elem.Value.(*cacheEntry).lastAccess
+	mark := elem
+	for next := elem.Next(); next != nil && next.Value.(*cacheEntry).lastAccess > lastAccess; next = next.Next() {
+		mark = next
+	}
+	if mark != elem {
+		s.evictionQ.MoveAfter(elem, mark)
+	}
+}
+
+// dumpCommand handles DUMP
+func dumpCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'DUMP' command"}
+	}
+
+	payload, ok := cache.Dump(argString(args[0]))
+	if !ok {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: payload}
+}
+
+// restoreCommand handles RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds]
+func restoreCommand(args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'RESTORE' command"}
+	}
+
+	key := argString(args[0])
+	ttl, err := strconv.ParseInt(argString(args[1]), 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: errInvalidInteger.Error()}
+	}
+	if ttl < 0 {
+		return Value{typ: "error", str: "ERR Invalid TTL value, must be >= 0"}
+	}
+
+	replace, absTTL := false, false
+	idle := int64(-1)
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(argString(args[i])) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME":
+			if i+1 >= len(args) {
+				return Value{typ: "error", str: errSyntax.Error()}
+			}
+			i++
+			n, err := strconv.ParseInt(argString(args[i]), 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: errInvalidInteger.Error()}
+			}
+			if n < 0 {
+				return Value{typ: "error", str: "ERR Invalid IDLETIME value, must be >= 0"}
+			}
+			idle = n
+		default:
+			return Value{typ: "error", str: errSyntax.Error()}
+		}
+	}
+
+	value, err := decodeDump(argString(args[2]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if s, ok := value.(string); ok {
+		err = checkSize(key, s)
+	} else {
+		err = checkSize(key, "")
+	}
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if (&cacheEntry{value: value}).isEmpty() {
+		return Value{typ: "error", str: errBadDataFormat.Error()}
+	}
+
+	expireAt := ttl
+	if ttl > 0 && !absTTL {
+		expireAt = nowMillis() + ttl
+	}
+	if err := cache.Restore(key, value, expireAt, idle, replace); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "string", str: "OK"}
+}
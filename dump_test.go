@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+	"strconv"
+	"testing"
+)
+
+// dumpPayload wraps a type byte and an encoded value in a DUMP trailer with the given version
+func dumpPayload(body []byte, version uint16) string {
+	body = binary.LittleEndian.AppendUint16(body, version)
+	return string(binary.LittleEndian.AppendUint64(body, crc64.Checksum(body, crcTable)))
+}
+
+func TestDumpRestoreEveryType(t *testing.T) {
+	c := newTestCache(t, 0)
+	fillAllTypes(t)
+	want := cacheContent(c)
+	for key, value := range want {
+		payload := run("DUMP", key)
+		if payload.typ != "bulk" || payload.null {
+			t.Fatalf("DUMP %s = %+v", key, payload)
+		}
+		if reply := run("RESTORE", "copy:"+key, "0", payload.bulk); reply.str != "OK" {
+			t.Fatalf("RESTORE copy:%s = %+v", key, reply)
+		}
+		if got := cacheContent(c)["copy:"+key]; got != value {
+			t.Errorf("copy:%s = %q, want %q", key, got, value)
+		}
+	}
+	runCommands(t, []commandTest{
+		{[]string{"DUMP", "missing"}, "$nil"},
+		// the TTL isn't part of the payload
+		{[]string{"TTL", "copy:ttl"}, ":-1"},
+	})
+}
+
+func TestRestoreOptions(t *testing.T) {
+	c := newTestCache(t, 0)
+	run("SET", "src", "v")
+	payload := run("DUMP", "src").bulk
+	future := strconv.FormatInt(nowMillis()+100*1000, 10)
+	past := strconv.FormatInt(nowMillis()-1000, 10)
+
+	runCommands(t, []commandTest{
+		{[]string{"RESTORE", "src", "0", payload}, "-" + errBusyKey.Error()},
+		{[]string{"RESTORE", "src", "0", payload, "REPLACE"}, "+OK"},
+		{[]string{"RESTORE", "k", "50000", payload}, "+OK"},
+		{[]string{"TTL", "k"}, ":50"},
+		{[]string{"RESTORE", "k", future, payload, "REPLACE", "ABSTTL"}, "+OK"},
+		{[]string{"TTL", "k"}, ":100"},
+		// an expire time in the past replaces the key with nothing at all
+		{[]string{"RESTORE", "k", past, payload, "ABSTTL", "REPLACE"}, "+OK"},
+		{[]string{"EXISTS", "k"}, ":0"},
+		{[]string{"RESTORE", "k", "0", payload, "idletime", "1000"}, "+OK"},
+		{[]string{"EXISTS", "k"}, ":1"},
+
+		{[]string{"RESTORE", "x", "-1", payload}, "-ERR Invalid TTL value, must be >= 0"},
+		{[]string{"RESTORE", "x", "soon", payload}, "-" + errInvalidInteger.Error()},
+		{[]string{"RESTORE", "x", "0", payload, "IDLETIME", "-1"}, "-ERR Invalid IDLETIME value, must be >= 0"},
+		{[]string{"RESTORE", "x", "0", payload, "IDLETIME", "long"}, "-" + errInvalidInteger.Error()},
+		{[]string{"RESTORE", "x", "0", payload, "IDLETIME"}, "-" + errSyntax.Error()},
+		{[]string{"RESTORE", "x", "0", payload, "FORCE"}, "-" + errSyntax.Error()},
+		{[]string{"RESTORE", "x", "0"}, "-ERR wrong number of arguments for 'RESTORE' command"},
+		{[]string{"EXISTS", "x"}, ":0"},
+	})
+
+	// IDLETIME puts the key where a key idle for that long belongs in the LRU order
+	shard := c.getShard("k")
+	shard.mutex.RLock()
+	entry := shard.items["k"].Value.(*cacheEntry)
+	idle := nowMillis() - entry.lastAccess
+	shard.mutex.RUnlock()
+	if idle < 1000*1000 || idle > 1001*1000 {
+		t.Fatalf("restored with IDLETIME 1000, the key was last used %dms ago", idle)
+	}
+}
+
+func TestRestoreBadPayloads(t *testing.T) {
+	newTestCache(t, 0)
+	run("SET", "src", "v")
+	good := run("DUMP", "src").bulk
+	flipped := []byte(good)
+	flipped[1] ^= 1
+
+	badPayload, badFormat := "-"+errBadDumpPayload.Error(), "-"+errBadDataFormat.Error()
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{"empty", "", badPayload},
+		{"too short", good[:5], badPayload},
+		{"flipped bit", string(flipped), badPayload},
+		{"truncated", good[:len(good)-1], badPayload},
+		{"newer version", dumpPayload(appendValue([]byte{typeString}, "v"), snapshotVersion+1), badPayload},
+		{"unknown type", dumpPayload([]byte{42, 1, 'v'}, snapshotVersion), badFormat},
+		{"trailing bytes", dumpPayload(append(appendValue([]byte{typeString}, "v"), 0), snapshotVersion), badFormat},
+		{"short value", dumpPayload([]byte{typeString, 10, 'v'}, snapshotVersion), badFormat},
+		{"empty hash", dumpPayload(appendValue([]byte{typeHash}, hashValue{}), snapshotVersion), badFormat},
+	}
+	for _, tt := range tests {
+		if got := replyString(run("RESTORE", "k", "0", tt.payload)); got != tt.want {
+			t.Errorf("RESTORE with a %s payload = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	runCommands(t, []commandTest{{[]string{"EXISTS", "k"}, ":0"}})
+}
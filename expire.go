@@ -0,0 +1,373 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys with a TTL are removed in two ways, the same way redis does it:
+// 1. lazily, whenever a command touches a key that is already past its deadline
+// 2. actively, by a sweeper goroutine per shard that samples keys from the shard's expires map
+// The sweeper is what frees keys that are never read again (think abandoned session tokens).
+// A replica does neither, expired keys only look missing to its clients until the DEL of
+// its primary comes in (see propagate.go).
+const (
+	sweepInterval  = 100 * time.Millisecond // how often each shard is sampled
+	sweepSamples   = 20                     // keys looked at per sampling round
+	sweepMaxRounds = 16                     // cap so one shard can't hog its lock for too long
+)
+
+// expireCond holds the NX/XX/GT/LT flags of the EXPIRE family, XX can be combined with GT or LT
+type expireCond int
+
+const (
+	expireNX expireCond = 1 << iota // only set when the key has no TTL yet
+	expireXX                        // only set when the key already has a TTL
+	expireGT                        // only set when the new TTL is greater than the current one
+	expireLT                        // only set when the new TTL is less than the current one
+)
+
+var errInvalidInteger = errors.New("ERR value is not an integer or out of range")
+
+// nowMillis is the clock used for all TTL bookkeeping
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
+
+// isExpired reports whether the entry has a TTL that ran out at the given time
+func (e *cacheEntry) isExpired(now int64) bool {
+	return e.expireAt != 0 && e.expireAt <= now
+}
+
+// setExpire updates the TTL of an entry and keeps the shard's expires map in sync.
+// Callers must hold the shard write lock
+func (s *cacheShard) setExpire(elem *list.Element, expireAt int64) {
+	entry := elem.Value.(*cacheEntry)
+	entry.expireAt = expireAt
+	s.stats.changes.Add(1)
+	if expireAt == 0 {
+		delete(s.expires, entry.key)
+		return
+	}
+	s.expires[entry.key] = elem
+}
+
+// liveElement looks up a key for a caller that holds the shard write lock and the stripe
+// of the shard, a write command. A key whose TTL already ran out is removed on the spot
+// and reported as missing
+func (c *LRUCache) liveElement(shard *cacheShard, key string) (*list.Element, bool) {
+	elem, ok := shard.items[key]
+	if !ok {
+		return nil, false
+	}
+	if elem.Value.(*cacheEntry).isExpired(nowMillis()) {
+		if c.propagation.fromPrimary(key) {
+			return elem, true
+		}
+		c.removeExpired(shard, elem)
+		return nil, false
+	}
+	return elem, true
+}
+
+// readElement is liveElement for a command that only reads the key and holds no stripe.
+// An expired key is removed only if the stripe is free: a write to the shard that holds
+// it has to see its DEL propagated before its own command, see propagate.go. A replica
+// reports it as missing but leaves it to its primary
+func (c *LRUCache) readElement(shard *cacheShard, key string) (*list.Element, bool) {
+	elem, ok := shard.items[key]
+	if !ok {
+		return nil, false
+	}
+	if elem.Value.(*cacheEntry).isExpired(nowMillis()) {
+		p := c.propagation
+		switch {
+		case p.fromPrimary(key):
+			return elem, true
+		case p.replicated.Load():
+		default:
+			if unlock, ok := p.tryLockKey(key); ok {
+				c.removeExpired(shard, elem)
+				unlock()
+			}
+		}
+		return nil, false
+	}
+	return elem, true
+}
+
+// removeExpired removes an expired key and propagates it as a DEL. Callers hold the
+// shard write lock and the stripe of the shard
+func (c *LRUCache) removeExpired(shard *cacheShard, elem *list.Element) {
+	shard.removeElement(elem)
+	shard.stats.expired.Add(1)
+	c.propagation.removed(elem.Value.(*cacheEntry).key)
+}
+
+// expireKey removes a key that was found expired while holding only the read lock.
+// We have to check again after taking the write lock since another goroutine
+// may have replaced the key in the meantime. Like readElement it leaves the key
+// alone when a write holds the stripe, the next access removes it. A replica always
+// leaves it to its primary
+func (c *LRUCache) expireKey(shard *cacheShard, key string) {
+	if c.propagation.replicated.Load() {
+		return
+	}
+	unlock, ok := c.propagation.tryLockKey(key)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	shard.mutex.Lock()
+	if elem, ok := shard.items[key]; ok && elem.Value.(*cacheEntry).isExpired(nowMillis()) {
+		c.removeExpired(shard, elem)
+	}
+	shard.mutex.Unlock()
+}
+
+// runSweeper periodically removes expired keys from shard idx until the cache is closed
+func (c *LRUCache) runSweeper(idx uint32) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			// if more than a quarter of the sample was expired there are probably
+			// a lot more of them, so we keep going right away
+			for round := 0; round < sweepMaxRounds; round++ {
+				if c.sweepShard(idx) <= sweepSamples/4 {
+					break
+				}
+			}
+		}
+	}
+}
+
+// sweepShard samples keys with a TTL from shard idx and removes the expired ones.
+// It returns how many keys were removed. Replicas don't sweep, their primary does
+func (c *LRUCache) sweepShard(idx uint32) int {
+	if c.propagation.replicated.Load() {
+		return 0
+	}
+	shard := c.shards[idx]
+	now := nowMillis()
+	removed := 0
+
+	// the DELs are propagated in order with the writes to the shard
+	unlock := c.propagation.lockShard(idx)
+	defer unlock()
+	shard.mutex.Lock()
+	sampled := 0
+	// map iteration order is randomized in go, which gives us the random sample for free
+	for _, elem := range shard.expires {
+		if sampled == sweepSamples {
+			break
+		}
+		sampled++
+		if elem.Value.(*cacheEntry).isExpired(now) {
+			c.removeExpired(shard, elem)
+			removed++
+		}
+	}
+	shard.mutex.Unlock()
+	return removed
+}
+
+// Expire sets the TTL of an existing key to the given unix time in milliseconds.
+// A deadline in the past deletes the key right away. It returns false if the key
+// does not exist or the condition did not allow the change
+func (c *LRUCache) Expire(key string, expireAt int64, cond expireCond) bool {
+	shard := c.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	elem, ok := c.liveElement(shard, key)
+	if !ok {
+		return false
+	}
+
+	now := nowMillis()
+	entry := elem.Value.(*cacheEntry)
+
+	// a key without a TTL counts as having an infinite one for GT and LT
+	if cond&expireNX != 0 && entry.expireAt != 0 {
+		return false
+	}
+	if cond&expireXX != 0 && entry.expireAt == 0 {
+		return false
+	}
+	if cond&expireGT != 0 && (entry.expireAt == 0 || expireAt <= entry.expireAt) {
+		return false
+	}
+	if cond&expireLT != 0 && entry.expireAt != 0 && expireAt >= entry.expireAt {
+		return false
+	}
+
+	if expireAt <= now {
+		shard.removeElement(elem)
+		return true
+	}
+	shard.setExpire(elem, expireAt)
+	return true
+}
+
+// TTL returns the remaining time to live of a key in milliseconds,
+// -1 if the key has no TTL and -2 if the key does not exist
+func (c *LRUCache) TTL(key string) int64 {
+	shard := c.getShard(key)
+	shard.mutex.RLock()
+	elem, ok := shard.items[key]
+	if !ok {
+		shard.mutex.RUnlock()
+		return -2
+	}
+
+	now := nowMillis()
+	entry := elem.Value.(*cacheEntry)
+	if entry.isExpired(now) {
+		shard.mutex.RUnlock()
+		c.expireKey(shard, key)
+		return -2
+	}
+
+	expireAt := entry.expireAt
+	shard.mutex.RUnlock()
+
+	if expireAt == 0 {
+		return -1
+	}
+	return expireAt - now
+}
+
+// ExpireAt returns the unix time in milliseconds a key expires at,
+// or 0 if the key does not exist or has no TTL
+func (c *LRUCache) ExpireAt(key string) int64 {
+	shard := c.getShard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	elem, ok := shard.items[key]
+	if !ok || elem.Value.(*cacheEntry).isExpired(nowMillis()) {
+		return 0
+	}
+	return elem.Value.(*cacheEntry).expireAt
+}
+
+// Persist removes the TTL of a key, it returns false if the key
+// does not exist or had no TTL to begin with
+func (c *LRUCache) Persist(key string) bool {
+	shard := c.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	elem, ok := c.liveElement(shard, key)
+	if !ok {
+		return false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if entry.expireAt == 0 {
+		return false
+	}
+
+	shard.setExpire(elem, 0)
+	return true
+}
+
+// parseExpireArg converts the argument of an EX/PX/EXAT/PXAT style option into an
+// absolute unix time in milliseconds. SET does not accept zero or negative values
+// while the EXPIRE family does (the key is simply deleted), hence allowNonPositive
+func parseExpireArg(unit, arg, cmdName string, allowNonPositive bool) (int64, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errInvalidInteger
+	}
+
+	invalid := fmt.Errorf("ERR invalid expire time in '%s' command", cmdName)
+	if n <= 0 && !allowNonPositive {
+		return 0, invalid
+	}
+
+	// seconds have to be scaled to milliseconds first, watching out for overflow
+	if unit == "EX" || unit == "EXAT" {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return 0, invalid
+		}
+		n *= 1000
+	}
+
+	// relative values are added on top of the current time
+	if unit == "EX" || unit == "PX" {
+		now := nowMillis()
+		if n > math.MaxInt64-now {
+			return 0, invalid
+		}
+		n += now
+	}
+
+	return n, nil
+}
+
+// expireCommand handles EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT
+func expireCommand(cmd string, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	// parse the NX/XX/GT/LT flags, redis allows GT and LT to be combined with XX only
+	var cond expireCond
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(argString(arg)) {
+		case "NX":
+			cond |= expireNX
+		case "XX":
+			cond |= expireXX
+		case "GT":
+			cond |= expireGT
+		case "LT":
+			cond |= expireLT
+		default:
+			return Value{typ: "error", str: fmt.Sprintf("ERR Unsupported option %s", argString(arg))}
+		}
+	}
+	if cond&expireNX != 0 && cond != expireNX {
+		return Value{typ: "error", str: "ERR NX and XX, GT or LT options at the same time are not compatible"}
+	}
+	if cond&expireGT != 0 && cond&expireLT != 0 {
+		return Value{typ: "error", str: "ERR GT and LT options at the same time are not compatible"}
+	}
+
+	unit := map[string]string{"EXPIRE": "EX", "PEXPIRE": "PX", "EXPIREAT": "EXAT", "PEXPIREAT": "PXAT"}[cmd]
+	expireAt, err := parseExpireArg(unit, argString(args[1]), strings.ToLower(cmd), true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if cache.Expire(argString(args[0]), expireAt, cond) {
+		return Value{typ: "integer", num: 1}
+	}
+	return Value{typ: "integer", num: 0}
+}
+
+// ttlCommand handles TTL (seconds) and PTTL (milliseconds)
+func ttlCommand(cmd string, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	ttl := cache.TTL(argString(args[0]))
+	if ttl < 0 || cmd == "PTTL" {
+		return Value{typ: "integer", num: int(ttl)}
+	}
+	// round to the nearest second like redis does
+	return Value{typ: "integer", num: int((ttl + 500) / 1000)}
+}
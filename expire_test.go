@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	newTestCache(t, 0)
+	runCommands(t, []commandTest{
+		{[]string{"TTL", "missing"}, ":-2"},
+		{[]string{"EXPIRE", "missing", "100"}, ":0"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"TTL", "k"}, ":-1"},
+		{[]string{"EXPIRE", "k", "100"}, ":1"},
+		{[]string{"TTL", "k"}, ":100"},
+		{[]string{"PEXPIRE", "k", "5000"}, ":1"},
+		{[]string{"TTL", "k"}, ":5"},
+
+		// NX only sets a first TTL, XX only replaces one, GT and LT compare with it
+		{[]string{"EXPIRE", "k", "100", "NX"}, ":0"},
+		{[]string{"EXPIRE", "k", "100", "XX"}, ":1"},
+		{[]string{"EXPIRE", "k", "50", "GT"}, ":0"},
+		{[]string{"EXPIRE", "k", "200", "gt"}, ":1"},
+		{[]string{"TTL", "k"}, ":200"},
+		{[]string{"EXPIRE", "k", "300", "LT"}, ":0"},
+		{[]string{"EXPIRE", "k", "150", "XX", "LT"}, ":1"},
+		{[]string{"TTL", "k"}, ":150"},
+
+		{[]string{"PERSIST", "k"}, ":1"},
+		{[]string{"PERSIST", "k"}, ":0"},
+		{[]string{"TTL", "k"}, ":-1"},
+		{[]string{"EXPIRE", "k", "100", "XX"}, ":0"},
+		// a key without a TTL lives forever: nothing is greater, everything is less
+		{[]string{"EXPIRE", "k", "100", "GT"}, ":0"},
+		{[]string{"EXPIRE", "k", "100", "LT"}, ":1"},
+		{[]string{"PERSIST", "k"}, ":1"},
+		{[]string{"EXPIRE", "k", "100", "NX"}, ":1"},
+
+		{[]string{"EXPIRE", "k", "100", "NX", "XX"}, "-ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{[]string{"EXPIRE", "k", "100", "NX", "GT"}, "-ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{[]string{"EXPIRE", "k", "100", "GT", "LT"}, "-ERR GT and LT options at the same time are not compatible"},
+		{[]string{"EXPIRE", "k", "100", "SOON"}, "-ERR Unsupported option SOON"},
+		{[]string{"EXPIRE", "k", "soon"}, "-" + errInvalidInteger.Error()},
+		{[]string{"EXPIRE", "k", "9223372036854775807"}, "-ERR invalid expire time in 'expire' command"},
+		{[]string{"EXPIRE", "k"}, "-ERR wrong number of arguments for 'EXPIRE' command"},
+		{[]string{"TTL", "k"}, ":100"},
+
+		// a deadline in the past deletes the key right away
+		{[]string{"EXPIREAT", "k", "1"}, ":1"},
+		{[]string{"EXISTS", "k"}, ":0"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"PEXPIRE", "k", "-1"}, ":1"},
+		{[]string{"EXISTS", "k"}, ":0"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"PEXPIREAT", "k", "4102444800000"}, ":1"},
+		{[]string{"PERSIST", "k"}, ":1"},
+	})
+}
+
+func TestSetExpireOptions(t *testing.T) {
+	newTestCache(t, 0)
+	runCommands(t, []commandTest{
+		{[]string{"SET", "k", "v", "EX", "100"}, "+OK"},
+		{[]string{"TTL", "k"}, ":100"},
+		{[]string{"SET", "k", "v", "px", "20000"}, "+OK"},
+		{[]string{"TTL", "k"}, ":20"},
+		// a plain SET forgets the TTL
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"TTL", "k"}, ":-1"},
+		{[]string{"SET", "k", "v", "EXAT", "4102444800"}, "+OK"},
+		{[]string{"PERSIST", "k"}, ":1"},
+		{[]string{"SET", "k", "v", "PXAT", "4102444800000"}, "+OK"},
+		{[]string{"PERSIST", "k"}, ":1"},
+
+		// an absolute deadline already gone by stores a key nobody can see
+		{[]string{"SET", "old", "v", "EXAT", "1"}, "+OK"},
+		{[]string{"GET", "old"}, "$nil"},
+		{[]string{"TTL", "old"}, ":-2"},
+
+		{[]string{"SET", "k", "v", "EX", "0"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "k", "v", "PX", "-5"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "k", "v", "EX", "ten"}, "-" + errInvalidInteger.Error()},
+		{[]string{"SET", "k", "v", "EX", "9223372036854775807"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"TTL", "k"}, ":-1"},
+	})
+}
+
+func TestExpiredKeysAreRemoved(t *testing.T) {
+	c := newTestCache(t, 0)
+	for i := 0; i < 100; i++ {
+		runCommands(t, []commandTest{{[]string{"SET", "session:" + strconv.Itoa(i), "token", "PX", "10"}, "+OK"}})
+	}
+	runCommands(t, []commandTest{{[]string{"SET", "lazy", "v", "PX", "10"}, "+OK"}})
+	time.Sleep(20 * time.Millisecond)
+
+	// a read finds the key expired and removes it
+	runCommands(t, []commandTest{
+		{[]string{"GET", "lazy"}, "$nil"},
+		{[]string{"EXISTS", "lazy"}, ":0"},
+	})
+
+	// the sweeper removes the keys nobody reads again
+	for idx := range c.shards {
+		for c.sweepShard(uint32(idx)) > 0 {
+		}
+	}
+	var expired int64
+	for _, shard := range c.shards {
+		expired += shard.stats.expired.Load()
+	}
+	if expired != 101 {
+		t.Fatalf("%d keys expired, want 101", expired)
+	}
+	for _, shard := range c.shards {
+		shard.mutex.RLock()
+		left := len(shard.items)
+		shard.mutex.RUnlock()
+		if left != 0 {
+			t.Fatalf("a shard still holds %d expired keys", left)
+		}
+	}
+}
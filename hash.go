@@ -0,0 +1,430 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// hashValue is the value of a hash key, a map from field to value
+type hashValue map[string]string
+
+var (
+	errHashNotInteger = errors.New("ERR hash value is not an integer")
+	errHashNotFloat   = errors.New("ERR hash value is not a float")
+)
+
+// HSet stores field-value pairs in the hash at key, creating it if needed. With
+// onlyIfMissing fields that already exist are left alone (HSETNX).
+// It returns how many fields were newly added
+func (c *LRUCache) HSet(key string, fields, values []string, onlyIfMissing bool) (int, error) {
+	added := 0
+	err := c.mutate(key, "hash", true, func(entry *cacheEntry) error {
+		h := entry.value.(hashValue)
+		for i, field := range fields {
+			_, exists := h[field]
+			if exists && onlyIfMissing {
+				continue
+			}
+			if !exists {
+				added++
+			}
+			h[field] = values[i]
+		}
+		return nil
+	})
+	return added, err
+}
+
+// HGet returns the value of a single field
+func (c *LRUCache) HGet(key, field string) (string, bool, error) {
+	values, found, err := c.HMGet(key, []string{field})
+	if err != nil {
+		return "", false, err
+	}
+	return values[0], found[0], nil
+}
+
+// HMGet returns the values of several fields, a missing key behaves like an empty hash
+func (c *LRUCache) HMGet(key string, fields []string) ([]string, []bool, error) {
+	values := make([]string, len(fields))
+	found := make([]bool, len(fields))
+	err := c.view(key, "hash", func(entry *cacheEntry) {
+		if entry == nil {
+			return
+		}
+		h := entry.value.(hashValue)
+		for i, field := range fields {
+			values[i], found[i] = h[field]
+		}
+	})
+	return values, found, err
+}
+
+// HDel removes fields from the hash at key and returns how many were removed.
+// The key itself goes away together with its last field
+func (c *LRUCache) HDel(key string, fields []string) (int, error) {
+	removed := 0
+	err := c.mutate(key, "hash", false, func(entry *cacheEntry) error {
+		if entry == nil {
+			return nil
+		}
+		h := entry.value.(hashValue)
+		for _, field := range fields {
+			if _, ok := h[field]; ok {
+				delete(h, field)
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// HGetAll returns all fields and values of the hash as a flat field, value, ... list
+func (c *LRUCache) HGetAll(key string) ([]string, error) {
+	var pairs []string
+	err := c.view(key, "hash", func(entry *cacheEntry) {
+		if entry == nil {
+			return
+		}
+		h := entry.value.(hashValue)
+		pairs = make([]string, 0, len(h)*2)
+		for field, value := range h {
+			pairs = append(pairs, field, value)
+		}
+	})
+	return pairs, err
+}
+
+// HLen returns the number of fields in the hash
+func (c *LRUCache) HLen(key string) (int, error) {
+	n := 0
+	err := c.view(key, "hash", func(entry *cacheEntry) {
+		if entry != nil {
+			n = len(entry.value.(hashValue))
+		}
+	})
+	return n, err
+}
+
+// HIncrBy atomically adds delta to the integer stored in a hash field
+func (c *LRUCache) HIncrBy(key, field string, delta int64) (int64, error) {
+	var result int64
+	err := c.mutate(key, "hash", true, func(entry *cacheEntry) error {
+		h := entry.value.(hashValue)
+		var current int64
+		if old, ok := h[field]; ok {
+			n, err := parseInteger(old)
+			if err != nil {
+				return errHashNotInteger
+			}
+			current = n
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return errOverflow
+		}
+		result = current + delta
+		h[field] = strconv.FormatInt(result, 10)
+		return nil
+	})
+	return result, err
+}
+
+// HIncrByFloat atomically adds delta to the number stored in a hash field
+func (c *LRUCache) HIncrByFloat(key, field string, delta float64) (float64, error) {
+	var result float64
+	err := c.mutate(key, "hash", true, func(entry *cacheEntry) error {
+		h := entry.value.(hashValue)
+		var current float64
+		if old, ok := h[field]; ok {
+			f, err := strconv.ParseFloat(old, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return errHashNotFloat
+			}
+			current = f
+		}
+		result = current + delta
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return errNaNOrInf
+		}
+		h[field] = formatFloat(result)
+		return nil
+	})
+	return result, err
+}
+
+// HScan returns a batch of matching field, value pairs (or only fields with noValues)
+// and the cursor for the next call, see scanBatch for how the cursor works
+func (c *LRUCache) HScan(key string, cursor uint64, opts scanOptions) ([]string, uint64, error) {
+	var reply []string
+	var next uint64
+	err := c.view(key, "hash", func(entry *cacheEntry) {
+		if entry == nil {
+			return
+		}
+		h := entry.value.(hashValue)
+		fields := make([]string, 0, len(h))
+		for field := range h {
+			fields = append(fields, field)
+		}
+
+		var batch []string
+		batch, next = scanBatch(fields, cursor, opts.count)
+		for _, field := range batch {
+			if opts.match != "" && !globMatch(opts.match, field) {
+				continue
+			}
+			reply = append(reply, field)
+			if !opts.noValues {
+				reply = append(reply, h[field])
+			}
+		}
+	})
+	return reply, next, err
+}
+
+// bulkArray turns a list of strings into a RESP array of bulk strings
+func bulkArray(items []string) Value {
+	array := make([]Value, len(items))
+	for i, item := range items {
+		array[i] = Value{typ: "bulk", bulk: item}
+	}
+	return Value{typ: "array", array: array}
+}
+
+// hsetCommand handles HSET (integer reply) and the older HMSET (OK reply)
+func hsetCommand(cmd string, args []Value) Value {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	key := argString(args[0])
+	fields := make([]string, 0, len(args)/2)
+	values := make([]string, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		field, value := argString(args[i]), argString(args[i+1])
+		if err := checkSize(key, field); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if err := checkSize(key, value); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		fields = append(fields, field)
+		values = append(values, value)
+	}
+
+	added, err := cache.HSet(key, fields, values, false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if cmd == "HMSET" {
+		return Value{typ: "string", str: "OK"}
+	}
+	return Value{typ: "integer", num: added}
+}
+
+// hsetnxCommand handles HSETNX
+func hsetnxCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'HSETNX' command"}
+	}
+
+	key, field, value := argString(args[0]), argString(args[1]), argString(args[2])
+	if err := checkSize(key, field); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if err := checkSize(key, value); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	added, err := cache.HSet(key, []string{field}, []string{value}, true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: added}
+}
+
+// hgetCommand handles HGET
+func hgetCommand(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'HGET' command"}
+	}
+
+	value, ok, err := cache.HGet(argString(args[0]), argString(args[1]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: value}
+}
+
+// hmgetCommand handles HMGET, missing fields show up as nil elements
+func hmgetCommand(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'HMGET' command"}
+	}
+
+	fields := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		fields[i] = argString(arg)
+	}
+
+	values, found, err := cache.HMGet(argString(args[0]), fields)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	reply := make([]Value, len(fields))
+	for i := range fields {
+		if found[i] {
+			reply[i] = Value{typ: "bulk", bulk: values[i]}
+		} else {
+			reply[i] = Value{typ: "bulk", null: true}
+		}
+	}
+	return Value{typ: "array", array: reply}
+}
+
+// hdelCommand handles HDEL
+func hdelCommand(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'HDEL' command"}
+	}
+
+	fields := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		fields[i] = argString(arg)
+	}
+
+	removed, err := cache.HDel(argString(args[0]), fields)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: removed}
+}
+
+// hgetallCommand handles HGETALL, HKEYS and HVALS, which are all views of the same pairs
+func hgetallCommand(cmd string, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	pairs, err := cache.HGetAll(argString(args[0]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	switch cmd {
+	case "HKEYS", "HVALS":
+		offset := 0
+		if cmd == "HVALS" {
+			offset = 1
+		}
+		items := make([]string, 0, len(pairs)/2)
+		for i := offset; i < len(pairs); i += 2 {
+			items = append(items, pairs[i])
+		}
+		return bulkArray(items)
+	default:
+		return bulkArray(pairs)
+	}
+}
+
+// hlenCommand handles HLEN
+func hlenCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'HLEN' command"}
+	}
+
+	n, err := cache.HLen(argString(args[0]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: n}
+}
+
+// hexistsCommand handles HEXISTS
+func hexistsCommand(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'HEXISTS' command"}
+	}
+
+	_, ok, err := cache.HGet(argString(args[0]), argString(args[1]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if ok {
+		return Value{typ: "integer", num: 1}
+	}
+	return Value{typ: "integer", num: 0}
+}
+
+// hincrbyCommand handles HINCRBY
+func hincrbyCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'HINCRBY' command"}
+	}
+
+	delta, err := parseInteger(argString(args[2]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	key, field := argString(args[0]), argString(args[1])
+	if err := checkSize(key, field); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	result, err := cache.HIncrBy(key, field, delta)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: int(result)}
+}
+
+// hincrbyfloatCommand handles HINCRBYFLOAT
+func hincrbyfloatCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'HINCRBYFLOAT' command"}
+	}
+
+	delta, err := strconv.ParseFloat(argString(args[2]), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return Value{typ: "error", str: errInvalidFloat.Error()}
+	}
+
+	key, field := argString(args[0]), argString(args[1])
+	if err := checkSize(key, field); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	result, err := cache.HIncrByFloat(key, field, delta)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "bulk", bulk: formatFloat(result)}
+}
+
+// hscanCommand handles HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES]
+func hscanCommand(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'HSCAN' command"}
+	}
+
+	cursor, opts, err := parseScanArgs(argString(args[1]), args[2:], "NOVALUES")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	items, next, err := cache.HScan(argString(args[0]), cursor, opts)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.FormatUint(next, 10)},
+		bulkArray(items),
+	}}
+}
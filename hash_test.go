@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHashCommands(t *testing.T) {
+	newTestCache(t, 0)
+	runCommands(t, []commandTest{
+		{[]string{"HSET", "h", "name", "gored", "port", "6379"}, ":2"},
+		{[]string{"HSET", "h", "name", "redis", "lang", "go"}, ":1"},
+		{[]string{"HGET", "h", "name"}, "$redis"},
+		{[]string{"HGET", "h", "missing"}, "$nil"},
+		{[]string{"HGET", "missing", "name"}, "$nil"},
+		{[]string{"HMGET", "h", "port", "missing", "lang"}, "*[6379 nil go]"},
+		{[]string{"HMGET", "missing", "a", "b"}, "*[nil nil]"},
+		{[]string{"HLEN", "h"}, ":3"},
+		{[]string{"HEXISTS", "h", "lang"}, ":1"},
+		{[]string{"HEXISTS", "h", "missing"}, ":0"},
+		{[]string{"HMSET", "h", "lang", "c"}, "+OK"},
+		{[]string{"HSETNX", "h", "lang", "go"}, ":0"},
+		{[]string{"HSETNX", "h", "new", "v"}, ":1"},
+		{[]string{"HGET", "h", "lang"}, "$c"},
+		{[]string{"HSET", "h", "name"}, "-ERR wrong number of arguments for 'HSET' command"},
+		{[]string{"HSET", "h", "a", "1", "b"}, "-ERR wrong number of arguments for 'HSET' command"},
+
+		// removing the last field removes the key
+		{[]string{"HDEL", "h", "name", "missing", "name"}, ":1"},
+		{[]string{"HDEL", "h", "port", "lang", "new"}, ":3"},
+		{[]string{"EXISTS", "h"}, ":0"},
+		{[]string{"HDEL", "h", "port"}, ":0"},
+		{[]string{"HGETALL", "h"}, "*[]"},
+		{[]string{"HSET", "h", "only", "one"}, ":1"},
+		{[]string{"HGETALL", "h"}, "*[only one]"},
+		{[]string{"HKEYS", "h"}, "*[only]"},
+		{[]string{"HVALS", "h"}, "*[one]"},
+	})
+}
+
+func TestHashIncrements(t *testing.T) {
+	newTestCache(t, 0)
+	runCommands(t, []commandTest{
+		{[]string{"HINCRBY", "h", "n", "5"}, ":5"},
+		{[]string{"HINCRBY", "h", "n", "-7"}, ":-2"},
+		{[]string{"HGET", "h", "n"}, "$-2"},
+		{[]string{"HINCRBY", "h", "n", "+1"}, "-" + errInvalidInteger.Error()},
+		{[]string{"HINCRBY", "h", "n", "1.5"}, "-" + errInvalidInteger.Error()},
+		{[]string{"HSET", "h", "max", "9223372036854775807", "text", "abc", "padded", " 1"}, ":3"},
+		{[]string{"HINCRBY", "h", "max", "1"}, "-" + errOverflow.Error()},
+		{[]string{"HINCRBY", "h", "text", "1"}, "-" + errHashNotInteger.Error()},
+		{[]string{"HINCRBY", "h", "padded", "1"}, "-" + errHashNotInteger.Error()},
+		{[]string{"HGET", "h", "max"}, "$9223372036854775807"},
+
+		{[]string{"HINCRBYFLOAT", "h", "f", "1.5"}, "$1.5"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "-0.25"}, "$1.25"},
+		{[]string{"HINCRBYFLOAT", "h", "n", "0.5"}, "$-1.5"},
+		{[]string{"HINCRBYFLOAT", "h", "f", "1e400"}, "-" + errInvalidFloat.Error()},
+		{[]string{"HINCRBYFLOAT", "h", "f", "nan"}, "-" + errInvalidFloat.Error()},
+		{[]string{"HINCRBYFLOAT", "h", "text", "1"}, "-" + errHashNotFloat.Error()},
+		{[]string{"HSET", "h", "big", "1.7e308"}, ":1"},
+		{[]string{"HINCRBYFLOAT", "h", "big", "1.7e308"}, "-" + errNaNOrInf.Error()},
+	})
+}
+
+func TestHashWrongType(t *testing.T) {
+	newTestCache(t, 0)
+	wrongType := "-" + errWrongType.Error()
+	runCommands(t, []commandTest{
+		{[]string{"SET", "s", "v"}, "+OK"},
+		{[]string{"HSET", "h", "f", "v"}, ":1"},
+
+		{[]string{"HSET", "s", "f", "v"}, wrongType},
+		{[]string{"HGET", "s", "f"}, wrongType},
+		{[]string{"HMGET", "s", "f"}, wrongType},
+		{[]string{"HDEL", "s", "f"}, wrongType},
+		{[]string{"HGETALL", "s"}, wrongType},
+		{[]string{"HLEN", "s"}, wrongType},
+		{[]string{"HINCRBY", "s", "f", "1"}, wrongType},
+		{[]string{"HSCAN", "s", "0"}, wrongType},
+
+		{[]string{"GET", "h"}, wrongType},
+		{[]string{"APPEND", "h", "v"}, wrongType},
+		{[]string{"INCR", "h"}, wrongType},
+		{[]string{"STRLEN", "h"}, wrongType},
+		{[]string{"GET", "s"}, "$v"},
+		{[]string{"HGET", "h", "f"}, "$v"},
+	})
+}
+
+func TestHashScanAndMemory(t *testing.T) {
+	c := newTestCache(t, 0)
+	var want []string
+	for i := 0; i < 500; i++ {
+		field := "field:" + strconv.Itoa(i)
+		runCommands(t, []commandTest{{[]string{"HSET", "h", field, strings.Repeat("v", 100)}, ":1"}})
+		want = append(want, field)
+	}
+
+	// a hash is charged for its fields, not just for an empty entry
+	if used := c.usedMemory.Load(); used < 500*100 {
+		t.Fatalf("used_memory = %d with 50kb in a hash", used)
+	}
+
+	// HSCAN sees every field exactly once
+	var got []string
+	cursor := "0"
+	for {
+		reply := run("HSCAN", "h", cursor, "COUNT", "30", "NOVALUES")
+		if reply.typ != "array" {
+			t.Fatalf("HSCAN = %+v", reply)
+		}
+		for _, field := range reply.array[1].array {
+			got = append(got, field.bulk)
+		}
+		if cursor = reply.array[0].bulk; cursor == "0" {
+			break
+		}
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("HSCAN returned %d fields, want the %d that were set", len(got), len(want))
+	}
+
+	runCommands(t, []commandTest{
+		{[]string{"HSCAN", "h", "0", "MATCH", "field:4[2]", "COUNT", "1000"}, "*[0 *[field:42 " + strings.Repeat("v", 100) + "]]"},
+		{[]string{"HSCAN", "h", "0", "MATCH", "nothing*", "COUNT", "1000"}, "*[0 *[]]"},
+	})
+
+	run("DEL", "h")
+	if used := c.usedMemory.Load(); used != 0 {
+		t.Fatalf("used_memory = %d after the hash was deleted", used)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// lazyFreeBacklog is how many unlinked entries can wait for the background goroutine
+// before UNLINK falls back to simply dropping the reference
+const lazyFreeBacklog = 1024
+
+var errNoSuchKey = errors.New("ERR no such key")
+
+// lockKeys write-locks every shard touched by the given keys exactly once, in shard
+// index order. Taking the locks in the same global order everywhere is what keeps
+// multi-key commands from deadlocking each other. It returns the unlock function
+func (c *LRUCache) lockKeys(keys ...string) func() {
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, int(c.shardIndex(key)))
+	}
+	sort.Ints(indexes)
+
+	// drop duplicates, a RWMutex can't be locked twice by the same goroutine
+	locked := indexes[:0]
+	for i, idx := range indexes {
+		if i > 0 && idx == indexes[i-1] {
+			continue
+		}
+		locked = append(locked, idx)
+	}
+
+	for _, idx := range locked {
+		c.shards[idx].mutex.Lock()
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			c.shards[locked[i]].mutex.Unlock()
+		}
+	}
+}
+
+// groupByShard buckets the positions of keys by the shard they live in, so batch
+// commands can visit every shard once instead of once per key
+func (c *LRUCache) groupByShard(keys []string) map[uint32][]int {
+	groups := make(map[uint32][]int)
+	for i, key := range keys {
+		idx := c.shardIndex(key)
+		groups[idx] = append(groups[idx], i)
+	}
+	return groups
+}
+
+// remove takes a key out of its shard and hands back the entry that was stored
+func (c *LRUCache) remove(key string) (*cacheEntry, bool) {
+	shard := c.getShard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	elem, ok := c.liveElement(shard, key)
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	shard.removeElement(elem)
+	return entry, true
+}
+
+// Delete removes a key from the cache, it returns false if the key did not exist
+func (c *LRUCache) Delete(key string) bool {
+	_, ok := c.remove(key)
+	return ok
+}
+
+// Unlink removes a key like Delete does, but the value itself is released by a background
+// goroutine. Only the map and list bookkeeping happens under the shard lock, which keeps
+// deleting very large values from stalling other clients of the same shard
+func (c *LRUCache) Unlink(key string) bool {
+	entry, ok := c.remove(key)
+	if !ok {
+		return false
+	}
+
+	select {
+	case c.lazyFree <- entry:
+	default:
+		// the backlog is full, the garbage collector will take care of it on its own
+	}
+	return true
+}
+
+// runLazyFree releases the entries queued up by Unlink until the cache is closed
+func (c *LRUCache) runLazyFree() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case entry := <-c.lazyFree:
+			entry.release()
+		}
+	}
+}
+
+// release drops the references an unlinked entry still holds so the memory
+// can be reclaimed even if something else is still pointing at the entry
+func (e *cacheEntry) release() {
+	switch v := e.value.(type) {
+	case hashValue:
+		clear(v)
+	case *listValue:
+		v.replace(nil)
+	case setValue:
+		clear(v)
+	case *zsetValue:
+		clear(v.dict)
+		v.zsl = newSkiplist()
+	}
+	e.value = nil
+}
+
+// Exists reports whether a key is present without touching its recency
+func (c *LRUCache) Exists(key string) bool {
+	shard := c.getShard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	elem, ok := shard.items[key]
+	return ok && !elem.Value.(*cacheEntry).isExpired(nowMillis())
+}
+
+// Type returns the redis type name of the value stored at key, or "none"
+func (c *LRUCache) Type(key string) string {
+	shard := c.getShard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	elem, ok := shard.items[key]
+	if !ok || elem.Value.(*cacheEntry).isExpired(nowMillis()) {
+		return "none"
+	}
+	return elem.Value.(*cacheEntry).typeName()
+}
+
+// Rename moves the value (and TTL) of src to dst, overwriting dst unless onlyIfMissing is set.
+// Both shards are locked for the whole move so nobody can observe the key in both or neither
+// place. It returns false when onlyIfMissing prevented the rename
+func (c *LRUCache) Rename(src, dst string, onlyIfMissing bool) (bool, error) {
+	unlock := c.lockKeys(src, dst)
+	defer unlock()
+
+	srcShard, dstShard := c.getShard(src), c.getShard(dst)
+	elem, ok := c.liveElement(srcShard, src)
+	if !ok {
+		return false, errNoSuchKey
+	}
+
+	// renaming a key to itself is a no-op, RENAMENX reports it as not renamed
+	if src == dst {
+		return !onlyIfMissing, nil
+	}
+
+	if old, exists := c.liveElement(dstShard, dst); exists {
+		if onlyIfMissing {
+			return false, nil
+		}
+		dstShard.removeElement(old)
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	srcShard.removeElement(elem)
+	entry.key = dst
+	c.serveNewList(dstShard, c.addEntry(dstShard, entry))
+	return true, nil
+}
+
+// delCommand handles DEL and UNLINK, both reply with the number of keys removed
+func delCommand(cmd string, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	removed := 0
+	for _, arg := range args {
+		var ok bool
+		if cmd == "UNLINK" {
+			ok = cache.Unlink(argString(arg))
+		} else {
+			ok = cache.Delete(argString(arg))
+		}
+		if ok {
+			removed++
+		}
+	}
+	return Value{typ: "integer", num: removed}
+}
+
+// existsCommand handles EXISTS, a key given several times is counted several times
+func existsCommand(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'EXISTS' command"}
+	}
+
+	count := 0
+	for _, arg := range args {
+		if cache.Exists(argString(arg)) {
+			count++
+		}
+	}
+	return Value{typ: "integer", num: count}
+}
+
+// typeCommand handles TYPE
+func typeCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'TYPE' command"}
+	}
+	return Value{typ: "string", str: cache.Type(argString(args[0]))}
+}
+
+// renameCommand handles RENAME (simple string reply) and RENAMENX (integer reply)
+func renameCommand(cmd string, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	renamed, err := cache.Rename(argString(args[0]), argString(args[1]), cmd == "RENAMENX")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if cmd == "RENAME" {
+		return Value{typ: "string", str: "OK"}
+	}
+	if renamed {
+		return Value{typ: "integer", num: 1}
+	}
+	return Value{typ: "integer", num: 0}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// Size limits
+//
+// proto-max-bulk-len caps every bulk string a client sends. It is checked by the RESP
+// parser before anything is allocated, a client claiming a gigabyte long argument must not
+// make us reserve that gigabyte. It defaults to 512mb like in redis. max-key-size and
+// max-value-size are checked by the commands and keep the 256 byte limit keys and values
+// always had, raise them for bigger values. All three are read from the environment
+// (MAX_VALUE_SIZE=1mb) at startup or changed with CONFIG SET.
+const (
+	defaultKeySize   = 256
+	defaultValueSize = 256
+	defaultBulkLen   = 512 << 20
+)
+
+var (
+	maxKeySize   = limitFromEnv("max-key-size", defaultKeySize)
+	maxValueSize = limitFromEnv("max-value-size", defaultValueSize)
+	maxBulkLen   = limitFromEnv("proto-max-bulk-len", defaultBulkLen)
+)
+
+// errBulkTooLong is what a client gets for a bulk string over proto-max-bulk-len
+var errBulkTooLong = errors.New("ERR Protocol error: invalid bulk length")
+
+// limitFromEnv returns a size limit holding def, or the value found in the environment
+// for the setting
+func limitFromEnv(param string, def int64) *atomic.Int64 {
+	limit := &atomic.Int64{}
+	limit.Store(def)
+	if value := os.Getenv(envName(param)); value != "" {
+		if n, err := parseMemory(value); err == nil && n > 0 {
+			limit.Store(n)
+		} else {
+			fmt.Printf("Ignoring %s: invalid size %q\n", envName(param), value)
+		}
+	}
+	return limit
+}
+
+// limitParam exposes a size limit as a CONFIG setting
+func limitParam(limit *atomic.Int64) configParam {
+	return configParam{
+		get: func() string { return strconv.FormatInt(limit.Load(), 10) },
+		set: func(value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return errors.New("the limit must be greater than 0")
+			}
+			limit.Store(n)
+			return nil
+		},
+	}
+}
+
+// checkSize validates a key and value against the size limits
+func checkSize(key, val string) error {
+	if limit := maxKeySize.Load(); int64(len(key)) > limit {
+		return fmt.Errorf("ERR key too long (max %d bytes)", limit)
+	}
+	if limit := maxValueSize.Load(); int64(len(val)) > limit {
+		return fmt.Errorf("ERR value too long (max %d bytes)", limit)
+	}
+	return nil
+}
+
+// errValueTooLong is returned when a command would grow a value past maxValueSize
+func errValueTooLong() error {
+	return fmt.Errorf("ERR string exceeds maximum allowed size (%d bytes)", maxValueSize.Load())
+}
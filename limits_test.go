@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// keepLimits puts the size limits back the way they were when the test is done
+func keepLimits(t *testing.T) {
+	t.Helper()
+	for _, limit := range []*atomic.Int64{maxKeySize, maxValueSize, maxBulkLen} {
+		old := limit.Load()
+		t.Cleanup(func() { limit.Store(old) })
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	newTestCache(t, 0)
+	keepLimits(t)
+	long := strings.Repeat("x", 257)
+
+	runCommands(t, []commandTest{
+		// keys and values keep their 256 byte limit, bulk strings get the 512mb of redis
+		{[]string{"CONFIG", "GET", "max-key-size"}, "*[max-key-size 256]"},
+		{[]string{"CONFIG", "GET", "max-value-size"}, "*[max-value-size 256]"},
+		{[]string{"CONFIG", "GET", "proto-max-bulk-len"}, "*[proto-max-bulk-len 536870912]"},
+
+		{[]string{"SET", long[:256], long[:256]}, "+OK"},
+		{[]string{"SET", long, "v"}, "-ERR key too long (max 256 bytes)"},
+		{[]string{"SET", "k", long}, "-ERR value too long (max 256 bytes)"},
+		{[]string{"RPUSH", "list", long}, "-ERR value too long (max 256 bytes)"},
+		{[]string{"SET", "k", long[:200]}, "+OK"},
+		{[]string{"APPEND", "k", long[:57]}, "-ERR string exceeds maximum allowed size (256 bytes)"},
+		{[]string{"SETRANGE", "k", "256", "x"}, "-ERR string exceeds maximum allowed size (256 bytes)"},
+		{[]string{"STRLEN", "k"}, ":200"},
+
+		{[]string{"CONFIG", "SET", "max-value-size", "1kb"}, "+OK"},
+		{[]string{"CONFIG", "GET", "max-value-size"}, "*[max-value-size 1024]"},
+		{[]string{"SET", "k", long}, "+OK"},
+		{[]string{"APPEND", "k", long}, ":514"},
+		{[]string{"CONFIG", "SET", "max-key-size", "1000"}, "+OK"},
+		{[]string{"SET", long, "v"}, "+OK"},
+	})
+
+	for _, value := range []string{"0", "-1", "lots"} {
+		if reply := run("CONFIG", "SET", "max-key-size", value); reply.typ != "error" {
+			t.Errorf("CONFIG SET max-key-size %s = %+v, want an error", value, reply)
+		}
+	}
+	if got := maxKeySize.Load(); got != 1000 {
+		t.Errorf("max-key-size = %d after invalid CONFIG SETs, want 1000", got)
+	}
+}
+
+func TestSizeLimitsFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int64
+	}{
+		{"", 256},
+		{"2kb", 2048},
+		{"4096", 4096},
+		{"0", 256},
+		{"huge", 256},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAX_KEY_SIZE", tt.env)
+		if got := limitFromEnv("max-key-size", defaultKeySize).Load(); got != tt.want {
+			t.Errorf("MAX_KEY_SIZE=%q gives %d, want %d", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestOversizedBulkKeepsConnection(t *testing.T) {
+	keepLimits(t)
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+	maxBulkLen.Store(1024)
+
+	// the oversized command is skipped as a whole, the ones before and after it still run
+	c.send("SET", "before", "1")
+	c.send("SET", "big", strings.Repeat("x", 2000))
+	c.send("SET", "after", "2")
+	c.send("GET", "big")
+	want := []string{"+OK", "-" + errBulkTooLong.Error(), "+OK", "$nil"}
+	for i, w := range want {
+		if got := replyString(c.read()); got != w {
+			t.Fatalf("reply %d = %s, want %s", i, got, w)
+		}
+	}
+	if got := replyString(c.do("GET", "after")); got != "$2" {
+		t.Fatalf("GET after = %s", got)
+	}
+}
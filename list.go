@@ -0,0 +1,1031 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errIndexOutOfRange   = errors.New("ERR index out of range")
+	errTimeoutNegative   = errors.New("ERR timeout is negative")
+	errTimeoutNotFloat   = errors.New("ERR timeout is not a float or out of range")
+	errTimeoutOutOfRange = errors.New("ERR timeout is out of range")
+)
+
+// listValue is the value of a list key. It is a ring buffer so pushes and pops
+// on both ends are O(1), which is what queues mostly do
+type listValue struct {
+	buf  []string
+	head int // index of the first element in buf
+	size int
+}
+
+// at returns the element at position i, 0 being the head
+func (l *listValue) at(i int) string {
+	return l.buf[(l.head+i)%len(l.buf)]
+}
+
+// set replaces the element at position i
+func (l *listValue) set(i int, value string) {
+	l.buf[(l.head+i)%len(l.buf)] = value
+}
+
+// grow doubles the buffer, unwrapping the elements to the start of the new one
+func (l *listValue) grow() {
+	size := 2 * len(l.buf)
+	if size < 8 {
+		size = 8
+	}
+	buf := make([]string, size)
+	for i := 0; i < l.size; i++ {
+		buf[i] = l.at(i)
+	}
+	l.buf, l.head = buf, 0
+}
+
+func (l *listValue) pushFront(value string) {
+	if l.size == len(l.buf) {
+		l.grow()
+	}
+	l.head = (l.head - 1 + len(l.buf)) % len(l.buf)
+	l.buf[l.head] = value
+	l.size++
+}
+
+func (l *listValue) pushBack(value string) {
+	if l.size == len(l.buf) {
+		l.grow()
+	}
+	l.buf[(l.head+l.size)%len(l.buf)] = value
+	l.size++
+}
+
+// popFront and popBack must only be called on a non-empty list
+func (l *listValue) popFront() string {
+	value := l.buf[l.head]
+	l.buf[l.head] = "" // don't keep the string alive
+	l.head = (l.head + 1) % len(l.buf)
+	l.size--
+	return value
+}
+
+func (l *listValue) popBack() string {
+	idx := (l.head + l.size - 1) % len(l.buf)
+	value := l.buf[idx]
+	l.buf[idx] = ""
+	l.size--
+	return value
+}
+
+// pop removes an element from the head (left) or the tail
+func (l *listValue) pop(left bool) string {
+	if left {
+		return l.popFront()
+	}
+	return l.popBack()
+}
+
+// push adds an element at the head (left) or the tail
+func (l *listValue) push(left bool, value string) {
+	if left {
+		l.pushFront(value)
+	} else {
+		l.pushBack(value)
+	}
+}
+
+// items copies the elements between start and end (inclusive) into a slice
+func (l *listValue) items(start, end int) []string {
+	out := make([]string, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		out = append(out, l.at(i))
+	}
+	return out
+}
+
+// replace swaps the whole content of the list, used by the commands that
+// rewrite the middle of the list (LREM, LTRIM, LINSERT)
+func (l *listValue) replace(items []string) {
+	l.buf, l.head, l.size = items, 0, len(items)
+}
+
+// listRange normalizes redis style start/end indexes (negative ones count from the end)
+// against a list of length n. ok is false when the range is empty
+func listRange(start, end, n int) (int, int, bool) {
+	if start < 0 {
+		start = n + start
+	}
+	if end < 0 {
+		end = n + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= n {
+		return 0, 0, false
+	}
+	if end >= n {
+		end = n - 1
+	}
+	return start, end, true
+}
+
+// Blocked clients
+//
+// A client blocked in BLPOP/BRPOP/BLMOVE is registered as a listWaiter on every key it
+// waits for, in FIFO order per key. Whoever pushes to a key hands elements directly to
+// the oldest waiters while still holding the shard lock, so a woken client can't have its
+// element stolen by somebody else and waiters are served strictly in arrival order.
+// BLMOVE waiters are the exception: the element has to leave src and reach dst under the
+// locks of both lists, which the pusher doesn't hold. They are only woken up, with one
+// element of the list set aside for them, and do the move themselves. They keep their
+// place in the queue until the move is done, so one whose element was taken by somebody
+// else goes back to waiting ahead of the clients that came after it.
+// Waiters register while holding the shard locks of all their keys, so a push can never
+// slip in between "all lists are empty" and "waiter is registered". Lists that reach a
+// key some other way (RENAME, RESTORE) serve its waiters too.
+// Lock order is always shard locks first, then listWaiters.mutex.
+
+// poppedElement is what a blocked client gets handed: the key it was served from and the value
+type poppedElement struct {
+	key   string
+	value string
+}
+
+// listWaiter is one blocked client
+type listWaiter struct {
+	keys     []string
+	left     bool                     // pop from the head (BLPOP) or the tail (BRPOP)
+	elems    map[string]*list.Element // the waiter's place in each key's queue
+	move     bool                     // BLMOVE, woken up instead of handed an element
+	woken    bool                     // BLMOVE with an element set aside, guarded by listWaiters.mutex
+	result   chan poppedElement       // buffered, receives one element per wake up
+	finished bool                     // served or given up, guarded by listWaiters.mutex
+}
+
+// listWaiters keeps the blocked clients per key, oldest first
+type listWaiters struct {
+	mutex sync.Mutex
+	byKey map[string]*list.List
+	count atomic.Int64 // number of registered waiters, lets pushes skip the mutex in the common case
+}
+
+// register queues a waiter on all of its keys, callers must hold the shard locks of those keys
+func (w *listWaiters) register(waiter *listWaiter) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	waiter.elems = make(map[string]*list.Element, len(waiter.keys))
+	for _, key := range waiter.keys {
+		if _, dup := waiter.elems[key]; dup {
+			continue
+		}
+		q, ok := w.byKey[key]
+		if !ok {
+			q = list.New()
+			w.byKey[key] = q
+		}
+		waiter.elems[key] = q.PushBack(waiter)
+	}
+	w.count.Add(1)
+}
+
+// unregisterLocked takes a waiter out of all queues, callers must hold w.mutex
+func (w *listWaiters) unregisterLocked(waiter *listWaiter) {
+	for key, elem := range waiter.elems {
+		q := w.byKey[key]
+		q.Remove(elem)
+		if q.Len() == 0 {
+			delete(w.byKey, key)
+		}
+	}
+	waiter.finished = true
+	w.count.Add(-1)
+}
+
+// cancel gives up on a waiter. It returns false if the waiter was served or woken up in
+// the meantime, in which case its element is waiting in the result channel
+func (w *listWaiters) cancel(waiter *listWaiter) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if waiter.finished {
+		return false
+	}
+	woken := waiter.woken
+	w.unregisterLocked(waiter)
+	return !woken
+}
+
+// rearm sends a woken BLMOVE waiter whose element was taken back to waiting, in the place
+// it kept in the queue. Callers must hold the shard lock of its key
+func (w *listWaiters) rearm(waiter *listWaiter) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	waiter.woken = false
+}
+
+// serveWaiters hands elements of the list at key to blocked clients, oldest first,
+// for as long as there are both. Callers must hold the shard lock of key
+func (c *LRUCache) serveWaiters(key string, lv *listValue) {
+	if c.waiters.count.Load() == 0 {
+		return
+	}
+
+	c.waiters.mutex.Lock()
+	defer c.waiters.mutex.Unlock()
+
+	q, ok := c.waiters.byKey[key]
+	if !ok {
+		return
+	}
+	reserved := 0 // elements left in the list for the BLMOVE waiters that are awake
+	for elem := q.Front(); elem != nil && lv.size > reserved; {
+		waiter := elem.Value.(*listWaiter)
+		elem = elem.Next()
+		if waiter.move {
+			// stays in the queue until it made the move
+			if !waiter.woken {
+				waiter.woken = true
+				waiter.result <- poppedElement{key: key}
+			}
+			reserved++
+			continue
+		}
+		c.waiters.unregisterLocked(waiter)
+		waiter.result <- poppedElement{key: key, value: lv.pop(waiter.left)}
+		c.propagation.servedPop(key, waiter.left)
+	}
+}
+
+// serveNewList serves the clients blocked on the key of elem, which just got its value from
+// somewhere else than a push (RENAME, RESTORE). Callers must hold the shard lock
+func (c *LRUCache) serveNewList(shard *cacheShard, elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	lv, ok := entry.value.(*listValue)
+	if !ok {
+		return
+	}
+	c.serveWaiters(entry.key, lv)
+	if lv.size == 0 {
+		shard.removeElement(elem)
+	} else {
+		c.reweigh(shard, elem)
+	}
+}
+
+// Push adds values to the head (left) or tail of the list at key and returns the new
+// length. With onlyIfExists nothing happens for a missing key (LPUSHX/RPUSHX)
+func (c *LRUCache) Push(key string, values []string, left, onlyIfExists bool) (int, error) {
+	length := 0
+	err := c.mutate(key, "list", !onlyIfExists, func(entry *cacheEntry) error {
+		if entry == nil {
+			return nil
+		}
+		lv := entry.value.(*listValue)
+		for _, value := range values {
+			lv.push(left, value)
+		}
+		length = lv.size
+		c.serveWaiters(key, lv)
+		return nil
+	})
+	return length, err
+}
+
+// Pop removes up to count elements from the head (left) or tail of the list at key
+func (c *LRUCache) Pop(key string, count int, left bool) ([]string, bool, error) {
+	var popped []string
+	found := false
+	err := c.mutate(key, "list", false, func(entry *cacheEntry) error {
+		if entry == nil {
+			return nil
+		}
+		found = true
+		lv := entry.value.(*listValue)
+		for i := 0; i < count && lv.size > 0; i++ {
+			popped = append(popped, lv.pop(left))
+		}
+		return nil
+	})
+	return popped, found, err
+}
+
+// LRange returns the elements between start and end, inclusive
+func (c *LRUCache) LRange(key string, start, end int) ([]string, error) {
+	var items []string
+	err := c.view(key, "list", func(entry *cacheEntry) {
+		if entry == nil {
+			return
+		}
+		lv := entry.value.(*listValue)
+		if from, to, ok := listRange(start, end, lv.size); ok {
+			items = lv.items(from, to)
+		}
+	})
+	return items, err
+}
+
+// LLen returns the length of the list, 0 for a missing key
+func (c *LRUCache) LLen(key string) (int, error) {
+	n := 0
+	err := c.view(key, "list", func(entry *cacheEntry) {
+		if entry != nil {
+			n = entry.value.(*listValue).size
+		}
+	})
+	return n, err
+}
+
+// LIndex returns the element at index, negative indexes count from the tail
+func (c *LRUCache) LIndex(key string, index int) (string, bool, error) {
+	var value string
+	found := false
+	err := c.view(key, "list", func(entry *cacheEntry) {
+		if entry == nil {
+			return
+		}
+		lv := entry.value.(*listValue)
+		if index < 0 {
+			index += lv.size
+		}
+		if index >= 0 && index < lv.size {
+			value, found = lv.at(index), true
+		}
+	})
+	return value, found, err
+}
+
+// LSet replaces the element at index
+func (c *LRUCache) LSet(key string, index int, value string) error {
+	return c.mutate(key, "list", false, func(entry *cacheEntry) error {
+		if entry == nil {
+			return errNoSuchKey
+		}
+		lv := entry.value.(*listValue)
+		if index < 0 {
+			index += lv.size
+		}
+		if index < 0 || index >= lv.size {
+			return errIndexOutOfRange
+		}
+		lv.set(index, value)
+		return nil
+	})
+}
+
+// LRem removes occurrences of value: the first count from the head for count > 0,
+// the last -count from the tail for count < 0 and all of them for count == 0
+func (c *LRUCache) LRem(key string, count int, value string) (int, error) {
+	removed := 0
+	err := c.mutate(key, "list", false, func(entry *cacheEntry) error {
+		if entry == nil {
+			return nil
+		}
+		lv := entry.value.(*listValue)
+		items := lv.items(0, lv.size-1)
+		keep := make([]bool, len(items))
+		for i := range keep {
+			keep[i] = true
+		}
+
+		limit := count
+		if limit < 0 {
+			limit = -limit
+		}
+		for n := 0; n < len(items); n++ {
+			i := n
+			if count < 0 {
+				i = len(items) - 1 - n
+			}
+			if items[i] == value && (limit == 0 || removed < limit) {
+				keep[i] = false
+				removed++
+			}
+		}
+
+		kept := items[:0]
+		for i, item := range items {
+			if keep[i] {
+				kept = append(kept, item)
+			}
+		}
+		lv.replace(kept)
+		return nil
+	})
+	return removed, err
+}
+
+// LTrim keeps only the elements between start and end, inclusive
+func (c *LRUCache) LTrim(key string, start, end int) error {
+	return c.mutate(key, "list", false, func(entry *cacheEntry) error {
+		if entry == nil {
+			return nil
+		}
+		lv := entry.value.(*listValue)
+		from, to, ok := listRange(start, end, lv.size)
+		if !ok {
+			lv.replace(nil)
+			return nil
+		}
+		lv.replace(lv.items(from, to))
+		return nil
+	})
+}
+
+// LInsert inserts value before or after the first occurrence of pivot. It returns
+// the new length, -1 if the pivot wasn't found and 0 for a missing key
+func (c *LRUCache) LInsert(key string, before bool, pivot, value string) (int, error) {
+	result := 0
+	err := c.mutate(key, "list", false, func(entry *cacheEntry) error {
+		if entry == nil {
+			return nil
+		}
+		lv := entry.value.(*listValue)
+		items := lv.items(0, lv.size-1)
+		result = -1
+		for i, item := range items {
+			if item != pivot {
+				continue
+			}
+			if !before {
+				i++
+			}
+			items = append(items[:i], append([]string{value}, items[i:]...)...)
+			lv.replace(items)
+			result = lv.size
+			break
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Move atomically pops an element from src and pushes it to dst (LMOVE). Both shards
+// are locked in index order for the whole move, like RENAME does
+func (c *LRUCache) Move(src, dst string, fromLeft, toLeft bool) (string, bool, error) {
+	unlock := c.lockKeys(src, dst)
+	defer unlock()
+	return c.moveLocked(src, dst, fromLeft, toLeft)
+}
+
+// moveLocked is Move for callers that hold the shard locks of src and dst
+func (c *LRUCache) moveLocked(src, dst string, fromLeft, toLeft bool) (string, bool, error) {
+	srcShard, dstShard := c.getShard(src), c.getShard(dst)
+	srcElem, ok := c.liveElement(srcShard, src)
+	if !ok {
+		return "", false, nil
+	}
+	srcEntry := srcElem.Value.(*cacheEntry)
+	if srcEntry.typeName() != "list" {
+		return "", false, errWrongType
+	}
+
+	dstElem, dstExists := c.liveElement(dstShard, dst)
+	if dstExists && dstElem.Value.(*cacheEntry).typeName() != "list" {
+		return "", false, errWrongType
+	}
+
+	value := srcEntry.value.(*listValue).pop(fromLeft)
+	if srcEntry.isEmpty() {
+		srcShard.removeElement(srcElem)
+		// src and dst can be the same key, which then has to be created again
+		dstElem, dstExists = c.liveElement(dstShard, dst)
+	} else {
+		c.reweigh(srcShard, srcElem)
+	}
+
+	if !dstExists {
+		dstElem = c.addEntry(dstShard, &cacheEntry{key: dst, value: &listValue{}})
+	}
+	lv := dstElem.Value.(*cacheEntry).value.(*listValue)
+	lv.push(toLeft, value)
+	c.serveWaiters(dst, lv)
+	if lv.size == 0 {
+		dstShard.removeElement(dstElem)
+	} else {
+		dstShard.touch(dstElem)
+		c.reweigh(dstShard, dstElem)
+	}
+	return value, true, nil
+}
+
+// BlockingPop pops from the first non-empty list among keys. If all of them are empty the
+// client is parked until another client pushes, the timeout runs out (0 waits forever) or
+// the client disconnects. Without a client (scripts, replayed commands) it never blocks
+func (c *LRUCache) BlockingPop(cl *client, keys []string, left bool, timeout time.Duration) (poppedElement, bool, error) {
+	// BLPOP can't run again elsewhere, what it pops right away is propagated as LPOP
+	unlockLog := c.propagation.lockKeys(keys...)
+	defer func() { unlockLog() }()
+	unlock := c.lockKeys(keys...)
+
+	for _, key := range keys {
+		shard := c.getShard(key)
+		elem, ok := c.liveElement(shard, key)
+		if !ok {
+			continue
+		}
+		entry := elem.Value.(*cacheEntry)
+		if entry.typeName() != "list" {
+			unlock()
+			return poppedElement{}, false, errWrongType
+		}
+
+		value := entry.value.(*listValue).pop(left)
+		if entry.isEmpty() {
+			shard.removeElement(elem)
+		} else {
+			shard.touch(elem)
+			c.reweigh(shard, elem)
+		}
+		unlock()
+		c.propagation.log([]string{key}, command(popName(left), key))
+		return poppedElement{key: key, value: value}, true, nil
+	}
+
+	if cl == nil {
+		unlock()
+		return poppedElement{}, false, nil
+	}
+
+	// register while we still hold the shard locks, so no push can be missed. What a
+	// push hands us is propagated by the push
+	waiter := &listWaiter{keys: keys, left: left, result: make(chan poppedElement, 1)}
+	c.waiters.register(waiter)
+	unlock()
+	unlockLog()
+	unlockLog = func() {}
+
+	gone, stop := cl.watchDisconnect()
+	defer stop()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case popped := <-waiter.result:
+		return popped, true, nil
+	case <-expired:
+		if c.waiters.cancel(waiter) {
+			return poppedElement{}, false, nil
+		}
+		// we were served right as the timer fired, the element is ours
+		return <-waiter.result, true, nil
+	case <-gone:
+		if !c.waiters.cancel(waiter) {
+			// served right as the client went away, put the element back where it came from
+			// so it isn't lost
+			popped := <-waiter.result
+			c.pushBack(popped.key, popped.value, left)
+		}
+		return poppedElement{}, false, nil
+	}
+}
+
+// BlockingMove is LMOVE that waits for src to get an element, see BlockingPop. A push to
+// src only wakes us up, the move itself always happens under the locks of both lists so
+// the element is never in neither of them
+func (c *LRUCache) BlockingMove(cl *client, src, dst string, fromLeft, toLeft bool, timeout time.Duration) (string, bool, error) {
+	var expired <-chan time.Time
+	if timeout > 0 && cl != nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var gone <-chan struct{}
+	var waiter *listWaiter
+	woken := false // a push set an element aside for us
+
+	for {
+		unlockLog := c.propagation.lockKeys(src, dst)
+		unlock := c.lockKeys(src, dst)
+		value, moved, err := c.moveLocked(src, dst, fromLeft, toLeft)
+		if err != nil || moved || cl == nil {
+			if waiter != nil {
+				c.waiters.cancel(waiter)
+			}
+			unlock()
+			if moved {
+				c.propagation.log([]string{src, dst}, command("LMOVE", src, dst, sideName(fromLeft), sideName(toLeft)))
+			}
+			unlockLog()
+			if err != nil && woken {
+				// the element set aside for us goes to the next waiter
+				c.serveKey(src)
+			}
+			return value, moved, err
+		}
+
+		// src is empty. Register while we still hold the shard locks, so no push can be
+		// missed. After a wake up whose element was taken we wait again in the same place
+		if waiter == nil {
+			waiter = &listWaiter{keys: []string{src}, left: fromLeft, move: true, result: make(chan poppedElement, 1)}
+			c.waiters.register(waiter)
+		} else {
+			c.waiters.rearm(waiter)
+		}
+		unlock()
+		unlockLog()
+
+		if gone == nil {
+			var stop func()
+			gone, stop = cl.watchDisconnect()
+			defer stop()
+		}
+
+		select {
+		case <-waiter.result:
+			// somebody else may still take the element first, then we wait again
+			woken = true
+		case <-expired:
+			if c.waiters.cancel(waiter) {
+				return "", false, nil
+			}
+			// woken right as the timer fired, one last try without blocking
+			woken, cl = true, nil
+		case <-gone:
+			if !c.waiters.cancel(waiter) {
+				c.serveKey(src)
+			}
+			return "", false, nil
+		}
+	}
+}
+
+// serveKey hands the list at key to blocked clients again, when a BLMOVE that was woken up
+// for one of its elements doesn't take it
+func (c *LRUCache) serveKey(key string) {
+	unlockLog := c.propagation.lockKeys(key)
+	defer unlockLog()
+
+	c.mutate(key, "list", false, func(entry *cacheEntry) error {
+		if entry != nil {
+			c.serveWaiters(key, entry.value.(*listValue))
+		}
+		return nil
+	})
+	// propagates the pops of the waiters it served
+	c.propagation.log([]string{key})
+}
+
+// pushBack pushes an element a blocking command took out of a list, propagated like any
+// other push
+func (c *LRUCache) pushBack(key, value string, left bool) error {
+	unlockLog := c.propagation.lockKeys(key)
+	defer unlockLog()
+
+	if _, err := c.Push(key, []string{value}, left, false); err != nil {
+		return err
+	}
+	cmd := "RPUSH"
+	if left {
+		cmd = "LPUSH"
+	}
+	c.propagation.log([]string{key}, command(cmd, key, value))
+	return nil
+}
+
+// popName is the pop command for a side of a list
+func popName(left bool) string {
+	if left {
+		return "LPOP"
+	}
+	return "RPOP"
+}
+
+// sideName is the LEFT/RIGHT argument of LMOVE for a side of a list
+func sideName(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// parseTimeout parses the timeout of a blocking command, seconds as a float
+func parseTimeout(arg string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, errTimeoutNotFloat
+	}
+	if seconds < 0 {
+		return 0, errTimeoutNegative
+	}
+	// past this the duration overflows and would come out negative
+	if seconds > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, errTimeoutOutOfRange
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseDirection parses the LEFT/RIGHT arguments of LMOVE and BLMOVE
+func parseDirection(arg string) (bool, error) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	default:
+		return false, errSyntax
+	}
+}
+
+// pushCommand handles LPUSH, RPUSH, LPUSHX and RPUSHX
+func pushCommand(cmd string, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	key := argString(args[0])
+	values := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		values[i] = argString(arg)
+		if err := checkSize(key, values[i]); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+	}
+
+	left := cmd == "LPUSH" || cmd == "LPUSHX"
+	onlyIfExists := cmd == "LPUSHX" || cmd == "RPUSHX"
+	length, err := cache.Push(key, values, left, onlyIfExists)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
+
+// popCommand handles LPOP and RPOP, with a count the reply is an array
+func popCommand(cmd string, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(argString(args[1]))
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	popped, found, err := cache.Pop(argString(args[0]), count, cmd == "LPOP")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if len(args) == 2 {
+		if !found {
+			return Value{typ: "array", null: true}
+		}
+		return bulkArray(popped)
+	}
+	if len(popped) == 0 {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: popped[0]}
+}
+
+// lrangeCommand handles LRANGE
+func lrangeCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'LRANGE' command"}
+	}
+
+	start, err1 := strconv.Atoi(argString(args[1]))
+	end, err2 := strconv.Atoi(argString(args[2]))
+	if err1 != nil || err2 != nil {
+		return Value{typ: "error", str: errInvalidInteger.Error()}
+	}
+
+	items, err := cache.LRange(argString(args[0]), start, end)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return bulkArray(items)
+}
+
+// llenCommand handles LLEN
+func llenCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'LLEN' command"}
+	}
+
+	n, err := cache.LLen(argString(args[0]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: n}
+}
+
+// lindexCommand handles LINDEX
+func lindexCommand(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'LINDEX' command"}
+	}
+
+	index, err := strconv.Atoi(argString(args[1]))
+	if err != nil {
+		return Value{typ: "error", str: errInvalidInteger.Error()}
+	}
+
+	value, found, err := cache.LIndex(argString(args[0]), index)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !found {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: value}
+}
+
+// lsetCommand handles LSET
+func lsetCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'LSET' command"}
+	}
+
+	index, err := strconv.Atoi(argString(args[1]))
+	if err != nil {
+		return Value{typ: "error", str: errInvalidInteger.Error()}
+	}
+	key, value := argString(args[0]), argString(args[2])
+	if err := checkSize(key, value); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if err := cache.LSet(key, index, value); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// lremCommand handles LREM
+func lremCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'LREM' command"}
+	}
+
+	count, err := strconv.Atoi(argString(args[1]))
+	if err != nil {
+		return Value{typ: "error", str: errInvalidInteger.Error()}
+	}
+
+	removed, err := cache.LRem(argString(args[0]), count, argString(args[2]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: removed}
+}
+
+// ltrimCommand handles LTRIM
+func ltrimCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'LTRIM' command"}
+	}
+
+	start, err1 := strconv.Atoi(argString(args[1]))
+	end, err2 := strconv.Atoi(argString(args[2]))
+	if err1 != nil || err2 != nil {
+		return Value{typ: "error", str: errInvalidInteger.Error()}
+	}
+
+	if err := cache.LTrim(argString(args[0]), start, end); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// linsertCommand handles LINSERT key BEFORE|AFTER pivot element
+func linsertCommand(args []Value) Value {
+	if len(args) != 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'LINSERT' command"}
+	}
+
+	var before bool
+	switch strings.ToUpper(argString(args[1])) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+		before = false
+	default:
+		return Value{typ: "error", str: errSyntax.Error()}
+	}
+	key, value := argString(args[0]), argString(args[3])
+	if err := checkSize(key, value); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	result, err := cache.LInsert(key, before, argString(args[2]), value)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: result}
+}
+
+// isBlockingCommand reports whether a request is one of the commands that may
+// park the connection until data arrives
+func isBlockingCommand(value Value) bool {
+	if value.typ != "array" || len(value.array) == 0 {
+		return false
+	}
+	switch strings.ToUpper(argString(value.array[0])) {
+	case "BLPOP", "BRPOP", "BLMOVE", "BRPOPLPUSH":
+		return true
+	default:
+		return false
+	}
+}
+
+// processBlockingCommand runs a blocking command on behalf of a connected client
+func processBlockingCommand(cl *client, value Value) Value {
+	cmd := strings.ToUpper(argString(value.array[0]))
+	if cache.readOnly() {
+		return Value{typ: "error", str: errReadOnlyReplica.Error()}
+	}
+	if err := checkMemory(cmd); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return moveCommand(cl, cmd, value.array[1:])
+}
+
+// moveCommand handles LMOVE, RPOPLPUSH and the blocking BLPOP, BRPOP, BLMOVE and
+// BRPOPLPUSH. cl is nil when the command doesn't come from a connection that can block,
+// then the blocking variants behave like their non-blocking counterparts
+func moveCommand(cl *client, cmd string, args []Value) Value {
+	switch cmd {
+	case "BLPOP", "BRPOP":
+		if len(args) < 2 {
+			return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+		}
+		timeout, err := parseTimeout(argString(args[len(args)-1]))
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		keys := make([]string, len(args)-1)
+		for i, arg := range args[:len(args)-1] {
+			keys[i] = argString(arg)
+		}
+
+		popped, ok, err := cache.BlockingPop(cl, keys, cmd == "BLPOP", timeout)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if !ok {
+			return Value{typ: "array", null: true}
+		}
+		return bulkArray([]string{popped.key, popped.value})
+	}
+
+	// the move family: LMOVE/BLMOVE spell out the directions, RPOPLPUSH is RIGHT LEFT
+	var src, dst string
+	fromLeft, toLeft := false, true
+	var timeout time.Duration
+	wantArgs := map[string]int{"LMOVE": 4, "BLMOVE": 5, "RPOPLPUSH": 2, "BRPOPLPUSH": 3}[cmd]
+	if len(args) != wantArgs {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+	src, dst = argString(args[0]), argString(args[1])
+
+	if cmd == "LMOVE" || cmd == "BLMOVE" {
+		var err1, err2 error
+		fromLeft, err1 = parseDirection(argString(args[2]))
+		toLeft, err2 = parseDirection(argString(args[3]))
+		if err1 != nil || err2 != nil {
+			return Value{typ: "error", str: errSyntax.Error()}
+		}
+	}
+	blocking := cmd == "BLMOVE" || cmd == "BRPOPLPUSH"
+	var value string
+	var ok bool
+	var err error
+	if blocking {
+		if timeout, err = parseTimeout(argString(args[len(args)-1])); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		value, ok, err = cache.BlockingMove(cl, src, dst, fromLeft, toLeft, timeout)
+	} else {
+		// propagated like any other write, see writeCommands
+		value, ok, err = cache.Move(src, dst, fromLeft, toLeft)
+	}
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		if blocking {
+			return Value{typ: "array", null: true}
+		}
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: value}
+}
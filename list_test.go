@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBlockingMove(t *testing.T) {
+	addr := startTestServer(t)
+	blocked, other := dialTest(t, addr), dialTest(t, addr)
+
+	blocked.send("BLMOVE", "src", "dst", "LEFT", "RIGHT", "5")
+	time.Sleep(50 * time.Millisecond)
+	other.do("RPUSH", "src", "a", "b")
+	if reply := blocked.read(); reply.bulk != "a" {
+		t.Fatalf("BLMOVE = %+v, want a", reply)
+	}
+	if got := arrayStrings(other.do("LRANGE", "dst", "0", "-1")); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("dst = %v", got)
+	}
+	if got := arrayStrings(other.do("LRANGE", "src", "0", "-1")); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("src = %v", got)
+	}
+
+	// a dst that isn't a list fails the move, the element stays in src where it was
+	other.do("DEL", "src")
+	other.do("SET", "dst", "x")
+	blocked.send("BLMOVE", "src", "dst", "LEFT", "RIGHT", "5")
+	time.Sleep(50 * time.Millisecond)
+	other.do("RPUSH", "src", "c", "d")
+	if reply := blocked.read(); reply.typ != "error" {
+		t.Fatalf("BLMOVE to a string = %+v, want WRONGTYPE", reply)
+	}
+	if got := arrayStrings(other.do("LRANGE", "src", "0", "-1")); !reflect.DeepEqual(got, []string{"c", "d"}) {
+		t.Fatalf("src = %v", got)
+	}
+}
+
+func TestBlockingMoveHandsOverToNextWaiter(t *testing.T) {
+	addr := startTestServer(t)
+	mover, popper, other := dialTest(t, addr), dialTest(t, addr), dialTest(t, addr)
+
+	other.do("SET", "dst", "x")
+	mover.send("BLMOVE", "src", "dst", "LEFT", "RIGHT", "5")
+	time.Sleep(50 * time.Millisecond)
+	popper.send("BLPOP", "src", "5")
+	time.Sleep(50 * time.Millisecond)
+
+	// the element set aside for the failing BLMOVE goes to the BLPOP queued behind it
+	other.do("RPUSH", "src", "a")
+	if reply := mover.read(); reply.typ != "error" {
+		t.Fatalf("BLMOVE = %+v, want WRONGTYPE", reply)
+	}
+	if got := arrayStrings(popper.read()); !reflect.DeepEqual(got, []string{"src", "a"}) {
+		t.Fatalf("BLPOP = %v", got)
+	}
+}
+
+func TestBlockingMoveKeepsItsPlace(t *testing.T) {
+	addr := startTestServer(t)
+	mover, popper, other := dialTest(t, addr), dialTest(t, addr), dialTest(t, addr)
+
+	// a dst whose stripe comes before the one of src, so holding it stops the woken BLMOVE
+	// before it locks anything and leaves src to the others
+	src, dst := "src", ""
+	for i := 0; dst == ""; i++ {
+		if key := "dst" + strconv.Itoa(i); cache.shardIndex(key) < cache.shardIndex(src) {
+			dst = key
+		}
+	}
+
+	mover.send("BLMOVE", src, dst, "LEFT", "RIGHT", "5")
+	time.Sleep(50 * time.Millisecond)
+	popper.send("BLPOP", src, "5")
+	time.Sleep(50 * time.Millisecond)
+
+	unlock := cache.propagation.lockKeys(dst)
+	other.do("RPUSH", src, "a")
+	time.Sleep(50 * time.Millisecond)
+	// the element set aside for the BLMOVE is taken before it gets to move it
+	if reply := other.do("LPOP", src); reply.bulk != "a" {
+		t.Fatalf("LPOP = %+v, want a", reply)
+	}
+	unlock()
+	time.Sleep(50 * time.Millisecond)
+
+	// the BLMOVE is still first in line, the BLPOP that came after it gets the next element
+	other.do("RPUSH", src, "b")
+	if reply := mover.read(); reply.bulk != "b" {
+		t.Fatalf("BLMOVE = %+v, want b", reply)
+	}
+	other.do("RPUSH", src, "c")
+	if got := arrayStrings(popper.read()); !reflect.DeepEqual(got, []string{src, "c"}) {
+		t.Fatalf("BLPOP = %v", got)
+	}
+}
+
+func TestListsFromRenameAndRestoreServeWaiters(t *testing.T) {
+	addr := startTestServer(t)
+	blocked, other := dialTest(t, addr), dialTest(t, addr)
+
+	tests := []struct {
+		name   string
+		place  func() // puts the list a, b at dst
+		remain []string
+	}{
+		{"RENAME", func() {
+			other.do("RPUSH", "src", "a", "b")
+			other.do("RENAME", "src", "dst")
+		}, []string{"b"}},
+		{"RESTORE", func() {
+			other.do("RPUSH", "src", "a", "b")
+			payload := other.do("DUMP", "src").bulk
+			other.do("DEL", "src")
+			other.do("RESTORE", "dst", "0", payload)
+		}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other.do("DEL", "dst")
+			blocked.send("BLPOP", "dst", "5")
+			time.Sleep(50 * time.Millisecond)
+			tt.place()
+			if got := arrayStrings(blocked.read()); !reflect.DeepEqual(got, []string{"dst", "a"}) {
+				t.Fatalf("BLPOP = %v", got)
+			}
+			if got := arrayStrings(other.do("LRANGE", "dst", "0", "-1")); !reflect.DeepEqual(got, tt.remain) {
+				t.Fatalf("dst = %v, want %v", got, tt.remain)
+			}
+		})
+	}
+
+	// a list the waiters empty doesn't stay behind as an empty key
+	other.do("DEL", "dst")
+	blocked.send("BLPOP", "dst", "5")
+	time.Sleep(50 * time.Millisecond)
+	other.do("RPUSH", "single", "x")
+	other.do("RENAME", "single", "dst")
+	if got := arrayStrings(blocked.read()); !reflect.DeepEqual(got, []string{"dst", "x"}) {
+		t.Fatalf("BLPOP = %v", got)
+	}
+	if reply := other.do("EXISTS", "dst"); reply.num != 0 {
+		t.Fatalf("EXISTS dst = %d after its only element was served", reply.num)
+	}
+}
+
+func TestBlockingTimeouts(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+
+	tests := []struct {
+		timeout string
+		err     string
+	}{
+		{"-1", "ERR timeout is negative"},
+		{"abc", "ERR timeout is not a float or out of range"},
+		{"inf", "ERR timeout is not a float or out of range"},
+		{"1e12", "ERR timeout is out of range"},
+		{"9223372037", "ERR timeout is out of range"},
+	}
+	for _, tt := range tests {
+		for _, args := range [][]string{
+			{"BLPOP", "k", tt.timeout},
+			{"BLMOVE", "k", "d", "LEFT", "LEFT", tt.timeout},
+		} {
+			if reply := c.do(args...); reply.typ != "error" || reply.str != tt.err {
+				t.Errorf("%v = %+v, want %q", args, reply, tt.err)
+			}
+		}
+	}
+	// timeouts in range still block until they run out
+	if reply := c.do("BLPOP", "k", "0.01"); !reply.null {
+		t.Fatalf("BLPOP with a short timeout = %+v", reply)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Memory accounting
+//
+// Every entry is charged an estimate of the memory it holds: its key, its value and a fixed
+// overhead for the bookkeeping around it (the entry itself, its list element and map slots).
+// The charges of all shards add up in usedMemory, which is checked against maxMemory before
+// every command. Once the budget is exceeded we evict the way redis does: ask the eviction
+// policy for a candidate from each of a few random shards and evict the best of them (see
+// policy.go). That is close to a global LRU/LFU without ever holding more than one shard
+// lock at a time.
+const (
+	defaultMaxMemory = 1 << 30 // 1GB, leaves plenty of room for the rest of the process
+
+	entryOverhead    = 120 // cacheEntry, its list.Element and its slots in items/expires and the scan index
+	memberOverhead   = 48  // per hash field or set member: the map slot and string headers
+	zsetNodeOverhead = 112 // per sorted set member: dict slot plus the skiplist node
+	listSlotOverhead = 16  // per slot of a list's ring buffer (a string header)
+	sizeSamples      = 16  // collections bigger than this get their size estimated from a sample
+	evictionSamples  = 5   // candidates (from different shards) compared for every evicted key
+	evictionStride   = 97  // odd, so walking the shards with it visits each of them exactly once
+)
+
+// memoryUsage estimates the bytes held by the entry. Strings are exact, for collections
+// the average member size is taken from a sample so big collections stay O(1) to account
+func (e *cacheEntry) memoryUsage() int64 {
+	size := int64(entryOverhead + len(e.key))
+
+	switch v := e.value.(type) {
+	case string:
+		return size + int64(len(v))
+
+	case hashValue:
+		sampled, bytes := 0, 0
+		// map iteration starts at a random spot, so this is a random sample
+		for field, value := range v {
+			if sampled == sizeSamples {
+				break
+			}
+			sampled++
+			bytes += len(field) + len(value)
+		}
+		return size + scaleSample(len(v), sampled, bytes, memberOverhead)
+
+	case setValue:
+		sampled, bytes := 0, 0
+		for member := range v {
+			if sampled == sizeSamples {
+				break
+			}
+			sampled++
+			bytes += len(member)
+		}
+		return size + scaleSample(len(v), sampled, bytes, memberOverhead)
+
+	case *zsetValue:
+		sampled, bytes := 0, 0
+		for member := range v.dict {
+			if sampled == sizeSamples {
+				break
+			}
+			sampled++
+			bytes += len(member)
+		}
+		return size + scaleSample(len(v.dict), sampled, bytes, zsetNodeOverhead)
+
+	case *listValue:
+		// the ring buffer is charged for its capacity, the elements are sampled evenly
+		step := v.size/sizeSamples + 1
+		sampled, bytes := 0, 0
+		for i := 0; i < v.size; i += step {
+			sampled++
+			bytes += len(v.at(i))
+		}
+		return size + int64(len(v.buf)*listSlotOverhead) + scaleSample(v.size, sampled, bytes, 0)
+	}
+	return size
+}
+
+// scaleSample extrapolates the bytes of a sample of members to all n of them,
+// adding the fixed per member overhead
+func scaleSample(n, sampled, bytes, overhead int) int64 {
+	total := int64(n) * int64(overhead)
+	if sampled > 0 {
+		total += int64(bytes) * int64(n) / int64(sampled)
+	}
+	return total
+}
+
+// account adds delta to the memory charged to the shard, to the whole cache and, for
+// entries in the admission window, to the window. Callers must hold the shard write lock
+func (s *cacheShard) account(entry *cacheEntry, delta int64) {
+	s.stats.changes.Add(1)
+	s.used += delta
+	s.cache.usedMemory.Add(delta)
+	if entry.windowElem != nil {
+		s.cache.windowMemory.Add(delta)
+	}
+}
+
+// touch marks an entry as just used, for the LRU, LFU and admission bookkeeping.
+// Callers must hold the shard write lock
+func (s *cacheShard) touch(elem *list.Element) {
+	s.evictionQ.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	if entry.windowElem != nil {
+		s.window.MoveToFront(entry.windowElem)
+	}
+	now := nowMillis()
+	entry.hit(now)
+	entry.lastAccess = now
+	s.cache.recordAccess(entry.key)
+}
+
+// evictIfNeeded evicts keys until the cache is back within its memory budget. It runs before
+// every command and must not be called with a shard lock held. A single write can overshoot
+// the budget a little, the next command brings the cache back under it, just like in redis.
+// It fails with errOOM when the policy can't free enough memory (noeviction, or volatile-*
+// without any keys that have a TTL)
+func (c *LRUCache) evictIfNeeded() error {
+	limit := c.maxMemory.Load()
+	c.drainWindow(limit)
+	// a replica keeps what its primary keeps, the primary propagates its evictions
+	if limit <= 0 || c.propagation.replicated.Load() {
+		return nil
+	}
+	for c.usedMemory.Load() > limit {
+		if !c.evictOne() {
+			return errOOM
+		}
+	}
+	return nil
+}
+
+// evictOne evicts the best candidate of the eviction policy among a few sampled shards, or
+// with admission enabled and a full window, whichever loses the admission contest. It
+// returns false when there is nothing left the policy may evict
+func (c *LRUCache) evictOne() bool {
+	policy := c.Policy()
+	if _, ok := policy.(noEvictionPolicy); ok {
+		return false
+	}
+
+	if f := c.admission.Load(); f != nil && c.windowMemory.Load() > c.maxMemory.Load()*windowPercent/100 {
+		if c.evictFromWindow(f, policy) {
+			return true
+		}
+	}
+
+	shard, key, ok := c.pickVictim(policy.candidate)
+	if !ok {
+		return false
+	}
+	c.evictKey(shard, key)
+	return true
+}
+
+// pickVictim samples shards for the lowest ranked candidate returned by candidate
+func (c *LRUCache) pickVictim(candidate func(shard *cacheShard, now int64) (string, int64, bool)) (*cacheShard, string, bool) {
+	var victim *cacheShard
+	var victimKey string
+	var lowest int64
+	now := nowMillis()
+
+	// shards without a candidate (empty, or without volatile keys) don't count towards the
+	// sample, otherwise a sparse cache would often compare a single candidate with nothing.
+	// We start at a random shard and walk on from there, so with few candidates left this
+	// degrades into looking at every shard once
+	candidates := 0
+	start := rand.Intn(c.shardCount)
+	for i := 0; i < c.shardCount && candidates < evictionSamples; i++ {
+		shard := c.shards[(start+i*evictionStride)%c.shardCount]
+		shard.mutex.RLock()
+		if key, rank, ok := candidate(shard, now); ok {
+			candidates++
+			if victim == nil || rank < lowest {
+				victim, victimKey, lowest = shard, key, rank
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+	return victim, victimKey, victim != nil
+}
+
+// evictKey evicts a key picked by pickVictim. It may have been deleted since we looked
+// at it, then somebody else freed memory for us and the caller simply checks again. With
+// the read-buffer engine it may also have been read since its last replay, then it is
+// not the one to evict after all and the caller picks again
+func (c *LRUCache) evictKey(shard *cacheShard, key string) {
+	// the DEL is propagated in order with the writes to the key
+	unlock := c.propagation.lockKeys(key)
+	defer unlock()
+
+	shard.mutex.Lock()
+	elem, ok := shard.items[key]
+	if ok && shard.drainReads(elem) {
+		ok = false
+	}
+	if ok {
+		shard.removeElement(elem)
+		c.propagation.removed(key)
+	}
+	shard.mutex.Unlock()
+
+	if ok {
+		shard.stats.evictions.Add(1)
+	}
+}
+
+// parseMemory parses a memory size the way redis config files write them:
+// plain bytes or a number with a k/kb/m/mb/g/gb suffix (kb and friends are powers of 1024)
+func parseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	s = strings.ToLower(strings.TrimSpace(s))
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, factor = strings.TrimSuffix(s, unit.suffix), unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return n * factor, nil
+}
+
+// denyOOMCommands are the commands that can grow the cache, they are refused with an OOM
+// error when the eviction policy can't get the cache back within its budget
+var denyOOMCommands = map[string]bool{
+	"SET": true, "PUT": true, "SETNX": true, "GETSET": true, "MSET": true, "MSETNX": true,
+	"APPEND": true, "SETRANGE": true, "INCR": true, "DECR": true, "INCRBY": true,
+	"DECRBY": true, "INCRBYFLOAT": true,
+	"HSET": true, "HMSET": true, "HSETNX": true, "HINCRBY": true, "HINCRBYFLOAT": true,
+	"LPUSH": true, "RPUSH": true, "LPUSHX": true, "RPUSHX": true, "LINSERT": true, "LSET": true,
+	"LMOVE": true, "RPOPLPUSH": true, "BLMOVE": true, "BRPOPLPUSH": true,
+	"SADD": true, "SMOVE": true, "SINTERSTORE": true, "SUNIONSTORE": true, "SDIFFSTORE": true,
+	"ZADD": true, "ZINCRBY": true, "RESTORE": true,
+}
+
+// checkMemory makes room before a command runs, like redis does. Only commands
+// that can grow the cache fail when there is no room to be made
+func checkMemory(cmd string) error {
+	if err := cache.evictIfNeeded(); err != nil && denyOOMCommands[cmd] {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1024", 1024, true},
+		{"100b", 100, true},
+		{"1kb", 1024, true},
+		{"1k", 1000, true},
+		{"512mb", 512 << 20, true},
+		{"2m", 2000000, true},
+		{"1GB", 1 << 30, true},
+		{" 3g ", 3000000000, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1tb", 0, false},
+		{"1.5mb", 0, false},
+		{"mb", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseMemory(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseMemory(%q) = %d, %v, want %d (ok %v)", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	c := newTestCache(t, 0)
+	run("SET", "k", strings.Repeat("v", 200))
+	full := c.usedMemory.Load()
+	if want := int64(entryOverhead + len("k") + 200); full != want {
+		t.Fatalf("used_memory = %d for a 200 byte value, want %d", full, want)
+	}
+
+	// overwrites, appends and deletes keep the total in step
+	run("SET", "k", "v")
+	if got, want := c.usedMemory.Load(), full-199; got != want {
+		t.Fatalf("used_memory = %d after a smaller SET, want %d", got, want)
+	}
+	run("APPEND", "k", strings.Repeat("v", 199))
+	if got := c.usedMemory.Load(); got != full {
+		t.Fatalf("used_memory = %d after APPEND, want %d", got, full)
+	}
+	run("RPUSH", "list", "a", "b", "c")
+	run("DEL", "k", "list")
+	if got := c.usedMemory.Load(); got != 0 {
+		t.Fatalf("used_memory = %d with nothing stored", got)
+	}
+}
+
+func TestMaxMemoryEviction(t *testing.T) {
+	const limit = 100 << 10
+	c := newTestCache(t, limit)
+	value := strings.Repeat("v", 200)
+	for i := 0; i < 2000; i++ {
+		if reply := run("SET", "key:"+strconv.Itoa(i), value); reply.typ == "error" {
+			t.Fatalf("SET key:%d = %s", i, reply.str)
+		}
+	}
+	run("PING") // every command brings the cache back within its budget first
+
+	used := c.usedMemory.Load()
+	if used > limit {
+		t.Fatalf("used_memory = %d over a maxmemory of %d", used, limit)
+	}
+	// the budget is global, the cache is filled up to it and not emptied by full shards
+	if used < limit*9/10 {
+		t.Fatalf("used_memory = %d, the cache was evicted far below its maxmemory %d", used, limit)
+	}
+	_, _, _, _, evictions, _ := c.totals()
+	if n := run("DBSIZE").num; evictions == 0 || int64(n)+evictions != 2000 {
+		t.Fatalf("%d keys left and %d evicted, want 2000 in total", n, evictions)
+	}
+
+	// victims come from all over the cache, not from the shards that happened to be written last
+	for i, shard := range c.Occupancy() {
+		if shard.keys == 0 {
+			t.Fatalf("shard %d was emptied", i)
+		}
+	}
+
+	// the most recently written keys survive an LRU eviction
+	for i := 1990; i < 2000; i++ {
+		if reply := run("EXISTS", "key:"+strconv.Itoa(i)); reply.num != 1 {
+			t.Fatalf("key:%d was evicted right after it was written", i)
+		}
+	}
+
+	stats := run("STATS").str
+	if !strings.Contains(stats, "Used Memory: "+strconv.FormatInt(c.usedMemory.Load(), 10)) ||
+		!strings.Contains(stats, "Max Memory: "+strconv.Itoa(limit)) {
+		t.Fatalf("STATS = %s", stats)
+	}
+}
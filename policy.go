@@ -0,0 +1,220 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"math/rand"
+)
+
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// Eviction policies
+//
+// When the cache is over its memory budget, evictOne samples a few shards and asks the
+// policy for the best candidate of each. Candidates come with a rank that is comparable
+// across shards (lower is evicted first), the lowest one is evicted. The policies mirror
+// the redis maxmemory-policy settings: allkeys-* pick from every key, volatile-* only
+// from keys that have a TTL.
+const (
+	policySamples = 5 // keys looked at per shard by the sampling policies
+
+	// LFU counters are logarithmic (Morris counters): the more hits a key already has, the
+	// less likely the next one is to bump its counter, so 8 bits are enough to tell a few
+	// hits from millions of them. Counters lose a point for every lfuDecayTime without hits
+	lfuInitVal   = 5 // new keys start here so they aren't evicted before they get a chance
+	lfuLogFactor = 10
+	lfuDecayTime = 60 * 1000 // milliseconds
+)
+
+// evictionPolicy decides which key to evict when the cache runs out of memory
+type evictionPolicy interface {
+	// name is what CONFIG GET maxmemory-policy reports
+	name() string
+	// candidate picks the best key to evict from one shard and its rank. ok is false when
+	// the shard holds nothing the policy may evict. Called with the shard read lock held
+	candidate(shard *cacheShard, now int64) (key string, rank int64, ok bool)
+}
+
+// evictionPolicies lists every policy by its maxmemory-policy name
+var evictionPolicies = map[string]evictionPolicy{
+	"allkeys-lru":     lruPolicy{},
+	"allkeys-lfu":     lfuPolicy{},
+	"allkeys-random":  randomPolicy{},
+	"volatile-lru":    lruPolicy{volatile: true},
+	"volatile-lfu":    lfuPolicy{volatile: true},
+	"volatile-random": randomPolicy{volatile: true},
+	"volatile-ttl":    ttlPolicy{},
+	"noeviction":      noEvictionPolicy{},
+}
+
+const defaultPolicy = "allkeys-lru"
+
+// sampleEntries calls fn for up to policySamples entries of m. Go randomizes where
+// map iteration starts, which is what makes this a random sample. Entries still in the
+// admission window are skipped, they are evicted by the admission filter (see admission.go)
+func sampleEntries(m map[string]*list.Element, fn func(entry *cacheEntry)) {
+	sampled := 0
+	for _, elem := range m {
+		if sampled == policySamples {
+			return
+		}
+		entry := elem.Value.(*cacheEntry)
+		if entry.windowElem != nil {
+			continue
+		}
+		sampled++
+		fn(entry)
+	}
+}
+
+// sampleLowest returns the sampled entry of m with the lowest rank
+func sampleLowest(m map[string]*list.Element, rank func(entry *cacheEntry) int64) (string, int64, bool) {
+	var key string
+	var lowest int64
+	found := false
+	sampleEntries(m, func(entry *cacheEntry) {
+		if r := rank(entry); !found || r < lowest {
+			key, lowest, found = entry.key, r, true
+		}
+	})
+	return key, lowest, found
+}
+
+// candidateSet returns the keys a policy picks from: all of them or only the ones with a TTL
+func candidateSet(shard *cacheShard, volatile bool) map[string]*list.Element {
+	if volatile {
+		return shard.expires
+	}
+	return shard.items
+}
+
+// lruPolicy evicts the least recently used key. With all keys the tail of the shard's
+// recency list is exactly that (past any window entries), volatile keys are sampled
+type lruPolicy struct {
+	volatile bool
+}
+
+func (p lruPolicy) name() string {
+	if p.volatile {
+		return "volatile-lru"
+	}
+	return "allkeys-lru"
+}
+
+func (p lruPolicy) candidate(shard *cacheShard, now int64) (string, int64, bool) {
+	if p.volatile {
+		return sampleLowest(shard.expires, func(entry *cacheEntry) int64 { return entry.lastAccess })
+	}
+	// window entries are newer than most of the main area, so only a few of them sit
+	// at the tail. If we don't get past them quickly the shard has no candidate for now
+	elem := shard.evictionQ.Back()
+	for steps := 0; elem != nil && steps < sizeSamples; steps++ {
+		entry := elem.Value.(*cacheEntry)
+		if entry.windowElem == nil {
+			return entry.key, entry.lastAccess, true
+		}
+		elem = elem.Prev()
+	}
+	return "", 0, false
+}
+
+// lfuPolicy evicts the sampled key with the lowest (decayed) access frequency
+type lfuPolicy struct {
+	volatile bool
+}
+
+func (p lfuPolicy) name() string {
+	if p.volatile {
+		return "volatile-lfu"
+	}
+	return "allkeys-lfu"
+}
+
+func (p lfuPolicy) candidate(shard *cacheShard, now int64) (string, int64, bool) {
+	return sampleLowest(candidateSet(shard, p.volatile), func(entry *cacheEntry) int64 {
+		return int64(entry.decayedFreq(now))
+	})
+}
+
+// randomPolicy evicts a random key
+type randomPolicy struct {
+	volatile bool
+}
+
+func (p randomPolicy) name() string {
+	if p.volatile {
+		return "volatile-random"
+	}
+	return "allkeys-random"
+}
+
+func (p randomPolicy) candidate(shard *cacheShard, now int64) (string, int64, bool) {
+	for key, elem := range candidateSet(shard, p.volatile) {
+		if elem.Value.(*cacheEntry).windowElem == nil {
+			return key, rand.Int63(), true
+		}
+	}
+	return "", 0, false
+}
+
+// ttlPolicy evicts the sampled key that is closest to expiring anyway
+type ttlPolicy struct{}
+
+func (ttlPolicy) name() string { return "volatile-ttl" }
+
+func (ttlPolicy) candidate(shard *cacheShard, now int64) (string, int64, bool) {
+	return sampleLowest(shard.expires, func(entry *cacheEntry) int64 { return entry.expireAt })
+}
+
+// noEvictionPolicy never evicts, writes fail with an OOM error instead
+type noEvictionPolicy struct{}
+
+func (noEvictionPolicy) name() string { return "noeviction" }
+
+func (noEvictionPolicy) candidate(*cacheShard, int64) (string, int64, bool) {
+	return "", 0, false
+}
+
+// decayedFreq returns the LFU counter of the entry after applying the decay
+// for the time since it was last touched
+func (e *cacheEntry) decayedFreq(now int64) uint8 {
+	periods := (now - e.lastAccess) / lfuDecayTime
+	if periods <= 0 {
+		return e.freq
+	}
+	if periods >= int64(e.freq) {
+		return 0
+	}
+	return e.freq - uint8(periods)
+}
+
+// hit records an access in the LFU counter, the caller updates lastAccess afterwards
+func (e *cacheEntry) hit(now int64) {
+	freq := e.decayedFreq(now)
+	if freq < math.MaxUint8 {
+		base := float64(freq) - lfuInitVal
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			freq++
+		}
+	}
+	e.freq = freq
+}
+
+// Policy returns the eviction policy currently in use
+func (c *LRUCache) Policy() evictionPolicy {
+	return *c.policy.Load()
+}
+
+// SetPolicy switches the eviction policy by its maxmemory-policy name
+func (c *LRUCache) SetPolicy(name string) bool {
+	policy, ok := evictionPolicies[name]
+	if !ok {
+		return false
+	}
+	c.policy.Store(&policy)
+	return true
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestConfigSetPolicy(t *testing.T) {
+	newTestCache(t, 0)
+	tests := []commandTest{
+		{[]string{"CONFIG", "GET", "maxmemory-policy"}, "*[maxmemory-policy allkeys-lru]"},
+		{[]string{"CONFIG", "SET", "maxmemory-policy", "bogus"}, `-ERR CONFIG SET failed (possibly related to argument 'maxmemory-policy') - unknown policy "bogus"`},
+		{[]string{"CONFIG", "GET", "maxmemory-policy"}, "*[maxmemory-policy allkeys-lru]"},
+		{[]string{"CONFIG", "SET", "maxmemory-policy", "ALLKEYS-LFU"}, "+OK"},
+		{[]string{"CONFIG", "GET", "maxmemory-policy"}, "*[maxmemory-policy allkeys-lfu]"},
+		// several parameters can be set at once
+		{[]string{"CONFIG", "SET", "maxmemory", "1mb", "maxmemory-policy", "volatile-ttl"}, "+OK"},
+		{[]string{"CONFIG", "GET", "maxmemory*"}, "*[maxmemory 1048576 maxmemory-policy volatile-ttl]"},
+		{[]string{"CONFIG", "SET", "maxmemory", "lots"}, `-ERR CONFIG SET failed (possibly related to argument 'maxmemory') - invalid memory size "lots"`},
+	}
+	for name := range evictionPolicies {
+		tests = append(tests,
+			commandTest{[]string{"CONFIG", "SET", "maxmemory-policy", name}, "+OK"},
+			commandTest{[]string{"CONFIG", "GET", "maxmemory-policy"}, "*[maxmemory-policy " + name + "]"},
+		)
+	}
+	runCommands(t, tests)
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	t.Setenv("MAXMEMORY", "2mb")
+	t.Setenv("MAXMEMORY_POLICY", "Volatile-LFU")
+	c := newCacheFromEnv()
+	defer c.Close()
+	if got := c.maxMemory.Load(); got != 2<<20 {
+		t.Errorf("maxmemory = %d, want %d", got, 2<<20)
+	}
+	if got := c.Policy().name(); got != "volatile-lfu" {
+		t.Errorf("maxmemory-policy = %s, want volatile-lfu", got)
+	}
+
+	t.Setenv("MAXMEMORY_POLICY", "bogus")
+	c = newCacheFromEnv()
+	defer c.Close()
+	if got := c.Policy().name(); got != defaultPolicy {
+		t.Errorf("maxmemory-policy = %s with a bogus MAXMEMORY_POLICY, want %s", got, defaultPolicy)
+	}
+}
+
+// fill writes n keys with 200 byte values under prefix, it stops at the first error
+func fill(prefix string, n int, args ...string) {
+	value := strings.Repeat("v", 200)
+	for i := 0; i < n; i++ {
+		if reply := run(append([]string{"SET", prefix + strconv.Itoa(i), value}, args...)...); reply.typ == "error" {
+			return
+		}
+	}
+}
+
+func TestNoEviction(t *testing.T) {
+	c := newTestCache(t, 32<<10)
+	c.SetPolicy("noeviction")
+	value := strings.Repeat("v", 200)
+	var oom Value
+	for i := 0; i < 1000 && oom.typ == ""; i++ {
+		if reply := run("SET", "key:"+strconv.Itoa(i), value); reply.typ == "error" {
+			oom = reply
+		}
+	}
+	if oom.str != errOOM.Error() {
+		t.Fatalf("writes past maxmemory got %+v, want the OOM error", oom)
+	}
+	_, _, _, _, evictions, _ := c.totals()
+	if evictions != 0 {
+		t.Fatalf("noeviction evicted %d keys", evictions)
+	}
+
+	// reads and deletes still work, and the memory they free can be written again
+	runCommands(t, []commandTest{
+		{[]string{"GET", "key:0"}, "$" + value},
+		{[]string{"RPUSH", "list", "a"}, "-" + errOOM.Error()},
+		{[]string{"DEL", "key:0", "key:1", "key:2"}, ":3"},
+		{[]string{"SET", "key:0", "v"}, "+OK"},
+	})
+}
+
+func TestVolatilePolicies(t *testing.T) {
+	for _, policy := range []string{"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl"} {
+		t.Run(policy, func(t *testing.T) {
+			c := newTestCache(t, 32<<10)
+			c.SetPolicy(policy)
+			// with no TTL anywhere there is nothing these policies may evict
+			fill("plain:", 500)
+			if reply := run("SET", "more", "v"); reply.str != errOOM.Error() {
+				t.Fatalf("SET without volatile keys = %+v, want the OOM error", reply)
+			}
+			n := run("DBSIZE").num
+
+			// keys with a TTL are evicted, the others stay
+			run("CONFIG", "SET", "maxmemory", strconv.Itoa(64<<10))
+			fill("volatile:", 500, "EX", "1000")
+			run("PING")
+			if c.usedMemory.Load() > 64<<10 {
+				t.Fatalf("used_memory = %d over the budget", c.usedMemory.Load())
+			}
+			for i := 0; i < n; i++ {
+				if run("EXISTS", "plain:"+strconv.Itoa(i)).num != 1 {
+					t.Fatalf("plain:%d was evicted by %s", i, policy)
+				}
+			}
+		})
+	}
+}
+
+func TestVolatileTTLEvictsSoonestFirst(t *testing.T) {
+	c := newTestCache(t, 64<<10)
+	c.SetPolicy("volatile-ttl")
+	value := strings.Repeat("v", 200)
+	// one key in three is about to expire anyway, those go first
+	for i := 0; i < 1000; i++ {
+		ttl := "100000"
+		if i%3 == 0 {
+			ttl = "100"
+		}
+		run("SET", "key:"+strconv.Itoa(i), value, "EX", ttl)
+	}
+	run("PING")
+
+	soon, late := 0, 0
+	for _, shard := range c.shards {
+		shard.mutex.RLock()
+		for _, elem := range shard.items {
+			if elem.Value.(*cacheEntry).expireAt < nowMillis()+1000*1000 {
+				soon++
+			} else {
+				late++
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+	if soon*10 > late {
+		t.Fatalf("%d keys about to expire are left next to %d that aren't", soon, late)
+	}
+}
+
+func TestLFUKeepsHotKeys(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		minHot int // of the 100 hot keys
+		maxHot int
+	}{
+		{"allkeys-lfu", 90, 100},
+		// the scan flushes them out of an LRU, which is what LFU is for
+		{"allkeys-lru", 0, 10},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			c := newTestCache(t, 64<<10)
+			c.SetPolicy(tt.policy)
+			value := strings.Repeat("v", 100)
+			for i := 0; i < 100; i++ {
+				run("SET", "hot:"+strconv.Itoa(i), value)
+			}
+			for round := 0; round < 50; round++ {
+				for i := 0; i < 100; i++ {
+					run("GET", "hot:"+strconv.Itoa(i))
+				}
+			}
+			// a long tail of keys read once, many times the size of the cache
+			for i := 0; i < 3000; i++ {
+				run("SET", "scan:"+strconv.Itoa(i), value)
+			}
+			run("PING")
+
+			hot := 0
+			for i := 0; i < 100; i++ {
+				hot += run("EXISTS", "hot:"+strconv.Itoa(i)).num
+			}
+			if hot < tt.minHot || hot > tt.maxHot {
+				t.Fatalf("%d hot keys survived the scan, want %d to %d", hot, tt.minHot, tt.maxHot)
+			}
+		})
+	}
+}
+
+func TestLFUCounter(t *testing.T) {
+	now := nowMillis()
+	entry := &cacheEntry{freq: lfuInitVal, lastAccess: now}
+	for i := 0; i < 1000; i++ {
+		entry.hit(now)
+	}
+	// logarithmic: a thousand hits are worth a few points, not a thousand
+	if entry.freq <= lfuInitVal || entry.freq > lfuInitVal+20 {
+		t.Fatalf("a thousand hits gave a counter of %d", entry.freq)
+	}
+
+	// a point is lost for every decay period without hits
+	entry = &cacheEntry{freq: 10, lastAccess: now - 3*lfuDecayTime}
+	if got := entry.decayedFreq(now); got != 7 {
+		t.Fatalf("decayedFreq after 3 periods = %d, want 7", got)
+	}
+	entry.lastAccess = now - 100*lfuDecayTime
+	if got := entry.decayedFreq(now); got != 0 {
+		t.Fatalf("decayedFreq after 100 periods = %d, want 0", got)
+	}
+}
+
+func TestRandomPolicyStaysInBudget(t *testing.T) {
+	c := newTestCache(t, 32<<10)
+	c.SetPolicy("allkeys-random")
+	fill("key:", 500)
+	run("PING")
+	if used := c.usedMemory.Load(); used > 32<<10 {
+		t.Fatalf("used_memory = %d over the budget", used)
+	}
+}
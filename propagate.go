@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Propagation
+//
+// Every write command ends up in a stream of commands that recreates it elsewhere: the
+// append only file replays it at the next start (aof.go) and replicas apply it as it
+// happens (replication.go). The stream is RESP, the way clients send commands. A few
+// commands are propagated in a form that gives the same result when they run again later
+// or on another node: relative TTLs are followed by a PEXPIREAT with the absolute deadline,
+// SPOP becomes an SREM of what was popped, the blocking list commands become their
+// non-blocking counterparts.
+//
+// Commands run in parallel, but the stream has to list the writes to a key in the order
+// they were applied. Every shard has a stripe lock that a write command takes (for the
+// shards of all its keys, in index order) before it runs and releases after it is
+// propagated, so writes to one shard are propagated in order while writes to different
+// shards still run in parallel. Elements a push hands to blocked clients are propagated as
+// pops right after the push. Lock order: stripes, then the shard locks.
+//
+// Keys that are evicted or expire are propagated as a DEL, like redis does: the node that
+// removes them does it holding the stripe of the shard, so the DEL lands in the stream
+// before any later write to the key. Replay and replicas then never have to decide on
+// their own whether a key is gone, their clock or memory budget may well differ.
+type propagator struct {
+	cache      *LRUCache
+	stripes    []sync.Mutex  // one per shard of the cache
+	apply      sync.Mutex    // held by a replica applying a command of its primary, see applyReplicated
+	replicated atomic.Bool   // the node is a replica, its stream is the one of its primary
+	applying   []atomic.Bool // shards whose stripe a command of the primary holds, see lockForPrimary
+	capturing  atomic.Int32  // len(captures), checked without the mutex
+
+	mutex    sync.Mutex
+	served   map[uint32][]Value // pops handed to blocked clients, propagated after the push that served them
+	captures []*capture         // copies of the cache being taken, see capture
+}
+
+// capture is a copy of the cache pinned to a single point of the stream, for the AOF
+// rewrite, replica full syncs and snapshots. Rather than holding up every write while the
+// whole cache is encoded, shards are encoded one at a time under their stripe. A write
+// first encodes the shards it touches that aren't yet, so the encoded shards are the cache
+// as it was when the capture started, across all shards, and from then on the writes are
+// collected in tail. The copy is the encoded shards followed by tail: every write shows in
+// exactly one of them. Snapshots only keep the shards and don't collect a tail
+type capture struct {
+	encode   func(shard *cacheShard) []byte
+	snapshot bool     // no tail wanted
+	parts    [][]byte // the encoded shards, guarded by their stripes
+	encoded  []bool   // guarded by the stripe of the shard
+	tail     []byte   // guarded by the propagator mutex
+	restart  bool     // the cache was replaced meanwhile, guarded by the propagator mutex
+}
+
+// writeCommands are the commands that change the cache and get propagated. The blocking
+// list commands propagate themselves, see BlockingPop and BlockingMove
+var writeCommands = map[string]bool{
+	"SET": true, "PUT": true, "SETNX": true, "GETSET": true, "GETDEL": true, "GETEX": true,
+	"EXPIRE": true, "PEXPIRE": true, "EXPIREAT": true, "PEXPIREAT": true, "PERSIST": true,
+	"MSET": true, "MSETNX": true, "APPEND": true, "SETRANGE": true,
+	"INCR": true, "DECR": true, "INCRBY": true, "DECRBY": true, "INCRBYFLOAT": true,
+	"HSET": true, "HMSET": true, "HSETNX": true, "HDEL": true, "HINCRBY": true, "HINCRBYFLOAT": true,
+	"LPUSH": true, "RPUSH": true, "LPUSHX": true, "RPUSHX": true, "LPOP": true, "RPOP": true,
+	"LMOVE": true, "RPOPLPUSH": true, "LSET": true, "LREM": true, "LTRIM": true, "LINSERT": true,
+	"SADD": true, "SREM": true, "SPOP": true, "SMOVE": true,
+	"SINTERSTORE": true, "SUNIONSTORE": true, "SDIFFSTORE": true,
+	"ZADD": true, "ZINCRBY": true, "ZREM": true,
+	"DEL": true, "UNLINK": true, "RENAME": true, "RENAMENX": true, "RESTORE": true,
+}
+
+// listMoveCommands are the write commands that propagate themselves
+var listMoveCommands = map[string]bool{
+	"BLPOP": true, "BRPOP": true, "BLMOVE": true, "BRPOPLPUSH": true,
+}
+
+// relativeTTLCommands can set a TTL relative to the time they run
+var relativeTTLCommands = map[string]bool{
+	"SET": true, "PUT": true, "GETEX": true, "EXPIRE": true, "PEXPIRE": true, "RESTORE": true,
+}
+
+// isWriteCommand reports whether a command changes the cache
+func isWriteCommand(cmd string) bool {
+	return writeCommands[cmd] || listMoveCommands[cmd]
+}
+
+// commandKeys returns the keys a write command touches
+func commandKeys(cmd string, args []Value) []string {
+	var keys []string
+	switch cmd {
+	case "MSET", "MSETNX":
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, argString(args[i]))
+		}
+	case "DEL", "UNLINK", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
+		for _, arg := range args {
+			keys = append(keys, argString(arg))
+		}
+	case "RENAME", "RENAMENX", "SMOVE", "LMOVE", "RPOPLPUSH":
+		for _, arg := range args[:min(2, len(args))] {
+			keys = append(keys, argString(arg))
+		}
+	default:
+		if len(args) > 0 {
+			keys = append(keys, argString(args[0]))
+		}
+	}
+	return keys
+}
+
+// command builds a RESP command the way a client sends it
+func command(args ...string) Value {
+	return bulkArray(args)
+}
+
+func newPropagator(c *LRUCache) *propagator {
+	return &propagator{
+		cache:    c,
+		stripes:  make([]sync.Mutex, c.shardCount),
+		applying: make([]atomic.Bool, c.shardCount),
+		served:   make(map[uint32][]Value),
+	}
+}
+
+// lockKeys takes the stripe locks of the shards of keys in index order, like
+// LRUCache.lockKeys does with the shard locks. It returns the unlock function
+func (p *propagator) lockKeys(keys ...string) func() {
+	indexes := p.shardIndexes(keys)
+	for _, idx := range indexes {
+		p.stripes[idx].Lock()
+	}
+	if p.capturing.Load() > 0 {
+		p.encodeForCaptures(indexes)
+	}
+	return func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			p.stripes[indexes[i]].Unlock()
+		}
+	}
+}
+
+// lockForPrimary is lockKeys for a replica applying a command of its primary
+func (p *propagator) lockForPrimary(keys []string) func() {
+	unlock := p.lockKeys(keys...)
+	indexes := p.shardIndexes(keys)
+	for _, idx := range indexes {
+		p.applying[idx].Store(true)
+	}
+	return func() {
+		for _, idx := range indexes {
+			p.applying[idx].Store(false)
+		}
+		unlock()
+	}
+}
+
+// fromPrimary reports whether the command touching key is one of the primary. A replica
+// leaves expired keys to its primary, which propagates a DEL when it removes them, and
+// until then the commands of the primary find them where they were
+func (p *propagator) fromPrimary(key string) bool {
+	return p.replicated.Load() && p.applying[p.cache.shardIndex(key)].Load()
+}
+
+// lockShard takes the stripe of shard idx, for removing keys a command didn't ask for.
+// It returns the unlock function
+func (p *propagator) lockShard(idx uint32) func() {
+	p.stripes[idx].Lock()
+	return p.stripes[idx].Unlock
+}
+
+// tryLockKey takes the stripe of the shard of key if nobody holds it, for a reader
+// that found the key expired. It returns the unlock function
+func (p *propagator) tryLockKey(key string) (func(), bool) {
+	stripe := &p.stripes[p.cache.shardIndex(key)]
+	if !stripe.TryLock() {
+		return nil, false
+	}
+	return stripe.Unlock, true
+}
+
+// encodeForCaptures encodes the shards a write is about to change for the captures that
+// haven't yet, so the write shows in their tail and not in their shards. Callers hold the
+// stripes of indexes
+func (p *propagator) encodeForCaptures(indexes []uint32) {
+	p.mutex.Lock()
+	captures := slices.Clone(p.captures)
+	p.mutex.Unlock()
+
+	for _, cp := range captures {
+		for _, idx := range indexes {
+			cp.encodeShard(p.cache, idx)
+		}
+	}
+}
+
+// encodeShard encodes shard idx unless it already is, callers hold its stripe
+func (cp *capture) encodeShard(c *LRUCache, idx uint32) {
+	if !cp.encoded[idx] {
+		cp.parts[idx] = cp.encode(c.shards[idx])
+		cp.encoded[idx] = true
+	}
+}
+
+// capture takes a copy of the cache, see the capture type. encode encodes one shard, it
+// takes the shard lock itself. pinned gets the copy: the encoded shards and the tail of the
+// stream that follows them. It runs under the propagator mutex, at the point of the stream
+// the copy is pinned to, nothing is propagated until it returns
+func (p *propagator) capture(encode func(shard *cacheShard) []byte, pinned func(shards, tail []byte)) {
+	p.take(&capture{encode: encode}, pinned)
+}
+
+// snapshot returns the encoded shards of a capture, the cache as it was when it started
+func (p *propagator) snapshot(encode func(shard *cacheShard) []byte) []byte {
+	var copied []byte
+	p.take(&capture{encode: encode, snapshot: true}, func(shards, _ []byte) { copied = shards })
+	return copied
+}
+
+// take runs a capture, see capture
+func (p *propagator) take(cp *capture, pinned func(shards, tail []byte)) {
+	cp.parts = make([][]byte, len(p.stripes))
+	cp.encoded = make([]bool, len(p.stripes))
+	p.mutex.Lock()
+	p.captures = append(p.captures, cp)
+	p.capturing.Add(1)
+	p.mutex.Unlock()
+
+	for {
+		// only the writes to the shard being encoded wait
+		for i := range p.stripes {
+			p.stripes[i].Lock()
+			cp.encodeShard(p.cache, uint32(i))
+			p.stripes[i].Unlock()
+		}
+		p.mutex.Lock()
+		if !cp.restart {
+			break
+		}
+		cp.restart = false
+		p.mutex.Unlock()
+	}
+	defer p.mutex.Unlock()
+	p.captures = slices.DeleteFunc(p.captures, func(other *capture) bool { return other == cp })
+	p.capturing.Add(-1)
+	pinned(bytes.Join(cp.parts, nil), cp.tail)
+}
+
+// shardIndexes returns the distinct shards of keys in index order
+func (p *propagator) shardIndexes(keys []string) []uint32 {
+	indexes := make([]uint32, 0, len(keys))
+	for _, key := range keys {
+		idx := p.cache.shardIndex(key)
+		i := 0
+		for i < len(indexes) && indexes[i] < idx {
+			i++
+		}
+		if i < len(indexes) && indexes[i] == idx {
+			continue
+		}
+		indexes = append(indexes, 0)
+		copy(indexes[i+1:], indexes[i:])
+		indexes[i] = idx
+	}
+	return indexes
+}
+
+// restartCaptures makes the captures under way encode every shard again, after the
+// content of the cache was replaced. Callers hold every stripe
+func (p *propagator) restartCaptures() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, cp := range p.captures {
+		clear(cp.parts)
+		clear(cp.encoded)
+		cp.tail, cp.restart = nil, true
+	}
+}
+
+// log propagates commands that touched keys, followed by the pops the commands handed to
+// blocked clients. Callers hold the stripe locks of keys
+func (p *propagator) log(keys []string, commands ...Value) {
+	if p.replicated.Load() {
+		return
+	}
+	var buf []byte
+	for _, cmd := range commands {
+		buf = append(buf, cmd.Marshal()...)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	indexes := p.shardIndexes(keys)
+	for _, idx := range indexes {
+		for _, pop := range p.served[idx] {
+			buf = append(buf, pop.Marshal()...)
+		}
+		delete(p.served, idx)
+	}
+	p.write(indexes, buf, true)
+}
+
+// write appends buf, the stream of a write to the shards indexes, to the append only file
+// (unless toAOF is false), the backlog and the tails of the captures that encoded those
+// shards already. Callers hold the mutex and the stripes of indexes
+func (p *propagator) write(indexes []uint32, buf []byte, toAOF bool) {
+	if len(buf) == 0 {
+		return
+	}
+	if toAOF {
+		p.cache.aof.write(buf)
+	}
+	p.cache.replication.backlog.write(buf)
+	if len(indexes) == 0 {
+		return
+	}
+	for _, cp := range p.captures {
+		if cp.encoded[indexes[0]] && !cp.snapshot {
+			cp.tail = append(cp.tail, buf...)
+		}
+	}
+}
+
+// removed propagates the removal of an evicted or expired key as a DEL. Callers hold the
+// stripe of key and the shard lock, and call it before anything else of the command that
+// found the key expired is propagated
+func (p *propagator) removed(key string) {
+	if p.replicated.Load() {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.write([]uint32{p.cache.shardIndex(key)}, command("DEL", key).Marshal(), true)
+}
+
+// servedPop notes that a push handed the element at the head (left) or tail of key
+// to a blocked client. Callers hold the shard lock of key
+func (p *propagator) servedPop(key string, left bool) {
+	if p.replicated.Load() {
+		return
+	}
+	p.mutex.Lock()
+	idx := p.cache.shardIndex(key)
+	p.served[idx] = append(p.served[idx], command(popName(left), key))
+	p.mutex.Unlock()
+}
+
+// propagate runs a write command and propagates it if it succeeded, see the top of the file
+func (p *propagator) propagate(cmd string, value Value, run func() Value) Value {
+	if !writeCommands[cmd] {
+		return run()
+	}
+
+	args := value.array[1:]
+	keys := commandKeys(cmd, args)
+	unlock := p.lockKeys(keys...)
+	defer unlock()
+
+	response := run()
+	if response.typ == "error" {
+		return response
+	}
+
+	switch {
+	case cmd == "SPOP":
+		// what gets popped is random, running SPOP again would pop something else
+		var popped []string
+		if response.typ == "array" {
+			popped = arrayStrings(response)
+		} else if !response.null {
+			popped = []string{response.bulk}
+		}
+		if len(popped) > 0 {
+			p.log(keys, command(append([]string{"SREM", keys[0]}, popped...)...))
+		} else {
+			p.log(keys)
+		}
+
+	case relativeTTLCommands[cmd] && len(keys) > 0:
+		if expireAt := p.cache.ExpireAt(keys[0]); expireAt > 0 {
+			p.log(keys, value, command("PEXPIREAT", keys[0], strconv.FormatInt(expireAt, 10)))
+		} else {
+			p.log(keys, value)
+		}
+
+	default:
+		p.log(keys, value)
+	}
+	return response
+}
+
+// arrayStrings returns the bulk strings of an array reply
+func arrayStrings(v Value) []string {
+	out := make([]string, 0, len(v.array))
+	for _, item := range v.array {
+		out = append(out, item.bulk)
+	}
+	return out
+}
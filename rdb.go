@@ -0,0 +1,920 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis RDB files
+//
+// Besides its own snapshot format the cache reads and writes the one redis uses, so data can
+// move between redis and gored in both directions. An RDB file is a header, a list of keys
+// (each optionally preceded by its expire time and LRU/LFU information) and a trailer:
+//
+//	"REDIS" version(4 digits) [opcode | type key value]* 0xFF crc64(8 bytes, little endian)
+//
+// Lengths use the RDB variable length encoding, the top two bits of the first byte pick
+// between 6, 14, 32 and 64 bit lengths or a special encoding: a string stored as an integer
+// or compressed with LZF. Besides the plain encodings, redis stores small and not so small
+// collections as ziplists, listpacks and intsets, all of them are read here. Streams and
+// module types can't be loaded, and neither can the hash field TTLs of redis 7.4.
+//
+// We write version 9 (redis 5) files with the plain encodings, which every redis since 5.0
+// can load. A gored database has no numbered databases: keys are written to db 0, and only
+// the keys of db 0 are loaded. The LRU idle time is written and read, the LFU counter is
+// read, so recency survives the trip.
+const (
+	rdbMagic        = "REDIS"
+	rdbVersion      = 9  // the version we write
+	rdbMaxVersion   = 12 // the newest version we read (redis 7.4)
+	rdbChecksumFrom = 5  // versions from this one on end with a checksum
+
+	// opcodes
+	rdbOpSlotInfo     = 0xF4
+	rdbOpFunction2    = 0xF5
+	rdbOpFunction     = 0xF6
+	rdbOpModuleAux    = 0xF7
+	rdbOpIdle         = 0xF8
+	rdbOpFreq         = 0xF9
+	rdbOpAux          = 0xFA
+	rdbOpResizeDB     = 0xFB
+	rdbOpExpireMs     = 0xFC
+	rdbOpExpire       = 0xFD
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+	rdbEncInt8        = 0
+	rdbEncInt16       = 1
+	rdbEncInt32       = 2
+	rdbEncLZF         = 3
+	rdbQuicklistPlain = 1 // quicklist node holding a single element instead of a listpack
+
+	// value types
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeSet            = 2
+	rdbTypeZSet           = 3
+	rdbTypeHash           = 4
+	rdbTypeZSet2          = 5
+	rdbTypeListZiplist    = 10
+	rdbTypeSetIntset      = 11
+	rdbTypeZSetZiplist    = 12
+	rdbTypeHashZiplist    = 13
+	rdbTypeListQuicklist  = 14
+	rdbTypeHashListpack   = 16
+	rdbTypeZSetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeSetListpack    = 20
+)
+
+var (
+	errBadRDB = errors.New("bad RDB file")
+
+	// redis' CRC-64 uses the Jones polynomial (reflected here) and no inversion
+	rdbCRCTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+	snapshotFormat = newSetting(snapshotFormatFromEnv())
+)
+
+// snapshotFormats are the formats SAVE and BGSAVE can write, by their snapshot-format name
+var snapshotFormats = map[string]bool{"gored": true, "rdb": true}
+
+// snapshotFormatFromEnv returns the snapshot format found in the environment, or gored
+func snapshotFormatFromEnv() string {
+	format := strings.ToLower(envOr("snapshot-format", "gored"))
+	if !snapshotFormats[format] {
+		fmt.Printf("Ignoring SNAPSHOT_FORMAT: unknown format %q\n", format)
+		return "gored"
+	}
+	return format
+}
+
+// checksum is a running checksum of what is written through it
+type checksum interface {
+	io.Writer
+	Sum64() uint64
+}
+
+// rdbChecksum computes the redis flavor of CRC-64. hash/crc64 can't, it always
+// inverts the checksum before and after
+type rdbChecksum uint64
+
+func (c *rdbChecksum) Write(p []byte) (int, error) {
+	crc := uint64(*c)
+	for _, b := range p {
+		crc = rdbCRCTable[byte(crc)^b] ^ crc>>8
+	}
+	*c = rdbChecksum(crc)
+	return len(p), nil
+}
+
+func (c *rdbChecksum) Sum64() uint64 {
+	return uint64(*c)
+}
+
+// isRDB reports whether the file at path is a redis RDB file
+func isRDB(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(rdbMagic))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == rdbMagic
+}
+
+// encodeRDB writes the cache as an RDB file without the checksum, see the top of the file.
+// Like encodeSnapshot it writes a point-in-time copy of the cache
+func (c *LRUCache) encodeRDB(w io.Writer) error {
+	header := fmt.Appendf(nil, "%s%04d", rdbMagic, rdbVersion)
+	header = appendRDBAux(header, "ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	header = appendRDBAux(header, "redis-bits", "64")
+	header = append(header, rdbOpSelectDB, 0)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	entries := c.propagation.snapshot(func(shard *cacheShard) []byte { return shard.appendRDBEntries(nil) })
+	if _, err := w.Write(entries); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{rdbOpEOF})
+	return err
+}
+
+// appendRDBEntries encodes the entries of a shard that haven't expired, least recently
+// used first like appendEntries
+func (s *cacheShard) appendRDBEntries(buf []byte) []byte {
+	now := nowMillis()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for elem := s.evictionQ.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*cacheEntry)
+		if !entry.isExpired(now) {
+			buf = appendRDBEntry(buf, entry, now)
+		}
+	}
+	return buf
+}
+
+// appendRDBAux encodes an auxiliary field, the metadata redis keeps in the header
+func appendRDBAux(b []byte, key, value string) []byte {
+	b = append(b, rdbOpAux)
+	b = appendRDBString(b, key)
+	return appendRDBString(b, value)
+}
+
+// appendRDBEntry encodes a key with its expire time, idle time and value
+func appendRDBEntry(b []byte, entry *cacheEntry, now int64) []byte {
+	if entry.expireAt != 0 {
+		b = append(b, rdbOpExpireMs)
+		b = binary.LittleEndian.AppendUint64(b, uint64(entry.expireAt))
+	}
+	b = append(b, rdbOpIdle)
+	b = appendRDBLength(b, uint64(max(now-entry.lastAccess, 0)/1000))
+
+	switch v := entry.value.(type) {
+	case string:
+		b = append(b, rdbTypeString)
+		b = appendRDBString(b, entry.key)
+		b = appendRDBString(b, v)
+
+	case hashValue:
+		b = append(b, rdbTypeHash)
+		b = appendRDBString(b, entry.key)
+		b = appendRDBLength(b, uint64(len(v)))
+		for field, value := range v {
+			b = appendRDBString(b, field)
+			b = appendRDBString(b, value)
+		}
+
+	case *listValue:
+		b = append(b, rdbTypeList)
+		b = appendRDBString(b, entry.key)
+		b = appendRDBLength(b, uint64(v.size))
+		for i := 0; i < v.size; i++ {
+			b = appendRDBString(b, v.at(i))
+		}
+
+	case setValue:
+		b = append(b, rdbTypeSet)
+		b = appendRDBString(b, entry.key)
+		b = appendRDBLength(b, uint64(len(v)))
+		for member := range v {
+			b = appendRDBString(b, member)
+		}
+
+	case *zsetValue:
+		b = append(b, rdbTypeZSet2)
+		b = appendRDBString(b, entry.key)
+		b = appendRDBLength(b, uint64(len(v.dict)))
+		for member, score := range v.dict {
+			b = appendRDBString(b, member)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(score))
+		}
+	}
+	return b
+}
+
+// appendRDBLength encodes n with the RDB length encoding
+func appendRDBLength(b []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, byte(n>>8)|0x40, byte(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0x80), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0x81), n)
+	}
+}
+
+// appendRDBString encodes a length prefixed string. We don't bother with the integer
+// and LZF encodings, redis reads plain strings just as well
+func appendRDBString(b []byte, s string) []byte {
+	return append(appendRDBLength(b, uint64(len(s))), s...)
+}
+
+// LoadRDB loads the keys of db 0 found in a redis RDB file, replacing the ones the cache
+// already holds and skipping the ones that expired. The checksum is verified before
+// anything is loaded. It returns the number of keys loaded
+func (c *LRUCache) LoadRDB(path string) (int, error) {
+	version, err := verifyRDB(path)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	d := &rdbDecoder{r: bufio.NewReader(f)}
+	d.r.Discard(len(rdbMagic) + 4)
+
+	loaded, skipped := 0, 0
+	now := nowMillis()
+	db := 0
+	var expireAt, idle int64 = 0, -1
+	freq := -1
+	for d.err == nil {
+		typ := d.byte()
+		switch typ {
+		case rdbOpEOF:
+			if skipped > 0 {
+				fmt.Printf("Skipped %d keys of databases other than 0 in %s\n", skipped, path)
+			}
+			c.sortByRecency()
+			return loaded, nil
+		case rdbOpSelectDB:
+			db = d.count()
+			continue
+		case rdbOpResizeDB:
+			d.count()
+			d.count()
+			continue
+		case rdbOpAux:
+			d.string()
+			d.string()
+			continue
+		case rdbOpSlotInfo:
+			d.count()
+			d.count()
+			d.count()
+			continue
+		case rdbOpFunction2:
+			d.string() // function libraries, we have no scripting
+			continue
+		case rdbOpExpireMs:
+			expireAt = int64(binary.LittleEndian.Uint64(d.read(8)))
+			continue
+		case rdbOpExpire:
+			expireAt = int64(binary.LittleEndian.Uint32(d.read(4))) * 1000
+			continue
+		case rdbOpIdle:
+			idle = int64(d.count())
+			continue
+		case rdbOpFreq:
+			freq = int(d.byte())
+			continue
+		case rdbOpModuleAux, rdbOpFunction:
+			d.fail(fmt.Errorf("%w: opcode 0x%X (modules or functions) is not supported", errBadRDB, typ))
+			continue
+		}
+
+		key := d.string()
+		value := d.value(typ)
+		if d.err != nil {
+			break
+		}
+
+		entry := &cacheEntry{key: key, value: value, expireAt: expireAt}
+		entry.lastAccess, entry.freq = now, lfuInitVal
+		if idle >= 0 {
+			entry.lastAccess = now - idle*1000
+		}
+		if freq >= 0 {
+			entry.freq = uint8(freq)
+		}
+		expireAt, idle, freq = 0, -1, -1
+
+		switch {
+		case db != 0:
+			skipped++
+		case entry.isExpired(now) || entry.isEmpty():
+		default:
+			c.restoreEntry(entry)
+			loaded++
+		}
+	}
+
+	c.sortByRecency()
+	return loaded, fmt.Errorf("%s (RDB version %d): %w", path, version, d.err)
+}
+
+// verifyRDB checks the header and the checksum of an RDB file and returns its version.
+// A zero checksum means redis was told not to compute one (rdbchecksum no)
+func verifyRDB(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, len(rdbMagic)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, fmt.Errorf("%s: %w: file too short", path, errBadRDB)
+	}
+	version, err := strconv.Atoi(string(header[len(rdbMagic):]))
+	if string(header[:len(rdbMagic)]) != rdbMagic || err != nil || version < 1 {
+		return 0, fmt.Errorf("%s: %w: not an RDB file", path, errBadRDB)
+	}
+	if version > rdbMaxVersion {
+		return 0, fmt.Errorf("%s: %w: version %d is newer than %d", path, errBadRDB, version, rdbMaxVersion)
+	}
+	if version < rdbChecksumFrom {
+		return version, nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size() - 8
+	if size <= int64(len(header)) {
+		return 0, fmt.Errorf("%s: %w: file too short", path, errBadRDB)
+	}
+
+	crc := new(rdbChecksum)
+	crc.Write(header)
+	if _, err := io.CopyN(crc, r, size-int64(len(header))); err != nil {
+		return 0, err
+	}
+	var trailer [8]byte
+	if _, err := io.ReadFull(r, trailer[:]); err != nil {
+		return 0, err
+	}
+	if sum := binary.LittleEndian.Uint64(trailer[:]); sum != 0 && sum != crc.Sum64() {
+		return 0, fmt.Errorf("%s: %w: checksum mismatch", path, errBadRDB)
+	}
+	return version, nil
+}
+
+// rdbDecoder reads the RDB encodings. Like decoder it remembers the first error, after
+// which every read returns zero values
+type rdbDecoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *rdbDecoder) fail(err error) {
+	if d.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		d.err = err
+	}
+}
+
+func (d *rdbDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		d.fail(err)
+	}
+	return b
+}
+
+// read reads n bytes. Big reads grow the buffer as the data comes in, a corrupted length
+// must not make us allocate more than the file holds
+func (d *rdbDecoder) read(n int) []byte {
+	if d.err != nil {
+		return make([]byte, min(n, 8))
+	}
+	if n <= 1<<20 {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(d.r, b); err != nil {
+			d.fail(err)
+		}
+		return b
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		d.fail(err)
+	}
+	return buf.Bytes()
+}
+
+// length reads an RDB length. special is true for the special string encodings,
+// the length is then the encoding
+func (d *rdbDecoder) length() (n uint64, special bool) {
+	b := d.byte()
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false
+	case 1:
+		return uint64(b&0x3f)<<8 | uint64(d.byte()), false
+	case 2:
+		switch b {
+		case 0x80:
+			return uint64(binary.BigEndian.Uint32(d.read(4))), false
+		case 0x81:
+			return binary.BigEndian.Uint64(d.read(8)), false
+		}
+		d.fail(fmt.Errorf("%w: unknown length encoding 0x%X", errBadRDB, b))
+		return 0, false
+	default:
+		return uint64(b & 0x3f), true
+	}
+}
+
+// count reads a length that can't be a special encoding
+func (d *rdbDecoder) count() int {
+	n, special := d.length()
+	if special || n > math.MaxInt32 {
+		d.fail(fmt.Errorf("%w: bad length", errBadRDB))
+		return 0
+	}
+	return int(n)
+}
+
+// string reads a string in any of its encodings
+func (d *rdbDecoder) string() string {
+	n, special := d.length()
+	if !special {
+		if n > math.MaxInt32 {
+			d.fail(fmt.Errorf("%w: string too long", errBadRDB))
+			return ""
+		}
+		return string(d.read(int(n)))
+	}
+
+	switch n {
+	case rdbEncInt8:
+		return strconv.Itoa(int(int8(d.byte())))
+	case rdbEncInt16:
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(d.read(2)))))
+	case rdbEncInt32:
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(d.read(4)))))
+	case rdbEncLZF:
+		compressed := d.count()
+		size := d.count()
+		data := d.read(compressed)
+		if d.err != nil {
+			return ""
+		}
+		s, err := lzfDecompress(data, size)
+		if err != nil {
+			d.fail(err)
+		}
+		return string(s)
+	}
+	d.fail(fmt.Errorf("%w: unknown string encoding %d", errBadRDB, n))
+	return ""
+}
+
+// legacyFloat reads a sorted set score of the old zset type, a number printed as a string
+// with a one byte length. 253, 254 and 255 stand for NaN, +inf and -inf
+func (d *rdbDecoder) legacyFloat() float64 {
+	switch n := d.byte(); n {
+	case 253:
+		return math.NaN()
+	case 254:
+		return math.Inf(1)
+	case 255:
+		return math.Inf(-1)
+	default:
+		f, err := strconv.ParseFloat(string(d.read(int(n))), 64)
+		if err != nil {
+			d.fail(fmt.Errorf("%w: bad score", errBadRDB))
+		}
+		return f
+	}
+}
+
+// blob reads a string holding a ziplist, listpack or intset and decodes it with parse
+func (d *rdbDecoder) blob(parse func([]byte) ([]string, error)) []string {
+	b := d.string()
+	if d.err != nil {
+		return nil
+	}
+	items, err := parse([]byte(b))
+	if err != nil {
+		d.fail(err)
+	}
+	return items
+}
+
+// value reads a value of the given RDB type
+func (d *rdbDecoder) value(typ byte) interface{} {
+	switch typ {
+	case rdbTypeString:
+		return d.string()
+
+	case rdbTypeList:
+		n := d.count()
+		items := make([]string, 0, min(n, 1024))
+		for i := 0; i < n && d.err == nil; i++ {
+			items = append(items, d.string())
+		}
+		return listFrom(items)
+
+	case rdbTypeListZiplist:
+		return listFrom(d.blob(ziplistEntries))
+
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		var items []string
+		nodes := d.count()
+		for i := 0; i < nodes && d.err == nil; i++ {
+			if typ == rdbTypeListQuicklist {
+				items = append(items, d.blob(ziplistEntries)...)
+			} else if d.count() == rdbQuicklistPlain {
+				items = append(items, d.string())
+			} else {
+				items = append(items, d.blob(listpackEntries)...)
+			}
+		}
+		return listFrom(items)
+
+	case rdbTypeSet:
+		n := d.count()
+		s := make(setValue, min(n, 1024))
+		for i := 0; i < n && d.err == nil; i++ {
+			s[d.string()] = struct{}{}
+		}
+		return s
+
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		parse := listpackEntries
+		if typ == rdbTypeSetIntset {
+			parse = intsetEntries
+		}
+		members := d.blob(parse)
+		s := make(setValue, len(members))
+		for _, member := range members {
+			s[member] = struct{}{}
+		}
+		return s
+
+	case rdbTypeHash:
+		n := d.count()
+		h := make(hashValue, min(n, 1024))
+		for i := 0; i < n && d.err == nil; i++ {
+			field := d.string()
+			h[field] = d.string()
+		}
+		return h
+
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		parse := listpackEntries
+		if typ == rdbTypeHashZiplist {
+			parse = ziplistEntries
+		}
+		pairs := d.blob(parse)
+		if len(pairs)%2 != 0 {
+			d.fail(fmt.Errorf("%w: odd number of hash entries", errBadRDB))
+			return nil
+		}
+		h := make(hashValue, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			h[pairs[i]] = pairs[i+1]
+		}
+		return h
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		n := d.count()
+		z := newZSet()
+		for i := 0; i < n && d.err == nil; i++ {
+			member := d.string()
+			var score float64
+			if typ == rdbTypeZSet {
+				score = d.legacyFloat()
+			} else {
+				score = math.Float64frombits(binary.LittleEndian.Uint64(d.read(8)))
+			}
+			if math.IsNaN(score) {
+				d.fail(fmt.Errorf("%w: NaN score", errBadRDB))
+				break
+			}
+			z.set(member, score)
+		}
+		return z
+
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		parse := listpackEntries
+		if typ == rdbTypeZSetZiplist {
+			parse = ziplistEntries
+		}
+		pairs := d.blob(parse)
+		if len(pairs)%2 != 0 {
+			d.fail(fmt.Errorf("%w: odd number of sorted set entries", errBadRDB))
+			return nil
+		}
+		z := newZSet()
+		for i := 0; i < len(pairs); i += 2 {
+			score, err := strconv.ParseFloat(pairs[i+1], 64)
+			if err != nil || math.IsNaN(score) {
+				d.fail(fmt.Errorf("%w: bad score", errBadRDB))
+				return nil
+			}
+			z.set(pairs[i], score)
+		}
+		return z
+	}
+
+	d.fail(fmt.Errorf("%w: value type %d is not supported (streams, modules and hashes with field TTLs can't be loaded)", errBadRDB, typ))
+	return nil
+}
+
+// listFrom makes a list value out of its elements
+func listFrom(items []string) *listValue {
+	l := &listValue{}
+	l.replace(items)
+	return l
+}
+
+// leInt decodes a little endian signed integer of 1 to 8 bytes
+func leInt(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*uint(len(b))
+	return int64(v<<shift) >> shift
+}
+
+// ziplistEntries decodes a ziplist, the compact list encoding of redis up to 6.2:
+//
+//	zlbytes(4) zltail(4) zllen(2) [prevlen encoding data]* 0xFF
+func ziplistEntries(b []byte) ([]string, error) {
+	bad := fmt.Errorf("%w: bad ziplist", errBadRDB)
+	if len(b) < 11 {
+		return nil, bad
+	}
+
+	var items []string
+	pos := 10
+	for {
+		if pos >= len(b) {
+			return nil, bad
+		}
+		if b[pos] == 0xFF {
+			return items, nil
+		}
+
+		// the length of the previous entry, 1 byte or 0xFE and 4 bytes
+		if b[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(b) {
+			return nil, bad
+		}
+
+		enc := b[pos]
+		var n, size int // string length, integer size
+		header := 1
+		switch {
+		case enc>>6 == 0:
+			n = int(enc & 0x3f)
+		case enc>>6 == 1:
+			if pos+1 >= len(b) {
+				return nil, bad
+			}
+			n, header = int(enc&0x3f)<<8|int(b[pos+1]), 2
+		case enc == 0x80:
+			if pos+4 >= len(b) {
+				return nil, bad
+			}
+			n, header = int(binary.BigEndian.Uint32(b[pos+1:])), 5
+		case enc == 0xC0:
+			size = 2
+		case enc == 0xD0:
+			size = 4
+		case enc == 0xE0:
+			size = 8
+		case enc == 0xF0:
+			size = 3
+		case enc == 0xFE:
+			size = 1
+		case enc >= 0xF1 && enc <= 0xFD:
+			// a 4 bit immediate between 0 and 12
+			items = append(items, strconv.Itoa(int(enc&0x0f)-1))
+			pos++
+			continue
+		default:
+			return nil, bad
+		}
+
+		pos += header
+		if size > 0 {
+			if pos+size > len(b) {
+				return nil, bad
+			}
+			items = append(items, strconv.FormatInt(leInt(b[pos:pos+size]), 10))
+			pos += size
+			continue
+		}
+		if n < 0 || pos+n > len(b) {
+			return nil, bad
+		}
+		items = append(items, string(b[pos:pos+n]))
+		pos += n
+	}
+}
+
+// listpackEntries decodes a listpack, the compact encoding of redis 7:
+//
+//	total bytes(4) count(2) [encoding data backlen]* 0xFF
+func listpackEntries(b []byte) ([]string, error) {
+	bad := fmt.Errorf("%w: bad listpack", errBadRDB)
+	if len(b) < 7 {
+		return nil, bad
+	}
+
+	var items []string
+	pos := 6
+	for {
+		if pos >= len(b) {
+			return nil, bad
+		}
+		enc := b[pos]
+		if enc == 0xFF {
+			return items, nil
+		}
+
+		n, size := -1, 0 // string length, integer size
+		header := 1
+		switch {
+		case enc&0x80 == 0:
+			items = append(items, strconv.Itoa(int(enc&0x7f)))
+		case enc&0xC0 == 0x80:
+			n = int(enc & 0x3f)
+		case enc&0xE0 == 0xC0:
+			if pos+1 >= len(b) {
+				return nil, bad
+			}
+			// 13 bit signed integer
+			v := int(enc&0x1f)<<8 | int(b[pos+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			items = append(items, strconv.Itoa(v))
+			header = 2
+		case enc&0xF0 == 0xE0:
+			if pos+1 >= len(b) {
+				return nil, bad
+			}
+			n, header = int(enc&0x0f)<<8|int(b[pos+1]), 2
+		case enc == 0xF0:
+			if pos+4 >= len(b) {
+				return nil, bad
+			}
+			n, header = int(binary.LittleEndian.Uint32(b[pos+1:])), 5
+		case enc >= 0xF1 && enc <= 0xF4:
+			size = [...]int{2, 3, 4, 8}[enc-0xF1]
+		default:
+			return nil, bad
+		}
+
+		entry := header
+		switch {
+		case size > 0:
+			if pos+1+size > len(b) {
+				return nil, bad
+			}
+			items = append(items, strconv.FormatInt(leInt(b[pos+1:pos+1+size]), 10))
+			entry += size
+		case n >= 0:
+			if pos+header+n > len(b) {
+				return nil, bad
+			}
+			items = append(items, string(b[pos+header:pos+header+n]))
+			entry += n
+		}
+		pos += entry + listpackBacklen(entry)
+	}
+}
+
+// listpackBacklen is the size of the back length that follows a listpack entry,
+// it encodes the entry length 7 bits per byte
+func listpackBacklen(entry int) int {
+	switch {
+	case entry <= 127:
+		return 1
+	case entry < 16383:
+		return 2
+	case entry < 2097151:
+		return 3
+	case entry < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// intsetEntries decodes an intset, a sorted array of integers:
+//
+//	encoding(4, the integer size) length(4) integers
+func intsetEntries(b []byte) ([]string, error) {
+	bad := fmt.Errorf("%w: bad intset", errBadRDB)
+	if len(b) < 8 {
+		return nil, bad
+	}
+	size := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if size != 2 && size != 4 && size != 8 || len(b) != 8+n*size {
+		return nil, bad
+	}
+
+	items := make([]string, n)
+	for i := range items {
+		items[i] = strconv.FormatInt(leInt(b[8+i*size:8+(i+1)*size]), 10)
+	}
+	return items, nil
+}
+
+// lzfDecompress decompresses LZF data, which redis uses for strings longer than 20 bytes.
+// Every control byte starts a literal run (below 32) or a back reference into the output
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	bad := fmt.Errorf("%w: bad LZF data", errBadRDB)
+	out := make([]byte, 0, min(size, 1<<20))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > size {
+				return nil, bad
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, bad
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, bad
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		n += 2
+		if ref < 0 || len(out)+n > size {
+			return nil, bad
+		}
+		// byte by byte, the reference may overlap what we are writing
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != size {
+		return nil, bad
+	}
+	return out, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+// Read buffers
+//
+// With the default list engine every GET moves its key to the front of the recency list,
+// which needs the shard write lock, so reads of one shard can never run in parallel. The
+// read-buffer engine records hits in a small per shard buffer instead, under the read lock.
+// Whoever fills the buffer takes the write lock once and replays the whole batch. The
+// buffer is lossy: reads arriving while it is full are not recorded, so recency and LFU
+// counters become approximate for the hottest keys, which are the ones that least need
+// them to be exact. Like in redis, eviction only ever needed an approximation anyway.
+const readBufferSize = 64
+
+// readBuffer collects the elements hit by reads of one shard until they are replayed
+type readBuffer struct {
+	slots [readBufferSize]atomic.Pointer[list.Element]
+	next  atomic.Uint32 // the next free slot, readBufferSize and up means the buffer is full
+}
+
+// record notes a hit on elem. It returns true for the read that filled the buffer,
+// that caller has to drain it. Safe to call with only the shard read lock held
+func (b *readBuffer) record(elem *list.Element) bool {
+	i := b.next.Add(1) - 1
+	if i >= readBufferSize {
+		// full, somebody is about to drain it and this hit is lost
+		return false
+	}
+	b.slots[i].Store(elem)
+	return i == readBufferSize-1
+}
+
+// drainReads replays the buffered hits of the shard and reports whether watch was one of
+// them. An element may have been removed or replaced since it was recorded, a reader may
+// also not have stored its element yet when we get here. Those hits are simply dropped.
+// Callers must hold the shard write lock
+func (s *cacheShard) drainReads(watch *list.Element) bool {
+	if s.reads.next.Load() == 0 {
+		return false
+	}
+	watched := false
+	for i := range s.reads.slots {
+		elem := s.reads.slots[i].Swap(nil)
+		if elem == nil {
+			continue
+		}
+		if current, ok := s.items[elem.Value.(*cacheEntry).key]; ok && current == elem {
+			s.touch(elem)
+			watched = watched || elem == watch
+		}
+	}
+	s.reads.next.Store(0)
+	return watched
+}
+
+// StorageEngine returns the storage-engine setting: list or read-buffer
+func (c *LRUCache) StorageEngine() string {
+	if c.bufferReads.Load() {
+		return "read-buffer"
+	}
+	return "list"
+}
+
+// SetStorageEngine switches the storage engine by its storage-engine name. Reads still
+// sitting in the buffers when going back to list are replayed by the next drain or lost
+func (c *LRUCache) SetStorageEngine(name string) bool {
+	switch name {
+	case "list":
+		c.bufferReads.Store(false)
+	case "read-buffer":
+		c.bufferReads.Store(true)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// BenchmarkParallelReads runs the same read only load on both storage engines. With
+// -cpu 1,2,4,8 the read-buffer engine should scale further, its hits only take the shard
+// read lock while the list engine takes the write lock for every one of them
+func BenchmarkParallelReads(b *testing.B) {
+	names := benchKeyNames()
+	for _, engine := range []string{"list", "read-buffer"} {
+		b.Run(engine, func(b *testing.B) {
+			c := newBenchCache(b)
+			c.SetStorageEngine(engine)
+			// a skewed load, the hot keys are where the engines differ
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, benchKeys-1)
+			keys := make([]string, 1<<16)
+			for i := range keys {
+				keys[i] = names[zipf.Uint64()]
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Intn(len(keys))
+				for pb.Next() {
+					c.Get(keys[i&(len(keys)-1)])
+					i++
+				}
+			})
+		})
+	}
+}
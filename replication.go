@@ -0,0 +1,968 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replication
+//
+// A replica follows a primary: REPLICAOF host port makes it connect to the RESP port of
+// the primary like any client and, after a handshake (PING, REPLCONF listening-port,
+// PSYNC), the connection carries the stream of write commands of the primary (see
+// propagate.go). Every byte of the stream has an offset, counted from the start of the
+// history the replication ID names. The primary keeps the last repl-backlog-size bytes of
+// its stream in a ring buffer, the backlog.
+//
+// PSYNC replid offset asks for the stream from offset on. When the backlog still holds it
+// (the replica was disconnected for a short while) the primary replies +CONTINUE and sends
+// what the replica missed, a partial resync. Otherwise it replies +FULLRESYNC replid offset
+// followed by a snapshot of its data at that offset, and streams from there. The snapshot is
+// encoded one shard at a time while writes go on, the writes to the shards already encoded
+// follow it as a second bulk string, together they are the data at the offset (see capture
+// in propagate.go).
+//
+// A replica feeds what it receives into its own backlog and append only file as it is, so
+// its offsets are the ones of its primary and it can have replicas of its own. REPLICAOF NO
+// ONE promotes it: it starts a new history under a new ID but remembers the old one, the
+// other replicas of the old primary (and the old primary, once it follows the new one) get
+// a partial resync as long as they aren't ahead of the point of the promotion.
+//
+// The primary sends a PING down the stream every second and replicas acknowledge the offset
+// they reached every second with REPLCONF ACK, which is where the lag in ROLE and INFO
+// replication comes from. A link silent for replTimeout is dropped, the replica reconnects.
+// Replicas refuse writes from clients unless replica-read-only is off, and the writes they
+// take then are not propagated to anyone. Keys the primary evicts or expires reach the
+// replicas as a DEL (see propagate.go), replicas don't evict or expire keys on their own:
+// a key past its TTL looks missing to their clients but stays until the DEL comes in
+const (
+	defaultBacklogSize = 1 << 20
+	replPingPeriod     = time.Second
+	replTimeout        = 10 * time.Second
+	replRetryDelay     = time.Second
+	replChunk          = 16 << 10 // bytes of the stream sent to a replica at once
+)
+
+var (
+	errReadOnlyReplica = errors.New("READONLY You can't write against a read only replica.")
+	errNoPrimaryLink   = errors.New("NOMASTERLINK Can't SYNC while not connected with my master")
+	errLinkStopped     = errors.New("replication stopped")
+)
+
+// replica-read-only can be changed any time, repl-backlog-size is read at startup only
+var (
+	replicaReadOnly = newSetting(yesNoFromEnv("replica-read-only", "yes"))
+	replBacklogSize = backlogSizeFromEnv()
+)
+
+// yesNoFromEnv returns the yes/no setting found in the environment, or def
+func yesNoFromEnv(param, def string) string {
+	value := strings.ToLower(envOr(param, def))
+	if value != "yes" && value != "no" {
+		fmt.Printf("Ignoring %s: %q is neither yes nor no\n", envName(param), value)
+		return def
+	}
+	return value
+}
+
+// backlogSizeFromEnv returns the backlog size found in the environment, or 1mb
+func backlogSizeFromEnv() int64 {
+	value := os.Getenv(envName("repl-backlog-size"))
+	if value == "" {
+		return defaultBacklogSize
+	}
+	n, err := parseMemory(value)
+	if err != nil || n <= 0 {
+		fmt.Printf("Ignoring %s: invalid size %q\n", envName("repl-backlog-size"), value)
+		return defaultBacklogSize
+	}
+	return n
+}
+
+// replicationState is the role of the node and the bookkeeping of both sides of the links
+type replicationState struct {
+	mutex        sync.Mutex
+	replID       string // the history our stream belongs to
+	replID2      string // the history we followed before our last promotion, "" for none
+	secondOffset int64  // the offset up to which replID2 is valid, -1 for none
+	backlog      *replBacklog
+	replicas     map[*replicaLink]bool // the replicas streaming from us
+
+	// while we follow a primary
+	primary   string        // its host:port, "" when we are a primary
+	stop      chan struct{} // closed when we stop following it
+	linkState string        // connect, connecting, sync or connected, like ROLE says it
+	downSince time.Time     // when the link went down, zero while it is up
+	lastIO    atomic.Int64  // unix time in milliseconds of the last data the primary sent
+}
+
+func (r *replicationState) init() {
+	r.replID = newReplID()
+	r.secondOffset = -1
+	r.backlog = newBacklog(replBacklogSize)
+	r.replicas = make(map[*replicaLink]bool)
+}
+
+// newReplID returns a random replication ID, 40 hex characters like the redis ones
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// readOnly reports whether client writes are refused, see the top of the file
+func (c *LRUCache) readOnly() bool {
+	return c.propagation.replicated.Load() && *replicaReadOnly.Load() == "yes"
+}
+
+// replBacklog is the tail of the replication stream, a ring buffer that streaming
+// replicas read from and wait on
+type replBacklog struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	end     int64 // offset right after the last byte of the stream
+	histlen int64 // how many bytes before end the buffer holds
+}
+
+func newBacklog(size int64) *replBacklog {
+	b := &replBacklog{buf: make([]byte, size)}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// write appends p to the stream, callers hold the propagator mutex so writes keep their order
+func (b *replBacklog) write(p []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	size := int64(len(b.buf))
+	if int64(len(p)) > size {
+		// only the tail fits, the rest is gone before anyone could read it
+		b.end += int64(len(p)) - size
+		p = p[int64(len(p))-size:]
+	}
+	b.histlen = min(b.histlen+int64(len(p)), size)
+	for len(p) > 0 {
+		n := copy(b.buf[b.end%size:], p)
+		p = p[n:]
+		b.end += int64(n)
+	}
+	b.cond.Broadcast()
+}
+
+// start returns the offset of the first byte held, callers hold b.mutex
+func (b *replBacklog) start() int64 {
+	return b.end - b.histlen
+}
+
+// offset returns the offset right after the last byte of the stream
+func (b *replBacklog) offset() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.end
+}
+
+// holds reports whether the stream can be resumed from offset
+func (b *replBacklog) holds(offset int64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return offset >= b.start() && offset <= b.end
+}
+
+// info returns the offset of the first byte held and how many are held
+func (b *replBacklog) info() (int64, int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.start(), b.histlen
+}
+
+// reset empties the backlog, the stream goes on from offset
+func (b *replBacklog) reset(offset int64) {
+	b.mutex.Lock()
+	b.end, b.histlen = offset, 0
+	b.mutex.Unlock()
+}
+
+// wake gets the readers waiting for the stream to check whether their link was closed
+func (b *replBacklog) wake() {
+	b.mutex.Lock()
+	b.cond.Broadcast()
+	b.mutex.Unlock()
+}
+
+// readAt copies the stream from pos on into p, waiting for it to get there. It fails
+// when the link is closed, or when pos already left the backlog and the replica can't
+// keep up
+func (b *replBacklog) readAt(p []byte, pos int64, closed *atomic.Bool) (int, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for pos >= b.end && !closed.Load() {
+		b.cond.Wait()
+	}
+	if closed.Load() || pos < b.start() || pos > b.end {
+		return 0, false
+	}
+	size := int64(len(b.buf))
+	from := pos % size
+	n := min(b.end-pos, int64(len(p)), size-from)
+	return copy(p, b.buf[from:from+n]), true
+}
+
+// replicaLink is a replica streaming from us
+type replicaLink struct {
+	conn      net.Conn
+	addr      string       // the address the replica listens on
+	ackOffset atomic.Int64 // the last offset the replica acknowledged
+	ackTime   atomic.Int64 // unix time in milliseconds of its last acknowledgement
+	closed    atomic.Bool
+}
+
+// close drops the link, its streaming goroutine notices on the next wake up
+func (l *replicaLink) close(b *replBacklog) {
+	if l.closed.CompareAndSwap(false, true) {
+		l.conn.Close()
+		b.wake()
+	}
+}
+
+// closeReplicasLocked drops every replica link, they have to sync again with the history
+// we start now. Callers hold r.mutex
+func (r *replicationState) closeReplicasLocked() {
+	for link := range r.replicas {
+		link.close(r.backlog)
+	}
+}
+
+// isReplicaCommand reports whether a command is part of the replication handshake
+func isReplicaCommand(value Value) bool {
+	if len(value.array) == 0 {
+		return false
+	}
+	switch strings.ToUpper(argString(value.array[0])) {
+	case "REPLCONF", "PSYNC", "SYNC":
+		return true
+	}
+	return false
+}
+
+// processReplicaCommand handles the handshake commands a replica sends us. PSYNC and
+// SYNC turn the connection into a replication link until the replica goes away, done is
+// true then and the connection must not be used anymore
+func processReplicaCommand(cl *client, value Value) (response Value, done bool) {
+	args := value.array[1:]
+	switch cmd := strings.ToUpper(argString(value.array[0])); cmd {
+	case "REPLCONF":
+		if len(args)%2 != 0 {
+			return Value{typ: "error", str: errSyntax.Error()}, false
+		}
+		for i := 0; i < len(args); i += 2 {
+			if strings.EqualFold(argString(args[i]), "listening-port") {
+				port, err := strconv.Atoi(argString(args[i+1]))
+				if err != nil || port <= 0 || port > 65535 {
+					return Value{typ: "error", str: "ERR invalid listening port"}, false
+				}
+				cl.listeningPort = port
+			}
+			// capabilities and the rest are accepted and ignored
+		}
+		return Value{typ: "string", str: "OK"}, false
+
+	default:
+		// SYNC is the old full sync only handshake, a PSYNC nobody can continue
+		id, offset := "?", int64(-1)
+		if cmd == "PSYNC" {
+			if len(args) != 2 {
+				return Value{typ: "error", str: "ERR wrong number of arguments for 'PSYNC' command"}, false
+			}
+			n, err := strconv.ParseInt(argString(args[1]), 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: errInvalidInteger.Error()}, false
+			}
+			id, offset = argString(args[0]), n
+		}
+		if err := cl.writer.Flush(); err != nil {
+			return Value{}, true
+		}
+		if err := cache.serveReplica(cl, id, offset); err != nil {
+			return Value{typ: "error", str: err.Error()}, false
+		}
+		return Value{}, true
+	}
+}
+
+// canContinue reports whether a replica at offset in the history id can get a partial
+// resync, callers hold r.mutex
+func (r *replicationState) canContinue(id string, offset int64) bool {
+	known := id == r.replID || (r.replID2 != "" && id == r.replID2 && offset <= r.secondOffset)
+	return known && r.backlog.holds(offset)
+}
+
+// serveReplica answers a PSYNC and streams to the replica until the link drops. It only
+// returns an error when it refused the PSYNC, the connection is still usable then
+func (c *LRUCache) serveReplica(cl *client, id string, offset int64) error {
+	r := &c.replication
+	link := &replicaLink{conn: cl.conn, addr: replicaAddr(cl)}
+	link.ackTime.Store(nowMillis())
+
+	var header string
+	var snapshot, tail []byte
+	r.mutex.Lock()
+	if r.primary != "" && r.linkState != "connected" {
+		r.mutex.Unlock()
+		return errNoPrimaryLink
+	}
+	if r.canContinue(id, offset) {
+		header = "+CONTINUE " + r.replID + "\r\n"
+		link.ackOffset.Store(offset)
+		r.replicas[link] = true
+	}
+	r.mutex.Unlock()
+
+	if header == "" {
+		c.propagation.capture(func(shard *cacheShard) []byte { return shard.appendEntries(nil) }, func(shards, t []byte) {
+			snapshot, tail = shards, t
+			r.mutex.Lock()
+			offset = r.backlog.offset()
+			header = fmt.Sprintf("+FULLRESYNC %s %d\r\n", r.replID, offset)
+			link.ackOffset.Store(offset)
+			r.replicas[link] = true
+			r.mutex.Unlock()
+		})
+		snapshot = snapshotBytes(snapshot)
+		header += fmt.Sprintf("$%d\r\n", len(snapshot))
+	}
+
+	defer func() {
+		r.mutex.Lock()
+		delete(r.replicas, link)
+		r.mutex.Unlock()
+		link.close(r.backlog)
+	}()
+
+	fmt.Printf("Replica %s syncing from offset %d (%s)\n", link.addr, offset, strings.Fields(header)[0][1:])
+	cl.conn.SetWriteDeadline(time.Now().Add(replTimeout))
+	if _, err := io.WriteString(cl.conn, header); err != nil {
+		return nil
+	}
+	if snapshot != nil {
+		// no CRLF after the snapshot, like redis. The writes that went on while it was
+		// encoded follow as a second bulk string, see capture
+		tail = append(fmt.Appendf(nil, "$%d\r\n", len(tail)), tail...)
+		if _, err := writeWithDeadline(cl.conn, append(snapshot, tail...)); err != nil {
+			return nil
+		}
+	}
+
+	go link.readAcks(cl, r.backlog)
+	link.stream(r.backlog, offset)
+	fmt.Printf("Replica %s disconnected\n", link.addr)
+	return nil
+}
+
+// replicaAddr returns the address a replica listens on, its IP and the port it told us
+func replicaAddr(cl *client) string {
+	host, _, err := net.SplitHostPort(cl.conn.RemoteAddr().String())
+	if err != nil {
+		host = cl.conn.RemoteAddr().String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(cl.listeningPort))
+}
+
+// writeWithDeadline writes p in chunks, giving each chunk replTimeout to go through
+func writeWithDeadline(conn net.Conn, p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		n, err := conn.Write(p[written:min(written+replChunk, len(p))])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// stream sends the stream from pos on to the replica until the link drops
+func (l *replicaLink) stream(b *replBacklog, pos int64) {
+	buf := make([]byte, replChunk)
+	for {
+		n, ok := b.readAt(buf, pos, &l.closed)
+		if !ok {
+			return
+		}
+		if _, err := writeWithDeadline(l.conn, buf[:n]); err != nil {
+			return
+		}
+		pos += int64(n)
+	}
+}
+
+// readAcks reads the REPLCONF ACKs of the replica, the link is dropped when they stop
+func (l *replicaLink) readAcks(cl *client, b *replBacklog) {
+	defer l.close(b)
+	for {
+		cl.conn.SetReadDeadline(time.Now().Add(replTimeout))
+		value, err := cl.resp.Read()
+		if err != nil {
+			return
+		}
+		args := arrayStrings(value)
+		if len(args) == 3 && strings.EqualFold(args[0], "REPLCONF") && strings.EqualFold(args[1], "ACK") {
+			if offset, err := strconv.ParseInt(args[2], 10, 64); err == nil {
+				l.ackOffset.Store(offset)
+				l.ackTime.Store(nowMillis())
+			}
+		}
+	}
+}
+
+// snapshotBytes turns the encoded entries of every shard into a snapshot file
+func snapshotBytes(entries []byte) []byte {
+	buf := append([]byte(snapshotMagic), snapshotVersion)
+	buf = append(append(buf, entries...), snapshotEOF)
+	return binary.LittleEndian.AppendUint64(buf, crc64.Checksum(buf, crcTable))
+}
+
+// runReplicationPing sends a PING down the stream every second while replicas follow
+// us, so they can tell a quiet primary from a dead one
+func runReplicationPing() {
+	ping := command("PING").Marshal()
+	ticker := time.NewTicker(replPingPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r := &cache.replication
+		r.mutex.Lock()
+		idle := len(r.replicas) == 0
+		r.mutex.Unlock()
+		if idle || cache.propagation.replicated.Load() {
+			// a replica passes on the PINGs of its primary
+			continue
+		}
+		cache.propagation.heartbeat(ping)
+	}
+}
+
+// heartbeat writes buf to the replication stream only, the append only file has no use for it
+func (p *propagator) heartbeat(buf []byte) {
+	p.mutex.Lock()
+	p.cache.replication.backlog.write(buf)
+	p.mutex.Unlock()
+}
+
+// ReplicaOf makes us follow the primary at addr, or become a primary when addr is empty
+func (c *LRUCache) ReplicaOf(addr string) {
+	// no command of the old primary is applied past this point, see applyReplicated
+	p := c.propagation
+	p.apply.Lock()
+	defer p.apply.Unlock()
+	r := &c.replication
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if addr == r.primary {
+		return
+	}
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+
+	if addr == "" {
+		// the stream we got so far stays valid under the old ID
+		p.replicated.Store(false)
+		r.replID2, r.secondOffset = r.replID, r.backlog.offset()
+		r.replID = newReplID()
+		r.primary, r.linkState = "", ""
+		r.closeReplicasLocked()
+		fmt.Println("Promoted to primary, new replication ID", r.replID)
+		return
+	}
+
+	p.replicated.Store(true)
+	r.closeReplicasLocked()
+	r.primary, r.linkState, r.downSince = addr, "connect", time.Now()
+	r.stop = make(chan struct{})
+	go c.follow(addr, r.stop)
+	fmt.Println("Following primary", addr)
+}
+
+// setLinkState records how far the link with the primary got
+func (r *replicationState) setLinkState(state string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.linkState = state
+	if state == "connected" {
+		r.downSince = time.Time{}
+	} else if r.downSince.IsZero() {
+		r.downSince = time.Now()
+	}
+}
+
+// follow keeps a link with the primary at addr until stop is closed
+func (c *LRUCache) follow(addr string, stop chan struct{}) {
+	for {
+		err := c.syncWithPrimary(addr, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		fmt.Printf("Replication link with %s down: %v\n", addr, err)
+		c.replication.setLinkState("connect")
+		select {
+		case <-stop:
+			return
+		case <-time.After(replRetryDelay):
+		}
+	}
+}
+
+// syncWithPrimary connects to the primary, syncs and applies its stream until the link drops
+func (c *LRUCache) syncWithPrimary(addr string, stop chan struct{}) error {
+	r := &c.replication
+	conn, err := net.DialTimeout("tcp", addr, replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	r.setLinkState("connecting")
+	resp := NewResp(conn)
+	send := func(args ...string) (string, error) {
+		conn.SetDeadline(time.Now().Add(replTimeout))
+		if _, err := conn.Write(command(args...).Marshal()); err != nil {
+			return "", err
+		}
+		reply, err := resp.Read()
+		if err == nil && reply.typ == "error" {
+			err = errors.New(reply.str)
+		}
+		return reply.str, err
+	}
+	if _, err := send("PING"); err != nil {
+		return err
+	}
+	if _, err := send("REPLCONF", "listening-port", serverPort()); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	id, offset := r.replID, r.backlog.offset()
+	r.mutex.Unlock()
+	reply, err := send("PSYNC", id, strconv.FormatInt(offset, 10))
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad FULLRESYNC offset %q", fields[2])
+		}
+		r.setLinkState("sync")
+		if err := c.fullSync(conn, resp, fields[1], offset, stop); err != nil {
+			return err
+		}
+	case len(fields) == 2 && fields[0] == "CONTINUE":
+		r.continueWith(fields[1])
+		fmt.Printf("Partial resync with %s from offset %d\n", addr, offset)
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC: %q", reply)
+	}
+	r.setLinkState("connected")
+	r.lastIO.Store(nowMillis())
+
+	go sendAcks(conn, r.backlog, done)
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		value, err := resp.Read()
+		if err != nil {
+			return err
+		}
+		r.lastIO.Store(nowMillis())
+		if err := c.applyReplicated(value, stop); err != nil {
+			return err
+		}
+	}
+}
+
+// continueWith switches to the history of the primary after a partial resync. A primary
+// promoted since we last followed it continues our stream under its new ID
+func (r *replicationState) continueWith(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if id != r.replID {
+		r.replID2, r.secondOffset = r.replID, r.backlog.offset()
+		r.replID = id
+		r.closeReplicasLocked()
+	}
+}
+
+// fullSync replaces the content of the cache with the snapshot the primary sends
+func (c *LRUCache) fullSync(conn net.Conn, resp *Resp, id string, offset int64, stop chan struct{}) error {
+	// the snapshot is a bulk string without the CRLF, bigger than any we'd take from a client
+	size, err := readBulkHeader(conn, resp)
+	if err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.sync-%d", *dbFilename.Load(), os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = io.CopyN(f, deadlineReader{conn: conn, r: resp.reader}, size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// followed by the writes that went on while the primary encoded it
+	if size, err = readBulkHeader(conn, resp); err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(deadlineReader{conn: conn, r: resp.reader}, buf); err != nil {
+		return err
+	}
+	tail, err := parseTail(buf)
+	if err != nil {
+		return err
+	}
+
+	// loaded on the side, a snapshot that turns out broken leaves our data alone
+	scratch := NewLRUCache(0, c.shardCount, c.shardHash)
+	scratch.hash = c.hash
+	scratch.propagation.replicated.Store(true)
+	defer scratch.Close()
+	n, err := scratch.Load(tmp)
+	if err != nil {
+		return err
+	}
+
+	p := c.propagation
+	p.apply.Lock()
+	select {
+	case <-stop:
+		p.apply.Unlock()
+		return errLinkStopped
+	default:
+	}
+	c.swapIn(scratch)
+	for _, value := range tail {
+		c.applyTail(value)
+	}
+	r := &c.replication
+	r.mutex.Lock()
+	r.replID, r.replID2, r.secondOffset = id, "", -1
+	r.backlog.reset(offset)
+	r.closeReplicasLocked()
+	r.mutex.Unlock()
+	p.apply.Unlock()
+	fmt.Printf("Full resync: loaded %d keys, replication ID %s offset %d\n", n, id, offset)
+
+	// the log has to start over from the data we just loaded
+	if c.aof != nil {
+		for c.aof.Rewrite() == errRewriteInProgress {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// readBulkHeader reads the $size line of a bulk string of the primary
+func readBulkHeader(conn net.Conn, resp *Resp) (int64, error) {
+	conn.SetReadDeadline(time.Now().Add(replTimeout))
+	line, err := resp.reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(line, "$"), "\r\n"), 10, 64)
+	if err != nil || !strings.HasPrefix(line, "$") || size < 0 {
+		return 0, fmt.Errorf("bad bulk header %q", line)
+	}
+	return size, nil
+}
+
+// parseTail parses the commands the primary sent after a snapshot
+func parseTail(buf []byte) ([]Value, error) {
+	var tail []Value
+	resp := NewResp(bytes.NewReader(buf))
+	for {
+		value, err := resp.Read()
+		if err == io.EOF {
+			return tail, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad command after the snapshot: %w", err)
+		}
+		if value.typ != "array" || len(value.array) == 0 {
+			return nil, errors.New("bad command after the snapshot")
+		}
+		tail = append(tail, value)
+	}
+}
+
+// applyTail runs a command the primary sent after a snapshot. They come before the offset
+// of the FULLRESYNC and are not part of our stream
+func (c *LRUCache) applyTail(value Value) {
+	cmd := strings.ToUpper(argString(value.array[0]))
+	unlock := c.propagation.lockForPrimary(commandKeys(cmd, value.array[1:]))
+	defer unlock()
+	if response := runCommand(cmd, value); response.typ == "error" {
+		fmt.Printf("Applying %s from the primary: %s\n", cmd, response.str)
+	}
+}
+
+// deadlineReader gives every read from a connection replTimeout to return
+type deadlineReader struct {
+	conn net.Conn
+	r    io.Reader
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(replTimeout))
+	return d.r.Read(p)
+}
+
+// sendAcks tells the primary the offset we reached once a second until done is closed
+func sendAcks(conn net.Conn, b *replBacklog, done chan struct{}) {
+	ticker := time.NewTicker(replPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		ack := command("REPLCONF", "ACK", strconv.FormatInt(b.offset(), 10)).Marshal()
+		conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		if _, err := conn.Write(ack); err != nil {
+			return
+		}
+	}
+}
+
+// applyReplicated runs a command of the stream of the primary and passes it on as it came
+func (c *LRUCache) applyReplicated(value Value, stop chan struct{}) error {
+	if value.typ != "array" || len(value.array) == 0 {
+		return errors.New("bad command in the replication stream")
+	}
+	cmd := strings.ToUpper(argString(value.array[0]))
+	raw := value.Marshal()
+
+	p := c.propagation
+	p.apply.Lock()
+	defer p.apply.Unlock()
+	select {
+	case <-stop:
+		return errLinkStopped
+	default:
+	}
+
+	if cmd == "PING" {
+		p.heartbeat(raw)
+		return nil
+	}
+
+	// the stripes order the command with the captures of our own replicas, see capture
+	keys := commandKeys(cmd, value.array[1:])
+	unlock := p.lockForPrimary(keys)
+	defer unlock()
+	if response := runCommand(cmd, value); response.typ == "error" {
+		fmt.Printf("Applying %s from the primary: %s\n", cmd, response.str)
+	}
+
+	p.mutex.Lock()
+	p.write(p.shardIndexes(keys), raw, true)
+	p.mutex.Unlock()
+	return nil
+}
+
+// swapIn replaces the content of every shard with the one of the same shard of scratch,
+// a cache with the same shard count and hash that nobody else uses. Writes wait for the
+// swap, the captures under way start over
+func (c *LRUCache) swapIn(scratch *LRUCache) {
+	p := c.propagation
+	for i := range p.stripes {
+		p.stripes[i].Lock()
+	}
+	defer func() {
+		for i := len(p.stripes) - 1; i >= 0; i-- {
+			p.stripes[i].Unlock()
+		}
+	}()
+
+	for i, shard := range c.shards {
+		from := scratch.shards[i]
+		shard.mutex.Lock()
+		shard.drainReads(nil)
+		for elem := shard.window.Front(); elem != nil; elem = elem.Next() {
+			c.windowMemory.Add(-elem.Value.(*list.Element).Value.(*cacheEntry).size)
+		}
+		c.usedMemory.Add(from.used - shard.used)
+		shard.items, shard.expires, shard.evictionQ, shard.window = from.items, from.expires, from.evictionQ, from.window
+		shard.used, shard.scan = from.used, from.scan
+		shard.stats.changes.Add(1)
+		shard.mutex.Unlock()
+	}
+	p.restartCaptures()
+}
+
+// replicaofCommand handles REPLICAOF host port and REPLICAOF NO ONE, and SLAVEOF the same
+func replicaofCommand(cmd string, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+	host, port := argString(args[0]), argString(args[1])
+	if strings.EqualFold(host, "NO") && strings.EqualFold(port, "ONE") {
+		cache.ReplicaOf("")
+		return Value{typ: "string", str: "OK"}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return Value{typ: "error", str: "ERR Invalid master port"}
+	}
+	cache.ReplicaOf(net.JoinHostPort(host, port))
+	return Value{typ: "string", str: "OK"}
+}
+
+// roleCommand handles ROLE: the offset and the replicas of a primary, or the primary of a
+// replica and how far it got
+func roleCommand(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ROLE' command"}
+	}
+	r := &cache.replication
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	offset := Value{typ: "integer", num: int(r.backlog.offset())}
+	if r.primary == "" {
+		replicas := Value{typ: "array", array: []Value{}}
+		for link := range r.replicas {
+			host, port, _ := net.SplitHostPort(link.addr)
+			replicas.array = append(replicas.array,
+				bulkArray([]string{host, port, strconv.FormatInt(link.ackOffset.Load(), 10)}))
+		}
+		return Value{typ: "array", array: []Value{{typ: "bulk", bulk: "master"}, offset, replicas}}
+	}
+
+	host, port, _ := net.SplitHostPort(r.primary)
+	portNum, _ := strconv.Atoi(port)
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "slave"},
+		{typ: "bulk", bulk: host},
+		{typ: "integer", num: portNum},
+		{typ: "bulk", bulk: r.linkState},
+		offset,
+	}}
+}
+
+// infoCommand handles INFO [section]. Replication is the only section we have
+func infoCommand(args []Value) Value {
+	if len(args) > 1 {
+		return Value{typ: "error", str: errSyntax.Error()}
+	}
+	if len(args) == 1 {
+		switch strings.ToLower(argString(args[0])) {
+		case "replication", "default", "all", "everything":
+		default:
+			return Value{typ: "bulk", bulk: ""}
+		}
+	}
+	return Value{typ: "bulk", bulk: cache.replicationInfo()}
+}
+
+// replicationInfo returns the replication section of INFO
+func (c *LRUCache) replicationInfo() string {
+	r := &c.replication
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var b strings.Builder
+	line := func(name string, value any) { fmt.Fprintf(&b, "%s:%v\r\n", name, value) }
+	offset := r.backlog.offset()
+	now := nowMillis()
+
+	b.WriteString("# Replication\r\n")
+	if r.primary == "" {
+		line("role", "master")
+	} else {
+		host, port, _ := net.SplitHostPort(r.primary)
+		line("role", "slave")
+		line("master_host", host)
+		line("master_port", port)
+		if r.linkState == "connected" {
+			line("master_link_status", "up")
+			line("master_last_io_seconds_ago", (now-r.lastIO.Load())/1000)
+		} else {
+			line("master_link_status", "down")
+			line("master_last_io_seconds_ago", -1)
+			line("master_link_down_since_seconds", int64(time.Since(r.downSince).Seconds()))
+		}
+		line("master_sync_in_progress", boolInt(r.linkState == "sync"))
+		line("slave_repl_offset", offset)
+		line("slave_read_only", boolInt(*replicaReadOnly.Load() == "yes"))
+	}
+
+	line("connected_slaves", len(r.replicas))
+	i := 0
+	for link := range r.replicas {
+		host, port, _ := net.SplitHostPort(link.addr)
+		fmt.Fprintf(&b, "slave%d:ip=%s,port=%s,state=online,offset=%d,lag=%d\r\n",
+			i, host, port, link.ackOffset.Load(), (now-link.ackTime.Load())/1000)
+		i++
+	}
+
+	replID2, secondOffset := r.replID2, r.secondOffset
+	if replID2 == "" {
+		replID2 = strings.Repeat("0", 40)
+	}
+	first, histlen := r.backlog.info()
+	line("master_replid", r.replID)
+	line("master_replid2", replID2)
+	line("master_repl_offset", offset)
+	line("second_repl_offset", secondOffset)
+	line("repl_backlog_active", 1)
+	line("repl_backlog_size", len(r.backlog.buf))
+	line("repl_backlog_first_byte_offset", first)
+	line("repl_backlog_histlen", histlen)
+	return b.String()
+}
+
+// boolInt returns 1 for true and 0 for false, the way INFO shows flags
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
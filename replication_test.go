@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The replication tests run the server binary as separate processes on localhost
+
+var (
+	buildOnce sync.Once
+	binDir    string
+	buildErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if binDir != "" {
+		os.RemoveAll(binDir)
+	}
+	os.Exit(code)
+}
+
+// serverBinary builds the server once and returns the path of the binary
+func serverBinary(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("starts server processes")
+	}
+	buildOnce.Do(func() {
+		if binDir, buildErr = os.MkdirTemp("", "gored-test"); buildErr != nil {
+			return
+		}
+		out, err := exec.Command("go", "build", "-o", filepath.Join(binDir, "gored"), ".").CombinedOutput()
+		if err != nil {
+			buildErr = fmt.Errorf("%v: %s", err, out)
+		}
+	})
+	if buildErr != nil {
+		t.Fatal(buildErr)
+	}
+	return filepath.Join(binDir, "gored")
+}
+
+// syncBuffer collects the output of a server process
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// serverProcess is a server running as a separate process
+type serverProcess struct {
+	cmd  *exec.Cmd
+	addr string
+	out  *syncBuffer
+}
+
+// freePort returns a localhost port nobody listens on
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// startServer starts a server in a temporary directory with env on top of ours and waits
+// until it takes connections
+func startServer(t *testing.T, env ...string) *serverProcess {
+	t.Helper()
+	port := freePort(t)
+	s := &serverProcess{addr: net.JoinHostPort("127.0.0.1", port), out: &syncBuffer{}}
+	s.cmd = exec.Command(serverBinary(t))
+	s.cmd.Dir = t.TempDir()
+	s.cmd.Env = append(append(os.Environ(), "PORT="+port), env...)
+	s.cmd.Stdout, s.cmd.Stderr = s.out, s.out
+	if err := s.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.kill)
+
+	waitFor(t, "the server on "+s.addr+" to start", func() bool {
+		_, err := query(s.addr, "PING")
+		return err == nil
+	})
+	return s
+}
+
+// kill stops the server right away, like a crash would
+func (s *serverProcess) kill() {
+	if s.cmd.ProcessState == nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+}
+
+// query sends one command to the server at addr on a connection of its own
+func query(addr string, args ...string) (Value, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return Value{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(command(args...).Marshal()); err != nil {
+		return Value{}, err
+	}
+	return NewResp(conn).Read()
+}
+
+// mustQuery is query for commands that have to go through
+func mustQuery(t *testing.T, addr string, args ...string) Value {
+	t.Helper()
+	v, err := query(addr, args...)
+	if err != nil {
+		t.Fatalf("%s on %s: %v", strings.Join(args, " "), addr, err)
+	}
+	return v
+}
+
+// waitFor polls cond until it holds, failing the test after a while
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waitConverged waits until the replica holds the same keys as the primary, comparing the
+// key count and the values of keys
+func waitConverged(t *testing.T, primary, replica string, keys []string) {
+	t.Helper()
+	waitFor(t, replica+" to catch up with "+primary, func() bool {
+		var values [2]string
+		for i, addr := range []string{primary, replica} {
+			size, err1 := query(addr, "DBSIZE")
+			mget, err2 := query(addr, append([]string{"MGET"}, keys...)...)
+			if err1 != nil || err2 != nil {
+				return false
+			}
+			values[i] = fmt.Sprint(size.num, arrayStrings(mget))
+		}
+		return values[0] == values[1]
+	})
+}
+
+// setKeys writes n keys named prefix:i with values of size bytes and returns their names
+func setKeys(t *testing.T, addr, prefix string, n, size int) []string {
+	t.Helper()
+	c := dialTest(t, addr)
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = prefix + ":" + strconv.Itoa(i)
+		c.send("SET", keys[i], strings.Repeat(strconv.Itoa(i%10), size))
+	}
+	for range keys {
+		if v := c.read(); v.typ == "error" {
+			t.Fatalf("SET on %s: %s", addr, v.str)
+		}
+	}
+	return keys
+}
+
+// linkProxy forwards connections to a server, so a test can cut the replication link
+// without killing either side
+type linkProxy struct {
+	listener net.Listener
+	target   string
+
+	mutex sync.Mutex
+	down  bool
+	conns []net.Conn
+}
+
+func startProxy(t *testing.T, target string) *linkProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &linkProxy{listener: l, target: target}
+	t.Cleanup(func() {
+		l.Close()
+		p.cut()
+	})
+	go p.serve()
+	return p
+}
+
+// port returns the port replicas should follow
+func (p *linkProxy) port() string {
+	_, port, _ := net.SplitHostPort(p.listener.Addr().String())
+	return port
+}
+
+func (p *linkProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mutex.Lock()
+		if p.down {
+			p.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			p.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		p.conns = append(p.conns, conn, upstream)
+		p.mutex.Unlock()
+
+		go func() {
+			defer upstream.Close()
+			buf := make([]byte, 32<<10)
+			for {
+				n, err := conn.Read(buf)
+				if n > 0 {
+					upstream.Write(buf[:n])
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 32<<10)
+			for {
+				n, err := upstream.Read(buf)
+				if n > 0 {
+					conn.Write(buf[:n])
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// cut drops the connections going through and refuses new ones until restore
+func (p *linkProxy) cut() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.down = true
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *linkProxy) restore() {
+	p.mutex.Lock()
+	p.down = false
+	p.mutex.Unlock()
+}
+
+// waitLinkDown waits until the replica at addr noticed it lost its primary
+func waitLinkDown(t *testing.T, addr string) {
+	t.Helper()
+	waitFor(t, addr+" to lose its primary", func() bool {
+		v, err := query(addr, "INFO", "replication")
+		return err == nil && strings.Contains(v.bulk, "master_link_status:down")
+	})
+}
+
+func TestReplicationResync(t *testing.T) {
+	// the values written to overrun the backlog are over the default max-value-size
+	primary := startServer(t, "REPL_BACKLOG_SIZE=64kb", "MAX_VALUE_SIZE=1kb")
+	keys := setKeys(t, primary.addr, "key", 500, 10)
+
+	proxy := startProxy(t, primary.addr)
+	replica := startServer(t, "REPLICAOF=127.0.0.1 "+proxy.port(), "MAX_VALUE_SIZE=1kb")
+	waitConverged(t, primary.addr, replica.addr, keys)
+	if n := strings.Count(replica.out.String(), "Full resync"); n != 1 {
+		t.Fatalf("%d full resyncs for the first sync, want 1", n)
+	}
+	if v := mustQuery(t, replica.addr, "SET", "key:0", "x"); !strings.HasPrefix(v.str, "READONLY") {
+		t.Fatalf("SET on the replica = %+v, want a READONLY error", v)
+	}
+
+	// a short break: what the replica missed is still in the backlog
+	proxy.cut()
+	waitLinkDown(t, replica.addr)
+	keys = append(keys, setKeys(t, primary.addr, "short", 100, 10)...)
+	mustQuery(t, primary.addr, "DEL", "key:1", "key:2")
+	mustQuery(t, primary.addr, "RPUSH", "list", "a", "b", "c")
+	proxy.restore()
+	waitConverged(t, primary.addr, replica.addr, append(keys, "list"))
+	if !strings.Contains(replica.out.String(), "Partial resync") {
+		t.Fatalf("the replica did not resync partially:\n%s", replica.out)
+	}
+	if v := mustQuery(t, replica.addr, "LRANGE", "list", "0", "-1"); strings.Join(arrayStrings(v), "") != "abc" {
+		t.Fatalf("LRANGE on the replica = %v", arrayStrings(v))
+	}
+
+	// a long one: the backlog moved past the offset of the replica
+	proxy.cut()
+	waitLinkDown(t, replica.addr)
+	keys = append(keys, setKeys(t, primary.addr, "long", 200, 1000)...)
+	proxy.restore()
+	waitConverged(t, primary.addr, replica.addr, keys)
+	if n := strings.Count(replica.out.String(), "Full resync"); n != 2 {
+		t.Fatalf("%d full resyncs, want 2:\n%s", n, replica.out)
+	}
+}
+
+func TestReplicationExpiry(t *testing.T) {
+	primary := startServer(t)
+	replica := startServer(t, "REPLICAOF="+strings.Replace(primary.addr, ":", " ", 1))
+	mustQuery(t, primary.addr, "SET", "session", "token", "PX", "300")
+	mustQuery(t, primary.addr, "SET", "kept", "value")
+	waitConverged(t, primary.addr, replica.addr, []string{"session", "kept"})
+
+	// the primary sweeps the key and sends a DEL, the replica never drops it on its own
+	waitFor(t, "the key to expire on the replica", func() bool {
+		v, err := query(replica.addr, "GET", "session")
+		return err == nil && v.null
+	})
+	waitConverged(t, primary.addr, replica.addr, []string{"session", "kept"})
+	if v := mustQuery(t, replica.addr, "DBSIZE"); v.num != 1 {
+		t.Fatalf("DBSIZE on the replica = %d, want 1", v.num)
+	}
+}
+
+func TestReplicaFailover(t *testing.T) {
+	primary := startServer(t)
+	follow := "REPLICAOF=" + strings.Replace(primary.addr, ":", " ", 1)
+	first := startServer(t, follow)
+	second := startServer(t, follow)
+	keys := setKeys(t, primary.addr, "key", 300, 10)
+	waitConverged(t, primary.addr, first.addr, keys)
+	waitConverged(t, primary.addr, second.addr, keys)
+
+	// the primary dies, the first replica takes over and the second one follows it
+	primary.kill()
+	if v := mustQuery(t, first.addr, "REPLICAOF", "NO", "ONE"); v.str != "OK" {
+		t.Fatalf("REPLICAOF NO ONE = %+v", v)
+	}
+	host, port, _ := net.SplitHostPort(first.addr)
+	if v := mustQuery(t, second.addr, "REPLICAOF", host, port); v.str != "OK" {
+		t.Fatalf("REPLICAOF = %+v", v)
+	}
+	if v := mustQuery(t, first.addr, "ROLE"); v.array[0].bulk != "master" {
+		t.Fatalf("ROLE of the promoted replica = %+v", v)
+	}
+
+	keys = append(keys, setKeys(t, first.addr, "after", 100, 10)...)
+	waitConverged(t, first.addr, second.addr, keys)
+	if !strings.Contains(second.out.String(), "Partial resync with "+first.addr) {
+		t.Fatalf("the second replica did not resync partially with the new primary:\n%s", second.out)
+	}
+	if v := mustQuery(t, second.addr, "ROLE"); v.array[0].bulk != "slave" || v.array[3].bulk != "connected" {
+		t.Fatalf("ROLE of the second replica = %+v", v)
+	}
+}
+
+func TestReplicaKeepsExpiredKeys(t *testing.T) {
+	c := NewLRUCache(0, 16, "fnv")
+	defer c.Close()
+	c.propagation.replicated.Store(true)
+	c.Put("session", "token", putOptions{expireAt: nowMillis() + 1})
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok, _ := c.Get("session"); ok {
+		t.Fatal("GET on a replica returned an expired key")
+	}
+	idx := c.shardIndex("session")
+	if n := c.sweepShard(idx); n != 0 {
+		t.Fatalf("the sweeper removed %d keys on a replica", n)
+	}
+	c.maxMemory.Store(1)
+	if err := c.evictIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.shards[idx].items["session"]; !ok {
+		t.Fatal("the replica dropped the expired key on its own")
+	}
+
+	// the commands of the primary still see it, the primary hasn't expired it yet
+	unlock := c.propagation.lockForPrimary([]string{"session"})
+	value, ok, _ := c.GetDel("session")
+	unlock()
+	if !ok || value != "token" {
+		t.Fatalf("GETDEL from the primary = %q, %v", value, ok)
+	}
+}
+
+// servePipe writes payload to the end of a pipe the test keeps, and returns the other end
+func servePipe(t *testing.T, payload []byte) net.Conn {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close() })
+	go func() {
+		remote.Write(payload)
+		remote.Close()
+	}()
+	return local
+}
+
+func TestFullSyncLoadsOnTheSide(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.gored")
+	old := dbFilename.Load()
+	dbFilename.Store(&path)
+	defer dbFilename.Store(old)
+
+	cache = NewLRUCache(0, 16, "fnv")
+	defer cache.Close()
+	cache.Put("mine", "1", putOptions{})
+	stop := make(chan struct{})
+
+	// a snapshot with a bad checksum leaves the data alone
+	junk := []byte(snapshotMagic + "junk")
+	payload := append(fmt.Appendf(nil, "$%d\r\n", len(junk)), junk...)
+	payload = append(payload, "$0\r\n"...)
+	conn := servePipe(t, payload)
+	if err := cache.fullSync(conn, NewResp(conn), "abc", 100, stop); err == nil {
+		t.Fatal("a broken snapshot was loaded")
+	}
+	if v, ok, _ := cache.Get("mine"); !ok || v != "1" {
+		t.Fatalf("GET after a broken snapshot = %q, %v", v, ok)
+	}
+
+	primary := NewLRUCache(0, 16, "fnv")
+	defer primary.Close()
+	for i := 0; i < 100; i++ {
+		primary.Put("key:"+strconv.Itoa(i), strconv.Itoa(i), putOptions{})
+	}
+	var entries []byte
+	for _, shard := range primary.shards {
+		entries = shard.appendEntries(entries)
+	}
+	snapshot := snapshotBytes(entries)
+	tail := command("SET", "written", "meanwhile").Marshal()
+	payload = append(fmt.Appendf(nil, "$%d\r\n", len(snapshot)), snapshot...)
+	payload = append(fmt.Appendf(payload, "$%d\r\n", len(tail)), tail...)
+	conn = servePipe(t, payload)
+	if err := cache.fullSync(conn, NewResp(conn), "abc", 100, stop); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.Put("written", "meanwhile", putOptions{})
+	want, got := cacheContent(primary), cacheContent(cache)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("after the full sync the replica holds %v, want %v", got, want)
+	}
+	if offset := cache.replication.backlog.offset(); offset != 100 {
+		t.Fatalf("offset after the full sync = %d, want 100", offset)
+	}
+}
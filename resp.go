@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
@@ -23,6 +24,7 @@ type Value struct {
 	num   int     // holds the value of the integer received from integers
 	bulk  string  // holds the value of the bulk string received from bulk strings
 	array []Value // holds the value of the array received from arrays
+	null  bool    // a null bulk string or array ($-1 / *-1), as opposed to an empty one
 }
 
 type Resp struct {
@@ -33,6 +35,12 @@ func NewResp(rd io.Reader) *Resp {
 	return &Resp{reader: bufio.NewReader(rd)}
 }
 
+// Buffered returns the number of bytes already read from the connection but not parsed
+// yet. When it is 0 the client has no more pipelined commands waiting for us
+func (r *Resp) Buffered() int {
+	return r.reader.Buffered()
+}
+
 // Now we need two methods:
 // 1. to read the lines fro mthe buffer
 // 2. to read the integer from the buffer
@@ -44,6 +52,9 @@ func (r *Resp) readLine() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("protocol error: expected CRLF")
+	}
 	return line[:len(line)-2], nil
 }
 
@@ -122,10 +133,26 @@ func (r *Resp) readBulk() (Value, error) {
 	}
 
 	if length == -1 {
-		return Value{typ: "null"}, nil
+		return Value{typ: "bulk", null: true}, nil
+	}
+	if length < 0 {
+		return Value{}, fmt.Errorf("invalid bulk length: %d", length)
+	}
+	if int64(length) > maxBulkLen.Load() {
+		// we skip the content instead of reading it, so the client can't make us allocate
+		// whatever it likes and the stream stays in sync for the next command
+		if _, err := io.CopyN(io.Discard, r.reader, int64(length)); err != nil {
+			return Value{}, err
+		}
+		if _, err := r.readLine(); err != nil {
+			return Value{}, err
+		}
+		return Value{}, errBulkTooLong
 	}
 
-	bulk := make([]byte, length)
+	// the content is read by length, not by line, so it may hold any bytes at all
+	// (CRLF and NUL included) and comes out exactly as it was sent
+	bulk := make([]byte, length+2)
 	_, err = io.ReadFull(r.reader, bulk)
 	if err != nil {
 		return Value{}, err
@@ -134,7 +161,10 @@ func (r *Resp) readBulk() (Value, error) {
 	// We also need to read the CRLF character that follows each bulk string.
 	// If not done, the pointer will be left at \r and the Read method won't be able to
 	// read the next bulk string correctly
-	r.readLine()
+	if bulk[length] != '\r' || bulk[length+1] != '\n' {
+		return Value{}, errors.New("protocol error: expected CRLF after bulk string")
+	}
+	bulk = bulk[:length]
 
 	strBulk := string(bulk)
 	return Value{typ: "bulk", bulk: strBulk}, nil
@@ -154,16 +184,30 @@ func (r *Resp) readArray() (Value, error) {
 	}
 
 	if length == -1 {
-		return Value{typ: "null"}, nil
+		return Value{typ: "array", null: true}, nil
+	}
+	if length < 0 {
+		return Value{}, fmt.Errorf("invalid array length: %d", length)
 	}
 
-	array := make([]Value, length)
+	// the length is only what the client claims, we don't reserve more than a page
+	// worth of elements up front and let the slice grow as the elements really arrive
+	array := make([]Value, 0, min(length, 1024))
+	var tooLong error
 	for i := 0; i < length; i++ {
 		val, err := r.Read()
+		if errors.Is(err, errBulkTooLong) {
+			// the rest of the command still has to be read to stay in sync
+			tooLong = err
+			continue
+		}
 		if err != nil {
 			return Value{}, err
 		}
-		array[i] = val
+		array = append(array, val)
+	}
+	if tooLong != nil {
+		return Value{}, tooLong
 	}
 
 	return Value{typ: "array", array: array}, nil
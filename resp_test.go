@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		value Value
+		want  string
+	}{
+		{Value{typ: "string", str: "OK"}, "+OK\r\n"},
+		{Value{typ: "error", str: "ERR boom"}, "-ERR boom\r\n"},
+		{Value{typ: "integer", num: -42}, ":-42\r\n"},
+		{Value{typ: "bulk", bulk: "hello"}, "$5\r\nhello\r\n"},
+		// an empty string is a value of its own, only null is nil
+		{Value{typ: "bulk", bulk: ""}, "$0\r\n\r\n"},
+		{Value{typ: "bulk", null: true}, "$-1\r\n"},
+		{Value{typ: "bulk", bulk: "a\r\nb\x00\xff"}, "$6\r\na\r\nb\x00\xff\r\n"},
+		{Value{typ: "array"}, "*0\r\n"},
+		{Value{typ: "array", null: true}, "*-1\r\n"},
+		{Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: ""},
+			{typ: "bulk", null: true},
+			{typ: "integer", num: 1},
+		}}, "*3\r\n$0\r\n\r\n$-1\r\n:1\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(tt.value.Marshal()); got != tt.want {
+			t.Errorf("%+v marshals to %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestReadBulk(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Value
+	}{
+		{"$5\r\nhello\r\n", Value{typ: "bulk", bulk: "hello"}},
+		{"$0\r\n\r\n", Value{typ: "bulk", bulk: ""}},
+		{"$-1\r\n", Value{typ: "bulk", null: true}},
+		// the content is taken by length, CRLF, NUL and invalid UTF-8 included
+		{"$8\r\na\r\nb\x00\xff\xfe\r\r\n", Value{typ: "bulk", bulk: "a\r\nb\x00\xff\xfe\r"}},
+		{"*-1\r\n", Value{typ: "array", null: true}},
+		{"*2\r\n$0\r\n\r\n$-1\r\n", Value{typ: "array", array: []Value{{typ: "bulk"}, {typ: "bulk", null: true}}}},
+	}
+	for _, tt := range tests {
+		got, err := NewResp(strings.NewReader(tt.input)).Read()
+		if err != nil {
+			t.Errorf("reading %q: %v", tt.input, err)
+			continue
+		}
+		if replyString(got) != replyString(tt.want) || got.null != tt.want.null {
+			t.Errorf("reading %q = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{
+		"$3\r\nhello\r\n", // the content is longer than announced
+		"$5\r\nhi\r\n",    // and shorter
+		"$-2\r\n",
+		"$x\r\n",
+		"$5\nhello\r\n",
+	} {
+		if v, err := NewResp(strings.NewReader(input)).Read(); err == nil {
+			t.Errorf("reading %q = %+v, want an error", input, v)
+		}
+	}
+}
+
+func TestBinarySafeValues(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+	key, value := "key\r\n\x00\xff", "\r\n$-1\r\n\x00\xc3\x28"
+
+	for _, tt := range []commandTest{
+		{[]string{"SET", key, value}, "+OK"},
+		{[]string{"GET", key}, "$" + value},
+		{[]string{"STRLEN", key}, ":10"},
+		{[]string{"SET", "empty", ""}, "+OK"},
+		{[]string{"GET", "empty"}, "$"},
+		{[]string{"EXISTS", "empty"}, ":1"},
+		{[]string{"GET", "missing"}, "$nil"},
+		{[]string{"MGET", "empty", "missing", key}, "*[ nil " + value + "]"},
+		{[]string{"HSET", "h", "", ""}, ":1"},
+		{[]string{"HGET", "h", ""}, "$"},
+		{[]string{"HGET", "h", "missing"}, "$nil"},
+		{[]string{"RPUSH", "list", "", "\x00"}, ":2"},
+		{[]string{"LPOP", "list"}, "$"},
+		{[]string{"LPOP", "list"}, "$\x00"},
+		{[]string{"LPOP", "list"}, "$nil"},
+	} {
+		reply := c.do(tt.args...)
+		if got := replyString(reply); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errInvalidCursor = errors.New("ERR invalid cursor")
+
+// Go maps have no stable iteration order we could hand out as a cursor, so the *SCAN
+// commands walk members in the order of a 64 bit hash of their name instead. The cursor
+// is simply the next hash value to continue from. That order doesn't change when other
+// members are added or removed, which gives us the redis guarantee: every member that is
+// present for the whole iteration is returned at least once.
+
+// scanHash is the FNV-1a 64 bit hash used to order members for scanning
+func scanHash(name string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// scanBatch returns up to count names whose hash is >= cursor, in hash order, plus the
+// cursor for the next call (0 once everything was returned). Names sharing a hash are
+// never split across two batches, so a batch can be slightly bigger than count
+func scanBatch(names []string, cursor uint64, count int) ([]string, uint64) {
+	return scanBatchBy(names, cursor, count, scanHash)
+}
+
+// scanBatchBy is scanBatch with the ordering hash passed in
+func scanBatchBy(names []string, cursor uint64, count int, hash func(string) uint64) ([]string, uint64) {
+	type hashed struct {
+		hash uint64
+		name string
+	}
+
+	candidates := make([]hashed, 0, len(names))
+	for _, name := range names {
+		if h := hash(name); h >= cursor {
+			candidates = append(candidates, hashed{h, name})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].hash < candidates[j].hash })
+
+	n := count
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	for n > 0 && n < len(candidates) && candidates[n].hash == candidates[n-1].hash {
+		n++
+	}
+
+	batch := make([]string, n)
+	for i := 0; i < n; i++ {
+		batch[i] = candidates[i].name
+	}
+
+	// done, or the last hash was the very last possible value
+	if n == len(candidates) || candidates[n-1].hash == ^uint64(0) {
+		return batch, 0
+	}
+	return batch, candidates[n-1].hash + 1
+}
+
+// scanOptions holds the MATCH/COUNT/TYPE/NOVALUES options shared by the *SCAN commands
+type scanOptions struct {
+	match    string // glob pattern, empty matches everything
+	count    int    // how much work to do per call (a hint, like in redis)
+	typ      string // SCAN only: only return keys of this type
+	noValues bool   // HSCAN only: return field names without their values
+}
+
+// parseScanArgs parses the cursor and options of a *SCAN command. allowed lists the
+// options beyond MATCH and COUNT the command accepts (TYPE, NOVALUES)
+func parseScanArgs(cursorArg string, args []Value, allowed ...string) (uint64, scanOptions, error) {
+	opts := scanOptions{count: 10}
+
+	cursor, err := strconv.ParseUint(cursorArg, 10, 64)
+	if err != nil {
+		return 0, opts, errInvalidCursor
+	}
+
+	isAllowed := func(opt string) bool {
+		for _, a := range allowed {
+			if a == opt {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(argString(args[i]))
+		switch {
+		case opt == "MATCH" && i+1 < len(args):
+			i++
+			opts.match = argString(args[i])
+		case opt == "COUNT" && i+1 < len(args):
+			i++
+			n, err := strconv.Atoi(argString(args[i]))
+			if err != nil {
+				return 0, opts, errInvalidInteger
+			}
+			if n < 1 {
+				return 0, opts, errSyntax
+			}
+			opts.count = n
+		case opt == "TYPE" && i+1 < len(args) && isAllowed("TYPE"):
+			i++
+			opts.typ = strings.ToLower(argString(args[i]))
+		case opt == "NOVALUES" && isAllowed("NOVALUES"):
+			opts.noValues = true
+		default:
+			return 0, opts, errSyntax
+		}
+	}
+	return cursor, opts, nil
+}
+
+// globMatch reports whether s matches a redis style glob pattern:
+// * matches any sequence, ? any single byte, [abc] / [^abc] / [a-z] a class
+// of bytes and a backslash escapes the next byte. Like redis' stringmatchlen it only
+// ever goes back to the last star, so a pattern full of stars can't take exponential time
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, starI := -1, 0 // where the pattern goes on after the last star, and the byte of s it matched up to
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			if p == len(pattern) {
+				return true
+			}
+			star, starI = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if next, ok := matchByte(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+		// mismatch: let the last star swallow one more byte, or give up without one
+		if star < 0 {
+			return false
+		}
+		starI++
+		p, i = star, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte matches b against the single byte token (?, a class, an escaped or a plain
+// byte) at pattern[p]. It returns where the pattern goes on after the token. An
+// unterminated class runs until the end of the pattern
+func matchByte(pattern string, p int, b byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '[':
+		p++
+		not := p < len(pattern) && pattern[p] == '^'
+		if not {
+			p++
+		}
+		match := false
+		for p < len(pattern) && pattern[p] != ']' {
+			switch {
+			case pattern[p] == '\\' && p+1 < len(pattern):
+				p++
+				if pattern[p] == b {
+					match = true
+				}
+			case p+2 < len(pattern) && pattern[p+1] == '-':
+				start, end := pattern[p], pattern[p+2]
+				if start > end {
+					start, end = end, start
+				}
+				if b >= start && b <= end {
+					match = true
+				}
+				p += 2
+			case pattern[p] == b:
+				match = true
+			}
+			p++
+		}
+		if p < len(pattern) {
+			p++ // the closing bracket
+		}
+		return p, match != not
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+		return p + 1, pattern[p] == b
+	default:
+		return p + 1, pattern[p] == b
+	}
+}
+
+// The keyspace SCAN cursor encodes both the shard and the position inside it: the low
+// bits hold the shard index and the rest the scan position within that shard, which uses
+// the same hash ordering as the *SCAN commands (shifted down to make room for the shard).
+// Shards are visited in index order, so the same guarantee holds across the whole cache.
+//
+// A shard can hold millions of keys, sorting all of them on every SCAN call would make
+// each step O(n log n). Every shard keeps a scanIndex instead: its keys spread over buckets
+// by the top bits of their hash, so a bucket holds the keys of one contiguous range of the
+// hash order and a SCAN step only sorts the few buckets it walks through. The number of
+// buckets follows the size of the shard, like a hash table
+const (
+	scanMinBits    = 4  // the smallest index has 16 buckets
+	scanMaxBits    = 32 // plenty, and leaves room for the shard bits of the cursor
+	scanBucketLoad = 8  // average keys per bucket before the index doubles
+)
+
+type scanIndex struct {
+	bits    uint            // buckets are indexed by the top bits of the hash
+	buckets [][]*cacheEntry // nil until the first key comes in
+	count   int
+}
+
+// bucket returns the bucket of a hash
+func (x *scanIndex) bucket(hash uint64) uint64 {
+	return hash >> (64 - x.bits)
+}
+
+// add puts an entry in the index. Callers hold the shard write lock
+func (x *scanIndex) add(entry *cacheEntry) {
+	if x.buckets == nil {
+		x.resize(scanMinBits)
+	} else if x.count >= len(x.buckets)*scanBucketLoad && x.bits < scanMaxBits {
+		x.resize(x.bits + 1)
+	}
+	b := x.bucket(scanHash(entry.key))
+	entry.scanSlot = len(x.buckets[b])
+	x.buckets[b] = append(x.buckets[b], entry)
+	x.count++
+}
+
+// remove takes an entry out of the index. Callers hold the shard write lock
+func (x *scanIndex) remove(entry *cacheEntry) {
+	b := x.bucket(scanHash(entry.key))
+	bucket := x.buckets[b]
+	last := bucket[len(bucket)-1]
+	bucket[entry.scanSlot], last.scanSlot = last, entry.scanSlot
+	bucket[len(bucket)-1] = nil
+	x.buckets[b] = bucket[:len(bucket)-1]
+	x.count--
+
+	if x.bits > scanMinBits && x.count < len(x.buckets)*scanBucketLoad/8 {
+		x.resize(x.bits - 1)
+	}
+}
+
+// resize spreads the entries over 1<<bits buckets
+func (x *scanIndex) resize(bits uint) {
+	old := x.buckets
+	x.bits, x.buckets = bits, make([][]*cacheEntry, 1<<bits)
+	for _, bucket := range old {
+		for _, entry := range bucket {
+			b := x.bucket(scanHash(entry.key))
+			entry.scanSlot = len(x.buckets[b])
+			x.buckets[b] = append(x.buckets[b], entry)
+		}
+	}
+}
+
+// batch returns, in hash order, at least count entries (when there are that many) whose
+// hash shifted down by shardBits is >= pos, plus the position to continue from (0 once
+// the shard is done). Like scanBatch it never splits entries sharing a hash. Callers hold
+// the shard read lock
+func (x *scanIndex) batch(pos uint64, count int, shardBits uint) ([]*cacheEntry, uint64) {
+	type hashed struct {
+		hash  uint64
+		entry *cacheEntry
+	}
+	if x.buckets == nil {
+		return nil, 0
+	}
+
+	var candidates []hashed
+	b := x.bucket(pos << shardBits)
+	for ; b < uint64(len(x.buckets)) && len(candidates) < count; b++ {
+		from := len(candidates)
+		for _, entry := range x.buckets[b] {
+			if h := scanHash(entry.key) >> shardBits; h >= pos {
+				candidates = append(candidates, hashed{h, entry})
+			}
+		}
+		fresh := candidates[from:]
+		sort.Slice(fresh, func(i, j int) bool { return fresh[i].hash < fresh[j].hash })
+	}
+
+	n := min(count, len(candidates))
+	for n > 0 && n < len(candidates) && candidates[n].hash == candidates[n-1].hash {
+		n++
+	}
+	batch := make([]*cacheEntry, n)
+	for i := range batch {
+		batch[i] = candidates[i].entry
+	}
+
+	switch {
+	case n < len(candidates):
+		return batch, candidates[n-1].hash + 1
+	case b < uint64(len(x.buckets)):
+		// every bucket we walked is done, carry on with the next one
+		return batch, (b << (64 - x.bits)) >> shardBits
+	default:
+		return batch, 0
+	}
+}
+
+// shardBits is the number of cursor bits used for the shard index
+func (c *LRUCache) shardBits() uint {
+	return uint(bits.TrailingZeros(uint(c.shardCount)))
+}
+
+// Scan returns a batch of keys matching opts and the cursor for the next call
+func (c *LRUCache) Scan(cursor uint64, opts scanOptions) ([]string, uint64) {
+	shardBits := c.shardBits()
+	idx := int(cursor & uint64(c.shardMask))
+	pos := cursor >> shardBits
+
+	var keys []string
+	visited := 0
+	for idx < c.shardCount {
+		shard := c.shards[idx]
+		now := nowMillis()
+
+		shard.mutex.RLock()
+		batch, next := shard.scan.batch(pos, opts.count-visited, shardBits)
+		for _, entry := range batch {
+			if entry.isExpired(now) {
+				continue
+			}
+			if opts.typ != "" && entry.typeName() != opts.typ {
+				continue
+			}
+			if opts.match != "" && !globMatch(opts.match, entry.key) {
+				continue
+			}
+			keys = append(keys, entry.key)
+		}
+		shard.mutex.RUnlock()
+
+		visited += len(batch)
+		if next != 0 {
+			if visited >= opts.count {
+				return keys, next<<shardBits | uint64(idx)
+			}
+			pos = next
+			continue
+		}
+
+		// this shard is done, carry on with the next one
+		idx++
+		pos = 0
+		if visited >= opts.count && idx < c.shardCount {
+			return keys, uint64(idx)
+		}
+	}
+	return keys, 0
+}
+
+// Keys returns every key matching a glob pattern. It walks the whole cache, so it
+// is meant for debugging, SCAN is the way to go on a busy server
+func (c *LRUCache) Keys(pattern string) []string {
+	var keys []string
+	now := nowMillis()
+	for _, shard := range c.shards {
+		shard.mutex.RLock()
+		for key, elem := range shard.items {
+			if !elem.Value.(*cacheEntry).isExpired(now) && globMatch(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+	return keys
+}
+
+// DBSize returns the number of keys in the cache. Like in redis, keys that expired
+// but were not reclaimed yet are still counted
+func (c *LRUCache) DBSize() int {
+	n := 0
+	for _, shard := range c.shards {
+		shard.mutex.RLock()
+		n += len(shard.items)
+		shard.mutex.RUnlock()
+	}
+	return n
+}
+
+// scanCommand handles SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scanCommand(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'SCAN' command"}
+	}
+
+	cursor, opts, err := parseScanArgs(argString(args[0]), args[1:], "TYPE")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	keys, next := cache.Scan(cursor, opts)
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.FormatUint(next, 10)},
+		bulkArray(keys),
+	}}
+}
+
+// keysCommand handles KEYS pattern
+func keysCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'KEYS' command"}
+	}
+	return bulkArray(cache.Keys(argString(args[0])))
+}
+
+// dbsizeCommand handles DBSIZE
+func dbsizeCommand(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'DBSIZE' command"}
+	}
+	return Value{typ: "integer", num: cache.DBSize()}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hellox", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h[\]]llo`, "h]llo", true},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:age", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"a**", "abc", true},
+		{"[abc", "a", true},
+		{"[abc", "ab", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGlobMatchManyStars(t *testing.T) {
+	// backtracking into every star would take ages here
+	pattern := strings.Repeat("*a", 30) + "*b"
+	s := strings.Repeat("a", 10000)
+	start := time.Now()
+	if globMatch(pattern, s) {
+		t.Fatal("matched without a b")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("globMatch took %v", elapsed)
+	}
+}
+
+func TestScanReturnsEveryKey(t *testing.T) {
+	cache = NewLRUCache(0, 4, "fnv")
+	const n = 5000
+	for i := 0; i < n; i++ {
+		cache.Put("key:"+strconv.Itoa(i), "v", putOptions{})
+	}
+
+	// keys deleted and added during the scan may or may not show up, the others must
+	seen := make(map[string]int)
+	cursor, steps := uint64(0), 0
+	for {
+		keys, next := cache.Scan(cursor, scanOptions{count: 37})
+		for _, key := range keys {
+			seen[key]++
+		}
+		steps++
+		if steps%10 == 0 {
+			cache.Delete("key:" + strconv.Itoa(steps))
+			cache.Put("new:"+strconv.Itoa(steps), "v", putOptions{})
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	for i := 0; i < n; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if i%10 == 0 && i > 0 && i <= steps {
+			continue
+		}
+		if seen[key] != 1 {
+			t.Fatalf("%s returned %d times", key, seen[key])
+		}
+	}
+	if steps > n/37+10 {
+		t.Fatalf("the scan took %d steps", steps)
+	}
+}
+
+func TestScanIndexShrinks(t *testing.T) {
+	cache = NewLRUCache(0, 1, "fnv")
+	for i := 0; i < 10000; i++ {
+		cache.Put(strconv.Itoa(i), "v", putOptions{})
+	}
+	grown := len(cache.shards[0].scan.buckets)
+	for i := 0; i < 9990; i++ {
+		cache.Delete(strconv.Itoa(i))
+	}
+	if shrunk := len(cache.shards[0].scan.buckets); shrunk >= grown || shrunk > 1<<scanMinBits {
+		t.Fatalf("the index went from %d to %d buckets", grown, shrunk)
+	}
+	keys, next := cache.Scan(0, scanOptions{count: 100})
+	if len(keys) != 10 || next != 0 {
+		t.Fatalf("Scan = %v, %d", keys, next)
+	}
+}
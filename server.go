@@ -1,20 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"runtime"
 	"strings"
+	"time"
 )
 
 // StartServer starts the redis compatible RESP server on port 7171
 // (instead of 6379, to comply with the assignment requirements)
 func StartServer() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "7171"
-	}
+	port := serverPort()
 
 	// we want to use all the available CPU cores for the server
 	// this is important for performance, especially when handling multiple connections
@@ -48,18 +47,96 @@ func StartServer() {
 	}
 }
 
+// serverPort returns the port we listen on, replicas tell it to their primary
+func serverPort() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return port
+	}
+	return "7171"
+}
+
+// client is the per connection state. The RESP reader and the reply writer live as long
+// as the connection: a reader created per command would throw away whatever it had already
+// buffered of the next pipelined command. Blocking commands also have to notice a
+// disconnect while they wait for data
+type client struct {
+	conn    net.Conn
+	resp    *Resp
+	writer  *Writer
+	pending []byte // bytes the disconnect watcher read off the socket while the client was blocked
+
+	listeningPort int // the port a replica listens on, from REPLCONF listening-port
+}
+
+func newClient(conn net.Conn) *client {
+	cl := &client{conn: conn, writer: NewWriter(conn)}
+	cl.resp = NewResp(cl)
+	return cl
+}
+
+// Read lets the RESP parser read through the client, the bytes picked up
+// by the disconnect watcher are handed out before reading the socket again
+func (cl *client) Read(p []byte) (int, error) {
+	if len(cl.pending) > 0 {
+		n := copy(p, cl.pending)
+		cl.pending = cl.pending[n:]
+		return n, nil
+	}
+	return cl.conn.Read(p)
+}
+
+// watchDisconnect keeps reading the socket while the client is blocked in a command,
+// since that is the only way to find out the peer went away. The returned channel is
+// closed when that happens. Anything the client sends in the meantime (pipelined commands)
+// is kept for later. stop has to be called once the command is done, it kicks the
+// watcher out of its read and waits for it before the connection is read normally again
+func (cl *client) watchDisconnect() (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		buf := make([]byte, 512)
+		for {
+			n, err := cl.conn.Read(buf)
+			cl.pending = append(cl.pending, buf[:n]...)
+			if err != nil {
+				// a timeout is our own doing in stop, anything else means the peer is gone
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					close(gone)
+				}
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		cl.conn.SetReadDeadline(time.Now())
+		<-finished
+		cl.conn.SetReadDeadline(time.Time{})
+	}
+	return gone, stop
+}
+
 // handleClient reads the incoming requests from a client and processes them
 func handleClient(conn net.Conn) {
 	// making sure we close the connection when we're done
 	defer conn.Close()
 
+	cl := newClient(conn)
+
 	// keep handling commands in a loop until client disconnects
 	for {
-		// creating a new RESP parser for this connection
-		resp := NewResp(conn)
-
 		// reeading the next command from client
-		value, err := resp.Read()
+		value, err := cl.resp.Read()
+		if errors.Is(err, errBulkTooLong) {
+			// the oversized command was skipped as a whole, the connection is still usable
+			if err := cl.reply(Value{typ: "error", str: err.Error()}); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			continue
+		}
 		if err != nil {
 			// handle client disconnection gracefully
 			if err.Error() == "EOF" ||
@@ -69,20 +146,48 @@ func handleClient(conn net.Conn) {
 				return
 			}
 
-			// If we're here, something unexpected happened
+			// If we're here, something unexpected happened. Like redis we tell the client
+			// about a protocol error before hanging up, the stream can't be trusted anymore
 			fmt.Println("Error reading request:", err)
+			cl.reply(Value{typ: "error", str: "ERR Protocol error: " + err.Error()})
 			return
 		}
 
-		// process the command to get a response
-		response := processCommand(value)
+		// process the command to get a response, blocking commands get the client
+		// so they can park this goroutine until data arrives
+		var response Value
+		switch {
+		case isReplicaCommand(value):
+			// a replica's PSYNC makes the connection a replication link, see replication.go
+			var done bool
+			if response, done = processReplicaCommand(cl, value); done {
+				return
+			}
+		case isBlockingCommand(value):
+			// the replies to the commands before this one must not wait for it to unblock
+			if err := cl.writer.Flush(); err != nil {
+				fmt.Println("Error writing response:", err)
+				return
+			}
+			response = processBlockingCommand(cl, value)
+		default:
+			response = processCommand(value)
+		}
 
-		// write response back to client
-		writer := NewWriter(conn)
-		err = writer.Write(response)
-		if err != nil {
+		if err := cl.reply(response); err != nil {
 			fmt.Println("Error writing response:", err)
 			return
 		}
 	}
 }
+
+// reply writes a response to the client. Replies are buffered and only flushed once the
+// client has no more pipelined commands waiting, so a batch of requests is answered with
+// a single write
+func (cl *client) reply(response Value) error {
+	err := cl.writer.Write(response)
+	if err == nil && cl.resp.Buffered() == 0 && len(cl.pending) == 0 {
+		err = cl.writer.Flush()
+	}
+	return err
+}
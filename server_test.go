@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer serves a fresh cache on a random localhost port and returns its address
+func startTestServer(t testing.TB) string {
+	t.Helper()
+	cache = NewLRUCache(0, 16, "fnv")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleClient(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// testConn is a client connection speaking RESP
+type testConn struct {
+	t    testing.TB
+	conn net.Conn
+	resp *Resp
+}
+
+func dialTest(t testing.TB, addr string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, resp: NewResp(conn)}
+}
+
+// send writes a command without waiting for its reply
+func (c *testConn) send(args ...string) {
+	c.t.Helper()
+	if _, err := c.conn.Write(command(args...).Marshal()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next reply
+func (c *testConn) read() Value {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	v, err := c.resp.Read()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return v
+}
+
+// do sends a command and returns its reply
+func (c *testConn) do(args ...string) Value {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+func TestPipelinedMixedCommands(t *testing.T) {
+	addr := startTestServer(t)
+	c := dialTest(t, addr)
+
+	// every command with a check of its reply, all sent in a single write
+	type step struct {
+		args  []string
+		check func(Value) bool
+	}
+	isBulk := func(s string) func(Value) bool {
+		return func(v Value) bool { return v.typ == "bulk" && !v.null && v.bulk == s }
+	}
+	isInt := func(n int) func(Value) bool {
+		return func(v Value) bool { return v.typ == "integer" && v.num == n }
+	}
+	isError := func(prefix string) func(Value) bool {
+		return func(v Value) bool { return v.typ == "error" && strings.HasPrefix(v.str, prefix) }
+	}
+	isPopped := func(key, value string) func(Value) bool {
+		return func(v Value) bool {
+			return v.typ == "array" && len(v.array) == 2 && v.array[0].bulk == key && v.array[1].bulk == value
+		}
+	}
+	isNullArray := func(v Value) bool { return v.typ == "array" && v.null }
+
+	var steps []step
+	add := func(check func(Value) bool, args ...string) {
+		steps = append(steps, step{args, check})
+	}
+	for i := 0; i < 1000; i++ {
+		n := strconv.Itoa(i)
+		add(func(v Value) bool { return v.str == "OK" }, "SET", "k"+n, "v"+n)
+		add(isBulk("v"+n), "GET", "k"+n)
+		add(isInt(i+1), "INCR", "counter")
+		add(isInt(1), "RPUSH", "list", n)
+		add(isPopped("list", n), "BLPOP", "list", "1")
+		switch i % 100 {
+		case 0:
+			// blocks for its whole timeout, the replies after it have to wait
+			add(isNullArray, "BLPOP", "empty", "0.01")
+		case 50:
+			add(isError("WRONGTYPE"), "LPUSH", "k"+n, "x")
+		case 99:
+			add(isError("ERR unknown command"), "NOSUCHCOMMAND", n)
+		}
+	}
+
+	var buf []byte
+	for _, s := range steps {
+		buf = append(buf, command(s.args...).Marshal()...)
+	}
+	go c.conn.Write(buf)
+
+	for i, s := range steps {
+		if reply := c.read(); !s.check(reply) {
+			t.Fatalf("reply %d to %v: %+v", i, s.args, reply)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// setValue is the value of a set key
+type setValue map[string]struct{}
+
+// members returns the members of the set as a slice, in no particular order
+func (s setValue) members() []string {
+	out := make([]string, 0, len(s))
+	for member := range s {
+		out = append(out, member)
+	}
+	return out
+}
+
+// SAdd adds members to the set at key and returns how many were not there yet
+func (c *LRUCache) SAdd(key string, members []string) (int, error) {
+	added := 0
+	err := c.mutate(key, "set", true, func(entry *cacheEntry) error {
+		s := entry.value.(setValue)
+		for _, member := range members {
+			if _, ok := s[member]; !ok {
+				s[member] = struct{}{}
+				added++
+			}
+		}
+		return nil
+	})
+	return added, err
+}
+
+// SRem removes members from the set at key and returns how many were removed
+func (c *LRUCache) SRem(key string, members []string) (int, error) {
+	removed := 0
+	err := c.mutate(key, "set", false, func(entry *cacheEntry) error {
+		if entry == nil {
+			return nil
+		}
+		s := entry.value.(setValue)
+		for _, member := range members {
+			if _, ok := s[member]; ok {
+				delete(s, member)
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// SIsMember reports for each member whether it is in the set at key
+func (c *LRUCache) SIsMember(key string, members []string) ([]bool, error) {
+	found := make([]bool, len(members))
+	err := c.view(key, "set", func(entry *cacheEntry) {
+		if entry == nil {
+			return
+		}
+		s := entry.value.(setValue)
+		for i, member := range members {
+			_, found[i] = s[member]
+		}
+	})
+	return found, err
+}
+
+// SCard returns the number of members of the set at key
+func (c *LRUCache) SCard(key string) (int, error) {
+	n := 0
+	err := c.view(key, "set", func(entry *cacheEntry) {
+		if entry != nil {
+			n = len(entry.value.(setValue))
+		}
+	})
+	return n, err
+}
+
+// maxRandomCount bounds the members SRANDMEMBER returns for a negative count. They may
+// repeat, so without a bound one command could ask for more than fits in memory
+const maxRandomCount = 1 << 24
+
+// SRandMember returns random members without removing them. A positive count returns
+// distinct members (at most the whole set), a negative one returns -count members that
+// may repeat. Like in redis. Only the members are copied under the shard lock, the
+// reply is picked from the copy
+func (c *LRUCache) SRandMember(key string, count int) ([]string, error) {
+	var members []string
+	err := c.view(key, "set", func(entry *cacheEntry) {
+		if entry != nil {
+			members = entry.value.(setValue).members()
+		}
+	})
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+
+	if count < 0 {
+		picked := make([]string, -count)
+		for i := range picked {
+			picked[i] = members[rand.Intn(len(members))]
+		}
+		return picked, nil
+	}
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	return members[:min(count, len(members))], nil
+}
+
+// SPop removes and returns up to count random members
+func (c *LRUCache) SPop(key string, count int) ([]string, error) {
+	var popped []string
+	err := c.mutate(key, "set", false, func(entry *cacheEntry) error {
+		if entry == nil {
+			return nil
+		}
+		s := entry.value.(setValue)
+		members := s.members()
+		rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+		if count > len(members) {
+			count = len(members)
+		}
+		popped = members[:count]
+		for _, member := range popped {
+			delete(s, member)
+		}
+		return nil
+	})
+	return popped, err
+}
+
+// SMove atomically moves a member from the set at src to the set at dst
+func (c *LRUCache) SMove(src, dst, member string) (bool, error) {
+	unlock := c.lockKeys(src, dst)
+	defer unlock()
+
+	srcShard, dstShard := c.getShard(src), c.getShard(dst)
+	srcElem, ok := c.liveElement(srcShard, src)
+	if !ok {
+		return false, nil
+	}
+	srcEntry := srcElem.Value.(*cacheEntry)
+	if srcEntry.typeName() != "set" {
+		return false, errWrongType
+	}
+	dstElem, dstExists := c.liveElement(dstShard, dst)
+	if dstExists && dstElem.Value.(*cacheEntry).typeName() != "set" {
+		return false, errWrongType
+	}
+
+	srcSet := srcEntry.value.(setValue)
+	if _, ok := srcSet[member]; !ok {
+		return false, nil
+	}
+	if src == dst {
+		return true, nil
+	}
+
+	delete(srcSet, member)
+	if srcEntry.isEmpty() {
+		srcShard.removeElement(srcElem)
+	} else {
+		c.reweigh(srcShard, srcElem)
+	}
+
+	if !dstExists {
+		c.addEntry(dstShard, &cacheEntry{key: dst, value: setValue{member: {}}})
+		return true, nil
+	}
+	dstElem.Value.(*cacheEntry).value.(setValue)[member] = struct{}{}
+	dstShard.touch(dstElem)
+	c.reweigh(dstShard, dstElem)
+	return true, nil
+}
+
+// SetAlgebra computes the intersection ("inter"), union ("union") or difference ("diff")
+// of the sets at keys, a missing key counts as an empty set. With a non empty dest the
+// result is stored there, replacing whatever dest held. All shards involved are locked
+// up front in index order so concurrent algebra on overlapping keys can't deadlock
+func (c *LRUCache) SetAlgebra(op string, keys []string, dest string) ([]string, error) {
+	locked := keys
+	if dest != "" {
+		locked = append(append([]string{}, keys...), dest)
+	}
+	unlock := c.lockKeys(locked...)
+	defer unlock()
+
+	sets := make([]setValue, len(keys))
+	for i, key := range keys {
+		shard := c.getShard(key)
+		elem, ok := c.readElement(shard, key)
+		if !ok {
+			continue
+		}
+		entry := elem.Value.(*cacheEntry)
+		if entry.typeName() != "set" {
+			return nil, errWrongType
+		}
+		sets[i] = entry.value.(setValue)
+		shard.touch(elem)
+	}
+
+	result := make(setValue)
+	switch op {
+	case "inter":
+		// walk the smallest set and check the others, any missing set empties the result
+		sorted := append([]setValue{}, sets...)
+		sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) < len(sorted[j]) })
+		if len(sorted) > 0 && sorted[0] != nil {
+			for member := range sorted[0] {
+				inAll := true
+				for _, other := range sorted[1:] {
+					if _, ok := other[member]; !ok {
+						inAll = false
+						break
+					}
+				}
+				if inAll {
+					result[member] = struct{}{}
+				}
+			}
+		}
+	case "union":
+		for _, s := range sets {
+			for member := range s {
+				result[member] = struct{}{}
+			}
+		}
+	case "diff":
+		for member := range sets[0] {
+			inOther := false
+			for _, other := range sets[1:] {
+				if _, ok := other[member]; ok {
+					inOther = true
+					break
+				}
+			}
+			if !inOther {
+				result[member] = struct{}{}
+			}
+		}
+	}
+
+	if dest != "" {
+		shard := c.getShard(dest)
+		if elem, ok := c.liveElement(shard, dest); ok {
+			shard.removeElement(elem)
+		}
+		// an empty result simply leaves dest deleted
+		if len(result) > 0 {
+			c.addEntry(shard, &cacheEntry{key: dest, value: result})
+		}
+	}
+	return result.members(), nil
+}
+
+// SScan returns a batch of matching members and the cursor for the next call
+func (c *LRUCache) SScan(key string, cursor uint64, opts scanOptions) ([]string, uint64, error) {
+	var reply []string
+	var next uint64
+	err := c.view(key, "set", func(entry *cacheEntry) {
+		if entry == nil {
+			return
+		}
+		var batch []string
+		batch, next = scanBatch(entry.value.(setValue).members(), cursor, opts.count)
+		for _, member := range batch {
+			if opts.match == "" || globMatch(opts.match, member) {
+				reply = append(reply, member)
+			}
+		}
+	})
+	return reply, next, err
+}
+
+// saddCommand handles SADD and SREM, both reply with the number of members changed
+func saddCommand(cmd string, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	key := argString(args[0])
+	members := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		members[i] = argString(arg)
+		if err := checkSize(key, members[i]); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+	}
+
+	var n int
+	var err error
+	if cmd == "SADD" {
+		n, err = cache.SAdd(key, members)
+	} else {
+		n, err = cache.SRem(key, members)
+	}
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: n}
+}
+
+// sismemberCommand handles SISMEMBER (integer reply) and SMISMEMBER (array of integers)
+func sismemberCommand(cmd string, args []Value) Value {
+	if len(args) < 2 || (cmd == "SISMEMBER" && len(args) != 2) {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	members := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		members[i] = argString(arg)
+	}
+
+	found, err := cache.SIsMember(argString(args[0]), members)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	reply := make([]Value, len(found))
+	for i, ok := range found {
+		reply[i] = Value{typ: "integer", num: 0}
+		if ok {
+			reply[i].num = 1
+		}
+	}
+	if cmd == "SISMEMBER" {
+		return reply[0]
+	}
+	return Value{typ: "array", array: reply}
+}
+
+// scardCommand handles SCARD
+func scardCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'SCARD' command"}
+	}
+
+	n, err := cache.SCard(argString(args[0]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: n}
+}
+
+// srandmemberCommand handles SRANDMEMBER and SPOP, without a count they reply
+// with a single bulk string instead of an array
+func srandmemberCommand(cmd string, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(argString(args[1]))
+		if err != nil {
+			return Value{typ: "error", str: errInvalidInteger.Error()}
+		}
+		if n < 0 && cmd == "SPOP" {
+			return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+		}
+		if n < -maxRandomCount {
+			return Value{typ: "error", str: "ERR value is out of range"}
+		}
+		count = n
+	}
+
+	var members []string
+	var err error
+	if cmd == "SPOP" {
+		members, err = cache.SPop(argString(args[0]), count)
+	} else {
+		members, err = cache.SRandMember(argString(args[0]), count)
+	}
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if len(args) == 2 {
+		return bulkArray(members)
+	}
+	if len(members) == 0 {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: members[0]}
+}
+
+// smoveCommand handles SMOVE
+func smoveCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'SMOVE' command"}
+	}
+
+	moved, err := cache.SMove(argString(args[0]), argString(args[1]), argString(args[2]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if moved {
+		return Value{typ: "integer", num: 1}
+	}
+	return Value{typ: "integer", num: 0}
+}
+
+// smembersCommand handles SMEMBERS, which is the union of a single set
+func smembersCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'SMEMBERS' command"}
+	}
+
+	members, err := cache.SetAlgebra("union", []string{argString(args[0])}, "")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return bulkArray(members)
+}
+
+// setAlgebraCommand handles SINTER, SUNION, SDIFF and their *STORE variants, which
+// take the destination as their first argument and reply with the size of the result
+func setAlgebraCommand(cmd string, args []Value) Value {
+	store := cmd == "SINTERSTORE" || cmd == "SUNIONSTORE" || cmd == "SDIFFSTORE"
+	minArgs := 1
+	if store {
+		minArgs = 2
+	}
+	if len(args) < minArgs {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	var dest string
+	if store {
+		dest, args = argString(args[0]), args[1:]
+	}
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = argString(arg)
+	}
+
+	op := map[string]string{
+		"SINTER": "inter", "SINTERSTORE": "inter",
+		"SUNION": "union", "SUNIONSTORE": "union",
+		"SDIFF": "diff", "SDIFFSTORE": "diff",
+	}[cmd]
+	members, err := cache.SetAlgebra(op, keys, dest)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if store {
+		return Value{typ: "integer", num: len(members)}
+	}
+	return bulkArray(members)
+}
+
+// sscanCommand handles SSCAN key cursor [MATCH pattern] [COUNT count]
+func sscanCommand(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'SSCAN' command"}
+	}
+
+	cursor, opts, err := parseScanArgs(argString(args[1]), args[2:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	members, next, err := cache.SScan(argString(args[0]), cursor, opts)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.FormatUint(next, 10)},
+		bulkArray(members),
+	}}
+}
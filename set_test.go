@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestSRandMemberCount(t *testing.T) {
+	newTestCache(t, 0)
+	run("SADD", "s", "a", "b", "c")
+
+	tests := []struct {
+		count    string
+		n        int  // members in the reply
+		distinct bool // no member twice
+	}{
+		{"0", 0, true},
+		{"2", 2, true},
+		{"3", 3, true},
+		{"10", 3, true}, // a positive count stops at the whole set
+		{"-2", 2, false},
+		{"-10", 10, false}, // a negative one repeats members to get there
+	}
+	for _, tt := range tests {
+		reply := run("SRANDMEMBER", "s", tt.count)
+		got := arrayStrings(reply)
+		if reply.typ != "array" || len(got) != tt.n {
+			t.Errorf("SRANDMEMBER s %s = %v, want %d members", tt.count, got, tt.n)
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, member := range got {
+			if member != "a" && member != "b" && member != "c" {
+				t.Errorf("SRANDMEMBER s %s returned %q, not a member", tt.count, member)
+			}
+			if seen[member] && tt.distinct {
+				t.Errorf("SRANDMEMBER s %s returned %q twice", tt.count, member)
+			}
+			seen[member] = true
+		}
+	}
+
+	// without a count a single bulk, a null one for a missing key
+	if reply := run("SRANDMEMBER", "s"); reply.typ != "bulk" || reply.bulk == "" {
+		t.Errorf("SRANDMEMBER s = %+v", reply)
+	}
+	if reply := run("SRANDMEMBER", "missing"); !reply.null {
+		t.Errorf("SRANDMEMBER missing = %+v", reply)
+	}
+	if reply := run("SRANDMEMBER", "missing", "-5"); reply.typ != "array" || len(reply.array) != 0 {
+		t.Errorf("SRANDMEMBER missing -5 = %+v", reply)
+	}
+
+	invalid := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"SRANDMEMBER", "s", "-1000000000000"}, "ERR value is out of range"},
+		{[]string{"SRANDMEMBER", "s", "-9223372036854775808"}, "ERR value is out of range"},
+		{[]string{"SRANDMEMBER", "s", "x"}, errInvalidInteger.Error()},
+		{[]string{"SPOP", "s", "-1"}, "ERR value is out of range, must be positive"},
+	}
+	for _, tt := range invalid {
+		if reply := run(tt.args...); reply.typ != "error" || reply.str != tt.err {
+			t.Errorf("%v = %+v, want %q", tt.args, reply, tt.err)
+		}
+	}
+	if got := run("SCARD", "s"); got.num != 3 {
+		t.Errorf("SCARD s = %d after SRANDMEMBER, want 3", got.num)
+	}
+}
+
+func TestSetAlgebraStore(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		keys []string
+		want []string // the members stored in dest, nil for no dest key
+	}{
+		{"SINTERSTORE", []string{"s1", "s2"}, []string{"b", "c"}},
+		{"SINTERSTORE", []string{"s1", "s2", "s3"}, []string{"c"}},
+		{"SINTERSTORE", []string{"s1", "missing"}, nil},
+		{"SUNIONSTORE", []string{"s1", "s3"}, []string{"a", "b", "c", "d"}},
+		{"SUNIONSTORE", []string{"missing"}, nil},
+		{"SDIFFSTORE", []string{"s1", "s2"}, []string{"a"}},
+		{"SDIFFSTORE", []string{"s1", "missing"}, []string{"a", "b", "c"}},
+		{"SDIFFSTORE", []string{"s2", "s1", "s3"}, nil},
+		// dest can be one of the sources
+		{"SUNIONSTORE", []string{"dest", "s3"}, []string{"c", "d", "x"}},
+	}
+	for _, tt := range tests {
+		newTestCache(t, 0)
+		run("SADD", "s1", "a", "b", "c")
+		run("SADD", "s2", "b", "c")
+		run("SADD", "s3", "c", "d")
+		// whatever dest held is replaced, even a value of another type
+		run("SET", "dest", "old")
+		if tt.keys[0] == "dest" {
+			run("DEL", "dest")
+			run("SADD", "dest", "x")
+		}
+
+		args := append([]string{tt.cmd, "dest"}, tt.keys...)
+		if reply := run(args...); reply.typ != "integer" || reply.num != len(tt.want) {
+			t.Errorf("%v = %+v, want %d", args, reply, len(tt.want))
+		}
+		if tt.want == nil {
+			if run("EXISTS", "dest").num != 0 {
+				t.Errorf("%v left dest behind, an empty result deletes it", args)
+			}
+			continue
+		}
+		got := arrayStrings(run("SMEMBERS", "dest"))
+		slices.Sort(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v stored %v, want %v", args, got, tt.want)
+		}
+	}
+
+	// a source that isn't a set fails the command and leaves dest alone
+	newTestCache(t, 0)
+	run("SET", "str", "x")
+	run("SADD", "dest", "kept")
+	if reply := run("SUNIONSTORE", "dest", "str"); reply.typ != "error" {
+		t.Errorf("SUNIONSTORE from a string = %+v, want WRONGTYPE", reply)
+	}
+	if got := arrayStrings(run("SMEMBERS", "dest")); !reflect.DeepEqual(got, []string{"kept"}) {
+		t.Errorf("dest = %v after a failed SUNIONSTORE", got)
+	}
+}
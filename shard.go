@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"strings"
+)
+
+// Sharding
+//
+// Keys are spread over a power of two number of shards by hashing them. The default FNV-1a
+// is fast and stable across restarts, but anybody who knows it can make up keys that all
+// land in one shard and serialize the server on its lock (hash flooding). maphash is seeded
+// randomly every time the cache is created, so the distribution can't be predicted from
+// outside. Both settings are fixed for the lifetime of the cache, changing them would mean
+// rehashing every key.
+const (
+	defaultShardCount = 256 // a good balance for most workloads
+	maxShardCount     = 1 << 16
+	defaultShardHash  = "fnv"
+)
+
+// shardHashes lists the hash functions keys can be sharded with, by their shard-hash name
+var shardHashes = map[string]func() func(key string) uint32{
+	"fnv": func() func(key string) uint32 { return fnvHash },
+	"maphash": func() func(key string) uint32 {
+		seed := maphash.MakeSeed()
+		return func(key string) uint32 { return uint32(maphash.String(seed, key)) }
+	},
+}
+
+// fnvHash is the FNV-1a 32 bit hash
+func fnvHash(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// validShardCount reports whether n can be used as the number of shards
+func validShardCount(n int) bool {
+	return n > 0 && n <= maxShardCount && n&(n-1) == 0
+}
+
+// shardOccupancy is what a shard holds, to spot an uneven distribution of the keys
+type shardOccupancy struct {
+	keys int
+	used int64
+}
+
+// Occupancy returns the number of keys and the memory held by every shard
+func (c *LRUCache) Occupancy() []shardOccupancy {
+	occupancy := make([]shardOccupancy, len(c.shards))
+	for i, shard := range c.shards {
+		shard.mutex.RLock()
+		occupancy[i] = shardOccupancy{keys: len(shard.items), used: shard.used}
+		shard.mutex.RUnlock()
+	}
+	return occupancy
+}
+
+// shardsCommand handles STATS SHARDS, it reports the occupancy of every shard in the
+// style of the redis INFO keyspace section, one line per shard
+func shardsCommand() Value {
+	var b strings.Builder
+	for i, shard := range cache.Occupancy() {
+		fmt.Fprintf(&b, "shard%d:keys=%d,used_memory=%d\r\n", i, shard.keys, shard.used)
+	}
+	return Value{typ: "bulk", bulk: b.String()}
+}
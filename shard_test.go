@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidShardCount(t *testing.T) {
+	tests := []struct {
+		n    int
+		want bool
+	}{
+		{1, true},
+		{2, true},
+		{256, true},
+		{1 << 16, true},
+		{0, false},
+		{-4, false},
+		{3, false},
+		{100, false},
+		{1 << 17, false},
+	}
+	for _, tt := range tests {
+		if got := validShardCount(tt.n); got != tt.want {
+			t.Errorf("validShardCount(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestShardSettingsFromEnv(t *testing.T) {
+	tests := []struct {
+		shards, hash string
+		wantShards   int
+		wantHash     string
+	}{
+		{"", "", defaultShardCount, defaultShardHash},
+		{"1024", "maphash", 1024, "maphash"},
+		{"1", "FNV", 1, "fnv"},
+		{"100", "sha1", defaultShardCount, defaultShardHash},
+		{"0", "", defaultShardCount, defaultShardHash},
+		{"131072", "", defaultShardCount, defaultShardHash},
+		{"many", "", defaultShardCount, defaultShardHash},
+	}
+	for _, tt := range tests {
+		t.Setenv("SHARDS", tt.shards)
+		t.Setenv("SHARD_HASH", tt.hash)
+		c := newCacheFromEnv()
+		if c.shardCount != tt.wantShards || len(c.shards) != tt.wantShards || c.shardHash != tt.wantHash {
+			t.Errorf("SHARDS=%q SHARD_HASH=%q gives %d shards (%d made) hashed with %s, want %d with %s",
+				tt.shards, tt.hash, c.shardCount, len(c.shards), c.shardHash, tt.wantShards, tt.wantHash)
+		}
+		c.Close()
+	}
+}
+
+func TestShardHashes(t *testing.T) {
+	for name := range shardHashes {
+		t.Run(name, func(t *testing.T) {
+			cache = NewLRUCache(0, 64, name)
+			t.Cleanup(cache.Close)
+			runCommands(t, []commandTest{
+				{[]string{"CONFIG", "GET", "shard*"}, "*[shard-hash " + name + " shards 64]"},
+				{[]string{"CONFIG", "SET", "shards", "128"}, "-ERR CONFIG SET failed (possibly related to argument 'shards') - " + errImmutableConfig.Error()},
+			})
+
+			// keys spread evenly over all of the shards
+			for i := 0; i < 10000; i++ {
+				run("SET", "key:"+strconv.Itoa(i), "v")
+			}
+			for i, shard := range cache.Occupancy() {
+				// 156 keys per shard on average
+				if shard.keys < 80 || shard.keys > 250 {
+					t.Errorf("shard %d holds %d of 10000 keys", i, shard.keys)
+				}
+			}
+		})
+	}
+}
+
+func TestMaphashIsSeeded(t *testing.T) {
+	// keys crafted to share an FNV shard don't share a maphash one
+	fnv := NewLRUCache(0, 64, "fnv")
+	defer fnv.Close()
+	var keys []string
+	for i := 0; len(keys) < 100; i++ {
+		if key := "k" + strconv.Itoa(i); fnv.shardIndex(key) == 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	seeded := NewLRUCache(0, 64, "maphash")
+	defer seeded.Close()
+	shards := map[uint32]bool{}
+	for _, key := range keys {
+		shards[seeded.shardIndex(key)] = true
+	}
+	if len(shards) < 32 {
+		t.Fatalf("100 keys of one fnv shard land in only %d maphash shards", len(shards))
+	}
+}
+
+func TestStatsShards(t *testing.T) {
+	cache = NewLRUCache(0, 4, "fnv")
+	t.Cleanup(cache.Close)
+	for i := 0; i < 100; i++ {
+		run("SET", "key:"+strconv.Itoa(i), "v")
+	}
+
+	reply := run("STATS", "SHARDS")
+	lines := strings.Split(strings.TrimSuffix(reply.bulk, "\r\n"), "\r\n")
+	if len(lines) != 4 {
+		t.Fatalf("STATS SHARDS = %q, want a line per shard", reply.bulk)
+	}
+	total := 0
+	for i, line := range lines {
+		occupancy := cache.Occupancy()[i]
+		want := "shard" + strconv.Itoa(i) + ":keys=" + strconv.Itoa(occupancy.keys) + ",used_memory=" + strconv.FormatInt(occupancy.used, 10)
+		if line != want {
+			t.Errorf("line %d = %q, want %q", i, line, want)
+		}
+		total += occupancy.keys
+	}
+	if total != 100 {
+		t.Fatalf("the shards hold %d keys, want 100", total)
+	}
+	if stats := run("STATS").str; !strings.Contains(stats, "Shards: 4,") {
+		t.Fatalf("STATS = %s", stats)
+	}
+}
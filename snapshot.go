@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshots
+//
+// A snapshot is a file holding every key with its value, TTL and recency, so a restarted
+// server comes back with a warm cache. The file starts with a magic string and a format
+// version and ends with a CRC-64 of everything before it:
+//
+//	"GORED" version(1 byte) entry* 0xFF crc64(8 bytes, little endian)
+//
+// Each entry is its value type, the key, expireAt, lastAccess and the LFU counter, then
+// the value (see appendValue). Numbers are varints, strings are length prefixed.
+//
+// The snapshot is a point-in-time copy of the whole cache, taken like the AOF rewrite takes
+// its copy (see capture in propagate.go): shards are encoded into memory one at a time, and
+// a write to a shard that isn't encoded yet encodes it first. Writers only ever wait for one
+// shard to be encoded and never for the disk, and a write to several shards, an MSET or a
+// RENAME, is either all in the file or not at all.
+const (
+	snapshotMagic   = "GORED"
+	snapshotVersion = 1
+	snapshotEOF     = 0xFF
+
+	defaultDBFilename = "dump.gored"
+	defaultSaveRules  = "3600 1 300 100 60 10000" // the redis defaults
+	saveRetryDelay    = 5                         // seconds before a failed background save is retried
+)
+
+// value types in snapshots (and DUMP payloads)
+const (
+	typeString byte = iota
+	typeHash
+	typeList
+	typeSet
+	typeZSet
+)
+
+var (
+	errSaveInProgress = errors.New("ERR Background save already in progress")
+	errBadSnapshot    = errors.New("bad snapshot")
+
+	crcTable = crc64.MakeTable(crc64.ECMA)
+)
+
+// saveRule triggers a background save once at least changes writes happened
+// and seconds have passed since the last save, like redis' "save 900 1"
+type saveRule struct {
+	seconds int64
+	changes int64
+}
+
+// snapshotState is the persistence bookkeeping of a cache
+type snapshotState struct {
+	saving       atomic.Bool
+	lastSave     atomic.Int64 // unix time in seconds of the last successful save
+	lastAttempt  atomic.Int64 // unix time in seconds of the last save, successful or not
+	lastFailed   atomic.Bool  // whether the last save failed
+	savedChanges atomic.Int64 // the change counter at the start of the last successful save
+}
+
+var (
+	dbFilename = newSetting(envOr("dbfilename", defaultDBFilename))
+	saveRules  = saveRulesFromEnv()
+)
+
+// saveRulesFromEnv returns the save rules found in the environment (SAVE="900 1"),
+// or the default ones
+func saveRulesFromEnv() *atomic.Pointer[[]saveRule] {
+	rules, err := parseSaveRules(envOr("save", defaultSaveRules))
+	if err != nil {
+		fmt.Println("Ignoring SAVE:", err)
+		rules, _ = parseSaveRules(defaultSaveRules)
+	}
+	setting := &atomic.Pointer[[]saveRule]{}
+	setting.Store(&rules)
+	return setting
+}
+
+// newSetting returns a string setting that can be changed while it is being read
+func newSetting(value string) *atomic.Pointer[string] {
+	setting := &atomic.Pointer[string]{}
+	setting.Store(&value)
+	return setting
+}
+
+// envOr returns the value of a setting in the environment, or def if it isn't set
+func envOr(param, def string) string {
+	if value, ok := os.LookupEnv(envName(param)); ok {
+		return value
+	}
+	return def
+}
+
+// parseSaveRules parses save rules written the way CONFIG SET save takes them:
+// "3600 1 300 100" is two rules, an empty string disables saving
+func parseSaveRules(s string) ([]saveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save rules %q", s)
+	}
+	rules := make([]saveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("invalid save rules %q", s)
+		}
+		rules = append(rules, saveRule{seconds: seconds, changes: changes})
+	}
+	return rules, nil
+}
+
+// formatSaveRules prints save rules the way CONFIG GET save reports them
+func formatSaveRules(rules []saveRule) string {
+	parts := make([]string, 0, 2*len(rules))
+	for _, rule := range rules {
+		parts = append(parts, strconv.FormatInt(rule.seconds, 10), strconv.FormatInt(rule.changes, 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+// changes returns how many writes the cache has seen, give or take. Every change to the
+// memory accounting or a TTL counts, which is what a snapshot could be missing
+func (c *LRUCache) changes() int64 {
+	var n int64
+	for _, shard := range c.shards {
+		n += shard.stats.changes.Load()
+	}
+	return n
+}
+
+// ChangesSinceSave returns roughly how many writes the last snapshot is missing
+func (c *LRUCache) ChangesSinceSave() int64 {
+	return c.changes() - c.snapshots.savedChanges.Load()
+}
+
+// Save writes a snapshot of the cache to path. The file is written under a temporary
+// name and renamed when complete, so a crash never leaves a half written snapshot behind
+func (c *LRUCache) Save(path string) error {
+	if !c.snapshots.saving.CompareAndSwap(false, true) {
+		return errSaveInProgress
+	}
+	defer c.snapshots.saving.Store(false)
+	return c.save(path)
+}
+
+// BackgroundSave starts a Save in its own goroutine. It only fails when
+// another save is still running
+func (c *LRUCache) BackgroundSave(path string) error {
+	if !c.snapshots.saving.CompareAndSwap(false, true) {
+		return errSaveInProgress
+	}
+	// the goroutine owns the saving flag from here on
+	go func() {
+		defer c.snapshots.saving.Store(false)
+		if err := c.save(path); err != nil {
+			fmt.Println("Background save failed:", err)
+		}
+	}()
+	return nil
+}
+
+// save is Save for callers that set the saving flag
+func (c *LRUCache) save(path string) error {
+	changes := c.changes()
+	err := c.writeSnapshot(path)
+	now := time.Now().Unix()
+	c.snapshots.lastAttempt.Store(now)
+	c.snapshots.lastFailed.Store(err != nil)
+	if err != nil {
+		return err
+	}
+	c.snapshots.lastSave.Store(now)
+	c.snapshots.savedChanges.Store(changes)
+	return nil
+}
+
+func (c *LRUCache) writeSnapshot(path string) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // a no-op once the rename went through
+
+	// snapshot-format picks our own format or the redis one, see rdb.go
+	var crc checksum = crc64.New(crcTable)
+	encode := c.encodeSnapshot
+	if *snapshotFormat.Load() == "rdb" {
+		crc, encode = new(rdbChecksum), c.encodeRDB
+	}
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+	err = encode(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		// the checksum itself isn't part of what it covers
+		_, err = f.Write(binary.LittleEndian.AppendUint64(nil, crc.Sum64()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// encodeSnapshot writes the header and every shard, see the top of the file
+func (c *LRUCache) encodeSnapshot(w io.Writer) error {
+	if _, err := w.Write(append([]byte(snapshotMagic), snapshotVersion)); err != nil {
+		return err
+	}
+
+	entries := c.propagation.snapshot(func(shard *cacheShard) []byte { return shard.appendEntries(nil) })
+	if _, err := w.Write(entries); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{snapshotEOF})
+	return err
+}
+
+// appendEntries encodes the entries of a shard that haven't expired
+func (s *cacheShard) appendEntries(buf []byte) []byte {
+	now := nowMillis()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	// least recently used first, loading them in file order restores the recency
+	for elem := s.evictionQ.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*cacheEntry)
+		if !entry.isExpired(now) {
+			buf = appendEntry(buf, entry)
+		}
+	}
+	return buf
+}
+
+// appendEntry encodes one snapshot entry
+func appendEntry(b []byte, entry *cacheEntry) []byte {
+	b = append(b, valueType(entry.value))
+	b = appendString(b, entry.key)
+	b = binary.AppendVarint(b, entry.expireAt)
+	b = binary.AppendVarint(b, entry.lastAccess)
+	b = append(b, entry.freq)
+	return appendValue(b, entry.value)
+}
+
+// valueType returns the type byte a value is encoded with
+func valueType(value interface{}) byte {
+	switch value.(type) {
+	case hashValue:
+		return typeHash
+	case *listValue:
+		return typeList
+	case setValue:
+		return typeSet
+	case *zsetValue:
+		return typeZSet
+	default:
+		return typeString
+	}
+}
+
+// appendValue encodes a value without its type: a string as is, collections as their
+// number of members followed by the members (field and value for hashes, member and
+// score for sorted sets)
+func appendValue(b []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return appendString(b, v)
+
+	case hashValue:
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for field, value := range v {
+			b = appendString(appendString(b, field), value)
+		}
+
+	case *listValue:
+		b = binary.AppendUvarint(b, uint64(v.size))
+		for i := 0; i < v.size; i++ {
+			b = appendString(b, v.at(i))
+		}
+
+	case setValue:
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for member := range v {
+			b = appendString(b, member)
+		}
+
+	case *zsetValue:
+		b = binary.AppendUvarint(b, uint64(len(v.dict)))
+		for member, score := range v.dict {
+			b = binary.LittleEndian.AppendUint64(appendString(b, member), math.Float64bits(score))
+		}
+	}
+	return b
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+// decoder reads what appendEntry and appendValue wrote
+type decoder struct {
+	r   *bufio.Reader
+	err error // the first error, after it every read returns zero values
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(d.r)
+	d.fail(err)
+	return n
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(d.r)
+	d.fail(err)
+	return n
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.r.ReadByte()
+	d.fail(err)
+	return b
+}
+
+// count reads the number of members of a collection or the length of a string.
+// Anything this big can only come from a corrupted payload
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > math.MaxInt32 {
+		d.fail(errBadSnapshot)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) string() string {
+	n := d.count()
+	if d.err != nil {
+		return ""
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(d.r, buf)
+	d.fail(err)
+	return string(buf)
+}
+
+func (d *decoder) float() float64 {
+	if d.err != nil {
+		return 0
+	}
+	var buf [8]byte
+	_, err := io.ReadFull(d.r, buf[:])
+	d.fail(err)
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf[:]))
+}
+
+func (d *decoder) fail(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if d.err == nil && err != nil {
+		d.err = err
+	}
+}
+
+// entry reads the rest of an entry whose type byte was already read
+func (d *decoder) entry(typ byte) *cacheEntry {
+	entry := &cacheEntry{key: d.string()}
+	entry.expireAt = d.varint()
+	entry.lastAccess = d.varint()
+	entry.freq = d.byte()
+	entry.value = d.value(typ)
+	return entry
+}
+
+// value reads a value of the given type
+func (d *decoder) value(typ byte) interface{} {
+	switch typ {
+	case typeString:
+		return d.string()
+
+	case typeHash:
+		n := d.count()
+		h := make(hashValue, min(n, 1024))
+		for i := 0; i < n && d.err == nil; i++ {
+			field := d.string()
+			h[field] = d.string()
+		}
+		return h
+
+	case typeList:
+		n := d.count()
+		items := make([]string, 0, min(n, 1024))
+		for i := 0; i < n && d.err == nil; i++ {
+			items = append(items, d.string())
+		}
+		l := &listValue{}
+		l.replace(items)
+		return l
+
+	case typeSet:
+		n := d.count()
+		s := make(setValue, min(n, 1024))
+		for i := 0; i < n && d.err == nil; i++ {
+			s[d.string()] = struct{}{}
+		}
+		return s
+
+	case typeZSet:
+		n := d.count()
+		z := newZSet()
+		for i := 0; i < n && d.err == nil; i++ {
+			member := d.string()
+			score := d.float()
+			if math.IsNaN(score) {
+				d.fail(errBadSnapshot)
+				break
+			}
+			z.set(member, score)
+		}
+		return z
+	}
+	d.fail(fmt.Errorf("%w: unknown value type %d", errBadSnapshot, typ))
+	return nil
+}
+
+// Load replaces the keys found in a snapshot file, skipping the ones that expired in the
+// meantime. The checksum is verified before anything is loaded, a damaged file leaves the
+// cache alone. Redis RDB files are loaded too. It returns the number of keys loaded
+func (c *LRUCache) Load(path string) (int, error) {
+	if isRDB(path) {
+		return c.LoadRDB(path)
+	}
+	if err := verifySnapshot(path); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	d := &decoder{r: bufio.NewReader(f)}
+	d.r.Discard(len(snapshotMagic) + 1)
+
+	loaded := 0
+	now := nowMillis()
+	for {
+		typ := d.byte()
+		if d.err != nil || typ == snapshotEOF {
+			break
+		}
+		entry := d.entry(typ)
+		if d.err != nil {
+			break
+		}
+		if entry.isExpired(now) || entry.isEmpty() {
+			continue
+		}
+		c.restoreEntry(entry)
+		loaded++
+	}
+	if d.err != nil {
+		return loaded, fmt.Errorf("%s: %w", path, d.err)
+	}
+
+	c.sortByRecency()
+	return loaded, nil
+}
+
+// restoreEntry stores a loaded entry, replacing whatever the key held. Its recency
+// and LFU counter are the ones that were saved
+func (c *LRUCache) restoreEntry(entry *cacheEntry) {
+	shard := c.getShard(entry.key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if elem, ok := shard.items[entry.key]; ok {
+		shard.removeElement(elem)
+	}
+	lastAccess, freq := entry.lastAccess, entry.freq
+	c.addEntry(shard, entry)
+	entry.lastAccess, entry.freq = lastAccess, freq
+}
+
+// sortByRecency puts every shard's recency list in lastAccess order. Snapshots keep the
+// order of each shard, but a cache with a different shard count or hash mixes the keys
+// of several saved shards into one
+func (c *LRUCache) sortByRecency() {
+	for _, shard := range c.shards {
+		shard.mutex.Lock()
+		elems := make([]*list.Element, 0, shard.evictionQ.Len())
+		for elem := shard.evictionQ.Back(); elem != nil; elem = elem.Prev() {
+			elems = append(elems, elem)
+		}
+		// stable, entries saved within the same millisecond keep their file order
+		sort.SliceStable(elems, func(i, j int) bool {
+			return elems[i].Value.(*cacheEntry).lastAccess < elems[j].Value.(*cacheEntry).lastAccess
+		})
+		for _, elem := range elems {
+			shard.evictionQ.MoveToFront(elem)
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// verifySnapshot checks the header and the checksum of a snapshot file
+func verifySnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size() - 8
+	if size < int64(len(snapshotMagic))+2 {
+		return fmt.Errorf("%s: %w: file too short", path, errBadSnapshot)
+	}
+
+	r := bufio.NewReader(f)
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("%s: %w: not a snapshot", path, errBadSnapshot)
+	}
+	if header[len(snapshotMagic)] > snapshotVersion {
+		return fmt.Errorf("%s: %w: version %d is newer than %d", path, errBadSnapshot, header[len(snapshotMagic)], snapshotVersion)
+	}
+
+	crc := crc64.New(crcTable)
+	crc.Write(header)
+	if _, err := io.CopyN(crc, r, size-int64(len(header))); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	if _, err := io.ReadFull(r, trailer[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(trailer[:]) != crc.Sum64() {
+		return fmt.Errorf("%s: %w: checksum mismatch", path, errBadSnapshot)
+	}
+	return nil
+}
+
+// loadSnapshot loads the snapshot file at startup, if there is one
+func loadSnapshot() {
+	path := *dbFilename.Load()
+	start := time.Now()
+	n, err := cache.Load(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return
+	case err != nil:
+		fmt.Println("Error loading snapshot:", err)
+	default:
+		fmt.Printf("Loaded %d keys from %s in %v\n", n, path, time.Since(start))
+	}
+	cache.snapshots.lastSave.Store(time.Now().Unix())
+	cache.snapshots.savedChanges.Store(cache.changes())
+}
+
+// runSaveRules starts a background save whenever one of the save rules is met
+func runSaveRules() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now().Unix()
+		state := &cache.snapshots
+		if state.lastFailed.Load() && now-state.lastAttempt.Load() < saveRetryDelay {
+			continue
+		}
+
+		changes := cache.ChangesSinceSave()
+		for _, rule := range *saveRules.Load() {
+			if changes >= rule.changes && changes > 0 && now-state.lastSave.Load() >= rule.seconds {
+				cache.BackgroundSave(*dbFilename.Load())
+				break
+			}
+		}
+	}
+}
+
+// saveOnShutdown saves a last snapshot before the server exits, if saving is enabled
+func saveOnShutdown() {
+	if len(*saveRules.Load()) == 0 {
+		return
+	}
+	fmt.Println("Saving the final snapshot before exiting")
+	for cache.Save(*dbFilename.Load()) == errSaveInProgress {
+		// a background save just started, the final one has to include what came after it
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// saveCommand handles SAVE and BGSAVE
+func saveCommand(cmd string, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	if cmd == "BGSAVE" {
+		if err := cache.BackgroundSave(*dbFilename.Load()); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		return Value{typ: "string", str: "Background saving started"}
+	}
+
+	if err := cache.Save(*dbFilename.Load()); err != nil {
+		if err == errSaveInProgress {
+			return Value{typ: "error", str: err.Error()}
+		}
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// lastsaveCommand handles LASTSAVE, the unix time of the last successful save
+func lastsaveCommand(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'LASTSAVE' command"}
+	}
+	return Value{typ: "integer", num: int(cache.snapshots.lastSave.Load())}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTestDBFilename points dbfilename at a file in a temporary directory for the test
+func useTestDBFilename(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dump.gored")
+	old := dbFilename.Load()
+	dbFilename.Store(&path)
+	t.Cleanup(func() { dbFilename.Store(old) })
+	return path
+}
+
+// waitForSave waits until no background save is running
+func waitForSave(t *testing.T, c *LRUCache) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); c.snapshots.saving.Load(); {
+		if time.Now().After(deadline) {
+			t.Fatal("the background save doesn't finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSnapshotIsPointInTime(t *testing.T) {
+	for _, format := range []string{"gored", "rdb"} {
+		t.Run(format, func(t *testing.T) {
+			old := snapshotFormat.Load()
+			snapshotFormat.Store(&format)
+			t.Cleanup(func() { snapshotFormat.Store(old) })
+
+			live := newTestCache(t, 0)
+			path := filepath.Join(t.TempDir(), "dump")
+			// enough keys that the writers get to run while the shards are encoded
+			for i := 0; i < 50000; i++ {
+				run("SET", "key:"+strconv.Itoa(i), "v")
+			}
+
+			// every writer sets first:w before second:w and both halves of an MSET, so at
+			// any point in time first >= second and the halves are equal
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w string) {
+					defer wg.Done()
+					for i := 1; ; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						n := strconv.Itoa(i)
+						run("SET", "first:"+w, n)
+						run("SET", "second:"+w, n)
+						run("MSET", "a:"+w, n, "b:"+w, n)
+					}
+				}(strconv.Itoa(w))
+			}
+			defer func() {
+				close(stop)
+				wg.Wait()
+			}()
+
+			for r := 0; r < 5; r++ {
+				if err := live.Save(path); err != nil {
+					t.Fatal(err)
+				}
+				loaded := NewLRUCache(0, 16, "fnv")
+				if _, err := loaded.Load(path); err != nil {
+					t.Fatal(err)
+				}
+				for w := 0; w < 4; w++ {
+					get := func(key string) int {
+						v, _, _ := loaded.Get(key + strconv.Itoa(w))
+						n, _ := strconv.Atoi(v)
+						return n
+					}
+					if first, second := get("first:"), get("second:"); first < second {
+						t.Fatalf("save %d has second:%d = %d but first:%d = %d, set before it", r, w, second, w, first)
+					}
+					if a, b := get("a:"), get("b:"); a != b {
+						t.Fatalf("save %d has half of an MSET: a:%d = %d, b:%d = %d", r, w, a, w, b)
+					}
+				}
+				loaded.Close()
+			}
+		})
+	}
+}
+
+func TestBackgroundSaveInProgress(t *testing.T) {
+	live := newTestCache(t, 0)
+	useTestDBFilename(t)
+	for i := 0; i < 100000; i++ {
+		run("SET", "key:"+strconv.Itoa(i), "v")
+	}
+
+	if reply := run("BGSAVE"); reply.str != "Background saving started" {
+		t.Fatalf("BGSAVE = %+v", reply)
+	}
+	// the first save runs for a while, the second BGSAVE has to be refused and not dropped
+	if reply := run("BGSAVE"); reply.typ != "error" || reply.str != errSaveInProgress.Error() {
+		t.Fatalf("second BGSAVE = %+v, want %q", reply, errSaveInProgress)
+	}
+	if reply := run("SAVE"); reply.typ != "error" || reply.str != errSaveInProgress.Error() {
+		t.Fatalf("SAVE during a BGSAVE = %+v, want %q", reply, errSaveInProgress)
+	}
+	waitForSave(t, live)
+	if reply := run("BGSAVE"); reply.str != "Background saving started" {
+		t.Fatalf("BGSAVE after the first one finished = %+v", reply)
+	}
+	waitForSave(t, live)
+}
+
+// fillAllTypes writes a key of every type, with and without TTLs
+func fillAllTypes(t *testing.T) {
+	t.Helper()
+	runCommands(t, []commandTest{
+		{[]string{"SET", "str", "hello"}, "+OK"},
+		{[]string{"SET", "empty", ""}, "+OK"},
+		{[]string{"SET", "binary", "a\r\n\x00\xff"}, "+OK"},
+		{[]string{"SET", "ttl", "v", "EX", "1000"}, "+OK"},
+		{[]string{"SET", "short", "v", "PX", "100"}, "+OK"},
+		{[]string{"RPUSH", "list", "a", "b", "", "c"}, ":4"},
+		{[]string{"HSET", "hash", "f1", "v1", "f2", "v2"}, ":2"},
+		{[]string{"SADD", "set", "x", "y", "z"}, ":3"},
+		{[]string{"ZADD", "zset", "1.5", "a", "-inf", "b", "inf", "c"}, ":3"},
+		{[]string{"EXPIRE", "hash", "2000"}, ":1"},
+	})
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	live := newTestCache(t, 0)
+	fillAllTypes(t)
+	for i := 0; i < 1000; i++ {
+		run("SET", "key:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	path := filepath.Join(t.TempDir(), "dump.gored")
+	if err := live.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	want := cacheContent(live)
+	delete(want, "short") // it runs out before the snapshot is loaded
+	time.Sleep(150 * time.Millisecond)
+
+	// a cache with another shard count and hash gets every key back
+	cache = NewLRUCache(0, 4, "maphash")
+	t.Cleanup(cache.Close)
+	n, err := cache.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Errorf("loaded %d keys, want %d", n, len(want))
+	}
+	checkContent(t, cache, want)
+	runCommands(t, []commandTest{
+		{[]string{"TTL", "ttl"}, ":1000"},
+		{[]string{"TTL", "hash"}, ":2000"},
+		{[]string{"TTL", "str"}, ":-1"},
+		{[]string{"GET", "empty"}, "$"},
+	})
+}
+
+func TestSnapshotKeepsRecency(t *testing.T) {
+	live := NewLRUCache(0, 1, "fnv")
+	defer live.Close()
+	cache = live
+	for i := 0; i < 20; i++ {
+		run("SET", "key:"+strconv.Itoa(i), "v")
+		time.Sleep(time.Millisecond)
+	}
+	run("GET", "key:3") // the most recently used now
+	path := filepath.Join(t.TempDir(), "dump.gored")
+	if err := live.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	order := func(c *LRUCache) []string {
+		var keys []string
+		for elem := c.shards[0].evictionQ.Front(); elem != nil; elem = elem.Next() {
+			keys = append(keys, elem.Value.(*cacheEntry).key)
+		}
+		return keys
+	}
+	loaded := NewLRUCache(0, 1, "fnv")
+	defer loaded.Close()
+	if _, err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := order(loaded), order(live); !slices.Equal(got, want) {
+		t.Fatalf("recency after loading = %v, want %v", got, want)
+	}
+}
+
+func TestSnapshotRejectsDamage(t *testing.T) {
+	live := newTestCache(t, 0)
+	fillAllTypes(t)
+	path := filepath.Join(t.TempDir(), "dump.gored")
+	if err := live.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	good, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damage := func(f func(b []byte) []byte) []byte { return f(slices.Clone(good)) }
+	tests := []struct {
+		name string
+		file []byte
+		want string
+	}{
+		{"flipped bit", damage(func(b []byte) []byte { b[len(b)/2] ^= 1; return b }), "checksum mismatch"},
+		{"bad checksum", damage(func(b []byte) []byte { b[len(b)-1]++; return b }), "checksum mismatch"},
+		{"truncated", good[:len(good)-20], "checksum mismatch"},
+		{"empty", nil, "file too short"},
+		{"not a snapshot", damage(func(b []byte) []byte { copy(b, "NOPE!"); return b }), "not a snapshot"},
+		{"newer version", damage(func(b []byte) []byte { b[len(snapshotMagic)] = snapshotVersion + 1; return b }), "is newer than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := filepath.Join(t.TempDir(), "dump.gored")
+			if err := os.WriteFile(damaged, tt.file, 0644); err != nil {
+				t.Fatal(err)
+			}
+			c := NewLRUCache(0, 16, "fnv")
+			defer c.Close()
+			c.Put("untouched", "v", putOptions{})
+
+			n, err := c.Load(damaged)
+			if !errors.Is(err, errBadSnapshot) || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Load = %v, want a bad snapshot error with %q", err, tt.want)
+			}
+			// nothing is loaded from a damaged file
+			if content := cacheContent(c); n != 0 || len(content) != 1 {
+				t.Fatalf("loaded %d keys from a damaged file, the cache holds %v", n, content)
+			}
+		})
+	}
+}
+
+func TestSaveBookkeeping(t *testing.T) {
+	live := newTestCache(t, 0)
+	path := useTestDBFilename(t)
+	runCommands(t, []commandTest{
+		{[]string{"SET", "a", "1"}, "+OK"},
+		{[]string{"SAVE", "now"}, "-ERR wrong number of arguments for 'SAVE' command"},
+	})
+	if live.ChangesSinceSave() == 0 {
+		t.Fatal("no changes counted for a SET")
+	}
+	before := time.Now().Unix()
+	runCommands(t, []commandTest{{[]string{"SAVE"}, "+OK"}})
+	if n := live.ChangesSinceSave(); n != 0 {
+		t.Fatalf("%d changes since a SAVE without writes", n)
+	}
+	if last := run("LASTSAVE").num; int64(last) < before {
+		t.Fatalf("LASTSAVE = %d, the save happened at %d", last, before)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed save is reported and leaves the last good one alone
+	bad := filepath.Join(t.TempDir(), "missing", "dump.gored")
+	dbFilename.Store(&bad)
+	run("SET", "b", "2")
+	if reply := run("SAVE"); reply.typ != "error" || !strings.HasPrefix(reply.str, "ERR ") {
+		t.Fatalf("SAVE into a missing directory = %+v", reply)
+	}
+	if !live.snapshots.lastFailed.Load() || live.ChangesSinceSave() == 0 {
+		t.Fatal("the failed save was counted as a successful one")
+	}
+}
+
+func TestParseSaveRules(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []saveRule
+		ok   bool
+	}{
+		{"", []saveRule{}, true},
+		{"3600 1", []saveRule{{3600, 1}}, true},
+		{" 3600 1  300 100 ", []saveRule{{3600, 1}, {300, 100}}, true},
+		{"60 0", []saveRule{{60, 0}}, true},
+		{"3600", nil, false},
+		{"0 1", nil, false},
+		{"60 -1", nil, false},
+		{"hour 1", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSaveRules(tt.in)
+		if (err == nil) != tt.ok || !slices.Equal(got, tt.want) {
+			t.Errorf("parseSaveRules(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+		if err == nil && formatSaveRules(got) != strings.Join(strings.Fields(tt.in), " ") {
+			t.Errorf("formatSaveRules(%v) = %q", got, formatSaveRules(got))
+		}
+	}
+}
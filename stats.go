@@ -0,0 +1,40 @@
+package main
+
+import "sync/atomic"
+
+// shardStats are the operation counters of one shard. Counting per shard instead of in
+// one place keeps the hot path from serializing every shard on a single lock or cache
+// line, Stats adds them up when somebody asks. They are atomic since a lot of them are
+// bumped with only the shard read lock held, or none at all
+type shardStats struct {
+	gets      atomic.Int64 // read operations
+	puts      atomic.Int64 // write operations
+	hits      atomic.Int64 // reads that found their key
+	misses    atomic.Int64 // reads that didn't
+	evictions atomic.Int64 // keys evicted to stay within maxmemory
+	expired   atomic.Int64 // keys dropped because their TTL ran out
+	changes   atomic.Int64 // writes, roughly, for the snapshot save rules
+}
+
+// countLookup updates the hit/miss statistics after a read
+func (s *cacheShard) countLookup(hit bool) {
+	if hit {
+		s.stats.hits.Add(1)
+	} else {
+		s.stats.misses.Add(1)
+	}
+}
+
+// totals adds up the counters of every shard. The sum isn't a snapshot, counters keep
+// moving while we walk the shards, which is fine for statistics
+func (c *LRUCache) totals() (gets, puts, hits, misses, evictions, expired int64) {
+	for _, shard := range c.shards {
+		gets += shard.stats.gets.Load()
+		puts += shard.stats.puts.Load()
+		hits += shard.stats.hits.Load()
+		misses += shard.stats.misses.Load()
+		evictions += shard.stats.evictions.Load()
+		expired += shard.stats.expired.Load()
+	}
+	return
+}
@@ -2,197 +2,470 @@ package main
 
 import (
 	"container/list"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // LRUCache represents our cache with a doubly linked list for recency tracking
 // and a map for O(1) lookups. This helps us maintain both speed and memory efficiency
 // it is similar to a linkedhashmap in java
 type LRUCache struct {
-	capacity   int                      // max number of items before eviction
-	items      map[string]*list.Element // for O(1) lookups
-	evictionQ  *list.List               // tracks usage order for eviction
-	mutex      sync.RWMutex             // protects concurrent access
-	hitCount   int                      // tracks cache hits for stats
-	missCount  int                      // tracks cache misses for stats
-	totalGets  int                      // tracks total get operations
-	totalPuts  int                      // tracks total put operations
-	evictions  int                      // tracks how many items we've kicked out
-	shardCount int                      // number of shards for the cache
-	shards     []*cacheShard            // array of shards
-	shardMask  uint32                   // bitmask used for shard selection
+	maxMemory    atomic.Int64                   // memory budget in bytes, 0 means no limit
+	policy       atomic.Pointer[evictionPolicy] // decides what to evict once maxMemory is reached
+	admission    atomic.Pointer[tinyLFU]        // W-TinyLFU admission filter, nil when disabled
+	bufferReads  atomic.Bool                    // the read-buffer storage engine, see readbuffer.go
+	windowMemory atomic.Int64                   // bytes held by entries in the admission window
+	usedMemory   atomic.Int64                   // approximate bytes held by all entries, see memoryUsage
+	items        map[string]*list.Element       // for O(1) lookups
+	evictionQ    *list.List                     // tracks usage order for eviction
+	shardCount   int                            // number of shards for the cache
+	shards       []*cacheShard                  // array of shards
+	shardMask    uint32                         // bitmask used for shard selection
+	shardHash    string                         // name of the hash keys are sharded with, see shard.go
+	hash         func(key string) uint32        // the shard hash itself
+	done         chan struct{}                  // closed to stop the background expiry sweepers
+	lazyFree     chan *cacheEntry               // entries removed by UNLINK, released by a background goroutine
+	waiters      listWaiters                    // clients blocked in BLPOP/BRPOP/BLMOVE
+	snapshots    snapshotState                  // SAVE/BGSAVE bookkeeping, see snapshot.go
+	aof          *appendOnlyFile                // the append only file, nil when disabled. Set once at startup
+	propagation  *propagator                    // orders the writes for the append only file and replicas
+	replication  replicationState               // role, replication stream and links, see replication.go
 }
 
 // cacheShard represents a portion of the cache to reduce lock contention. lock contention can cause performance issues
 // when multiple goroutines are trying to access the same data structure at the same time
 type cacheShard struct {
 	items     map[string]*list.Element
+	expires   map[string]*list.Element // only the keys that carry a TTL, sampled by the sweeper
 	evictionQ *list.List
+	used      int64      // approximate bytes held by the shard's entries
+	window    *list.List // elements of entries in the admission window, most recently used first
+	cache     *LRUCache  // the cache the shard belongs to, for the cache wide accounting
 	mutex     sync.RWMutex
+	stats     shardStats // operation counters, summed up by Stats
+	reads     readBuffer // hits waiting to be replayed by the read-buffer engine
+	scan      scanIndex  // the keys in SCAN order, see scan.go
 }
 
-// cacheEntry represents a key-value pair in our cache
+// cacheEntry represents a key-value pair in our cache. The value is either a plain
+// string or one of the collection types (hashValue, *listValue, setValue, *zsetValue)
 type cacheEntry struct {
-	key   string
-	value string
+	key        string
+	value      interface{}
+	expireAt   int64 // unix time in milliseconds, 0 means the key never expires
+	size       int64 // the memory this entry was last accounted with in shard.used
+	lastAccess int64 // unix time in milliseconds of the last touch, compared across shards on eviction
+	freq       uint8 // logarithmic access counter for the LFU policies, decays over time
+
+	windowElem *list.Element // the entry's place in shard.window, nil once it made it to the main area
+	scanSlot   int           // the entry's place in its bucket of shard.scan
 }
 
-// NewLRUCache creates a new cache with the given capacity
-// We're using 256 shards by default which is a good balance for most workloads
-func NewLRUCache(capacity int) *LRUCache {
-	// Default to 256 shards - power of 2 for efficient modulo with bitwise AND
-	shardCount := 256
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// typeName returns the name TYPE reports for the entry's value
+func (e *cacheEntry) typeName() string {
+	switch e.value.(type) {
+	case hashValue:
+		return "hash"
+	case *listValue:
+		return "list"
+	case setValue:
+		return "set"
+	case *zsetValue:
+		return "zset"
+	default:
+		return "string"
+	}
+}
+
+// isEmpty reports whether a collection has no members left. Redis never keeps
+// empty collections around, so such entries get deleted
+func (e *cacheEntry) isEmpty() bool {
+	switch v := e.value.(type) {
+	case hashValue:
+		return len(v) == 0
+	case *listValue:
+		return v.size == 0
+	case setValue:
+		return len(v) == 0
+	case *zsetValue:
+		return len(v.dict) == 0
+	default:
+		return false
+	}
+}
+
+// stringValue returns the value of a string entry, or errWrongType for collections
+func (e *cacheEntry) stringValue() (string, error) {
+	s, ok := e.value.(string)
+	if !ok {
+		return "", errWrongType
+	}
+	return s, nil
+}
+
+// NewLRUCache creates a new cache with the given memory budget in bytes (0 for no limit),
+// spreading the keys over shardCount shards with the named hash (see shard.go). The shard
+// count has to be a power of two for efficient modulo with bitwise AND
+func NewLRUCache(maxMemory int64, shardCount int, shardHash string) *LRUCache {
 	cache := &LRUCache{
-		capacity:   capacity,
 		shardCount: shardCount,
 		shardMask:  uint32(shardCount - 1),
+		shardHash:  shardHash,
+		hash:       shardHashes[shardHash](),
 		shards:     make([]*cacheShard, shardCount),
+		done:       make(chan struct{}),
+		lazyFree:   make(chan *cacheEntry, lazyFreeBacklog),
 	}
+	cache.waiters.byKey = make(map[string]*list.List)
+	cache.propagation = newPropagator(cache)
+	cache.replication.init()
+	cache.maxMemory.Store(maxMemory)
+	cache.SetPolicy(defaultPolicy)
 
 	// initialize each shard
 	for i := 0; i < shardCount; i++ {
 		cache.shards[i] = &cacheShard{
 			items:     make(map[string]*list.Element),
+			expires:   make(map[string]*list.Element),
 			evictionQ: list.New(),
+			window:    list.New(),
+			cache:     cache,
 			mutex:     sync.RWMutex{},
 		}
 	}
 
+	// every shard gets its own sweeper so expired keys nobody reads again still get freed
+	for i := range cache.shards {
+		go cache.runSweeper(uint32(i))
+	}
+	go cache.runLazyFree()
+
 	return cache
 }
 
+// Close stops the background sweepers and the lazy free goroutine. The cache itself stays usable,
+// expired keys are then only removed lazily when they are touched.
+func (c *LRUCache) Close() {
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+}
+
 // getShard returns the appropriate shard for a given key
-// We use a simple hash function to distribute keys evenly
 func (c *LRUCache) getShard(key string) *cacheShard {
-	// FNV-1a hash for good distribution
-	h := uint32(2166136261)
-	for i := 0; i < len(key); i++ {
-		h ^= uint32(key[i])
-		h *= 16777619
-	}
+	return c.shards[c.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard a key lives in. Multi-key commands
+// use it to lock shards in a consistent order
+func (c *LRUCache) shardIndex(key string) uint32 {
 	// Use bitmask for efficient modulo with power of 2
-	return c.shards[h&c.shardMask]
+	return c.hash(key) & c.shardMask
 }
 
-// put adds a key-value pair to the cache
-func (c *LRUCache) Put(key, value string) {
-	// count this operation
-	c.mutex.Lock()
-	c.totalPuts++
-	c.mutex.Unlock()
+// putOptions mirrors the options of the SET command so Put can apply them
+// atomically under the shard lock
+type putOptions struct {
+	expireAt      int64 // unix time in milliseconds, 0 stores the key without a TTL
+	keepTTL       bool  // keep the TTL of the old value instead of clearing it (KEEPTTL)
+	onlyIfMissing bool  // only write when the key does not exist (NX)
+	onlyIfExists  bool  // only write when the key already exists (XX)
+	getOld        bool  // the caller wants the old value back (GET), it has to be a string
+}
 
+// put adds a key-value pair to the cache, replacing whatever type was stored before.
+// Without keepTTL any TTL the old value had is cleared, like redis SET does. It returns
+// the old value, whether there was one and whether the new value was actually written
+// (NX/XX can prevent that). With getOld an old value that is not a string is an error
+func (c *LRUCache) Put(key, value string, opts putOptions) (old string, existed, written bool, err error) {
 	shard := c.getShard(key)
+	shard.stats.puts.Add(1)
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
 
 	// check if the key exists
-	if _, ok := shard.items[key]; ok {
+	elem, ok := c.liveElement(shard, key)
+	if ok && opts.getOld {
+		if old, err = elem.Value.(*cacheEntry).stringValue(); err != nil {
+			return "", true, false, err
+		}
+	}
+
+	// the NX/XX conditions are checked under the same lock as the write
+	if (opts.onlyIfMissing && ok) || (opts.onlyIfExists && !ok) {
+		return old, ok, false, nil
+	}
+
+	if ok {
 		// update existing entry
-		shard.evictionQ.MoveToFront(shard.items[key])
-		shard.items[key].Value.(*cacheEntry).value = value
-		return
+		entry := elem.Value.(*cacheEntry)
+		shard.touch(elem)
+		entry.value = value
+		if !opts.keepTTL {
+			shard.setExpire(elem, opts.expireAt)
+		}
+		c.reweigh(shard, elem)
+		return old, true, true, nil
 	}
 
 	// adding new entry
-	entry := &cacheEntry{key: key, value: value}
+	c.addEntry(shard, &cacheEntry{key: key, value: value, expireAt: opts.expireAt})
+	return "", false, true, nil
+}
+
+// addEntry inserts a new entry at the front of the shard and charges its memory.
+// Callers must hold the shard write lock and make sure the key is not in the shard yet
+func (c *LRUCache) addEntry(shard *cacheShard, entry *cacheEntry) *list.Element {
 	elem := shard.evictionQ.PushFront(entry)
-	shard.items[key] = elem
-	// checking if we need to evict
-	if shard.evictionQ.Len() > c.capacity/c.shardCount {
-		c.evictFromShard(shard)
+	shard.items[entry.key] = elem
+	shard.scan.add(entry)
+	shard.setExpire(elem, entry.expireAt)
+	entry.lastAccess = nowMillis()
+	entry.freq = lfuInitVal
+	if c.AdmissionEnabled() {
+		entry.windowElem = shard.window.PushFront(elem)
 	}
+	c.recordAccess(entry.key)
+	entry.size = entry.memoryUsage()
+	shard.account(entry, entry.size)
+	return elem
 }
 
-// evictFromShard removes the least recently used item from a shard
-func (c *LRUCache) evictFromShard(shard *cacheShard) {
-	// get the oldest element
-	elem := shard.evictionQ.Back()
-	if elem != nil {
-		// removing from list and map
-		shard.evictionQ.Remove(elem)
-		entry := elem.Value.(*cacheEntry)
-		delete(shard.items, entry.key)
+// reweigh updates the memory accounting after the value of an entry changed in place
+// (a hash gained or lost fields, a string got longer, ...). Callers must hold the shard
+// write lock
+func (c *LRUCache) reweigh(shard *cacheShard, elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	size := entry.memoryUsage()
+	shard.account(entry, size-entry.size)
+	entry.size = size
+}
 
-		// Update eviction stats
-		c.mutex.Lock()
-		c.evictions++
-		c.mutex.Unlock()
+// removeElement unlinks an entry from the recency list and both maps.
+// Callers must hold the shard write lock
+func (s *cacheShard) removeElement(elem *list.Element) {
+	entry := s.evictionQ.Remove(elem).(*cacheEntry)
+	delete(s.items, entry.key)
+	delete(s.expires, entry.key)
+	s.scan.remove(entry)
+	s.account(entry, -entry.size)
+	if entry.windowElem != nil {
+		s.window.Remove(entry.windowElem)
+		entry.windowElem = nil
 	}
 }
 
-// get retrieves a value for the given key
-func (c *LRUCache) Get(key string) (string, bool) {
-	// count this operation
-	c.mutex.Lock()
-	c.totalGets++
-	c.mutex.Unlock()
-
+// get retrieves a value for the given key, it fails with errWrongType
+// if the key holds a collection instead of a string
+func (c *LRUCache) Get(key string) (string, bool, error) {
 	shard := c.getShard(key)
+	shard.stats.gets.Add(1)
 	shard.mutex.RLock()
 	elem, ok := shard.items[key]
 
 	// If key doesn't exist, return not found
 	if !ok {
 		shard.mutex.RUnlock()
-		c.mutex.Lock()
-		c.missCount++
-		c.mutex.Unlock()
-		return "", false
+		// misses count for admission too, a key that is asked for a lot deserves a place
+		c.recordAccess(key)
+		shard.countLookup(false)
+		return "", false, nil
+	}
+
+	// keys whose TTL ran out are treated as missing and removed right away
+	entry := elem.Value.(*cacheEntry)
+	if entry.isExpired(nowMillis()) {
+		shard.mutex.RUnlock()
+		c.expireKey(shard, key)
+		shard.countLookup(false)
+		return "", false, nil
 	}
 
 	// Get value before upgrading lock
-	value := elem.Value.(*cacheEntry).value
+	value, err := entry.stringValue()
+	if err == nil && c.bufferReads.Load() {
+		// the read-buffer engine only takes the write lock once per batch of hits
+		full := shard.reads.record(elem)
+		shard.mutex.RUnlock()
+		if full {
+			shard.mutex.Lock()
+			shard.drainReads(nil)
+			shard.mutex.Unlock()
+		}
+		shard.countLookup(true)
+		return value, true, nil
+	}
 	shard.mutex.RUnlock()
+	if err != nil {
+		return "", true, err
+	}
 
-	// Move to front - requires write lock
+	// Move to front - requires write lock. Between the two locks the key may have been
+	// deleted, evicted or replaced, then its element is gone and there is nothing to move.
+	// The value we read is still what the key held at the time of the lookup
 	shard.mutex.Lock()
-	shard.evictionQ.MoveToFront(elem)
+	if current, ok := shard.items[key]; ok && current == elem {
+		shard.touch(elem)
+	}
 	shard.mutex.Unlock()
 
-	// Update hit stats
-	c.mutex.Lock()
-	c.hitCount++
-	c.mutex.Unlock()
+	shard.countLookup(true)
+	return value, true, nil
+}
+
+// newCollection returns an empty value of the given collection type
+func newCollection(typ string) interface{} {
+	switch typ {
+	case "hash":
+		return make(hashValue)
+	case "list":
+		return &listValue{}
+	case "set":
+		return make(setValue)
+	case "zset":
+		return newZSet()
+	default:
+		return ""
+	}
+}
+
+// mutate is the read-modify-write primitive for collection types. fn runs under the shard
+// write lock with the entry stored at key, which has to hold a value of type typ or the
+// call fails with errWrongType. A missing key is created empty when create is set,
+// otherwise fn gets a nil entry. Afterwards a collection left empty is deleted and the
+// memory accounting is updated. fn must not change anything if it returns an error
+func (c *LRUCache) mutate(key, typ string, create bool, fn func(entry *cacheEntry) error) error {
+	shard := c.getShard(key)
+	shard.stats.puts.Add(1)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	elem, ok := c.liveElement(shard, key)
+	var entry *cacheEntry
+	if ok {
+		entry = elem.Value.(*cacheEntry)
+		if entry.typeName() != typ {
+			return errWrongType
+		}
+	} else if create {
+		entry = &cacheEntry{key: key, value: newCollection(typ)}
+	}
+
+	if err := fn(entry); err != nil {
+		return err
+	}
+	if entry == nil {
+		return nil
+	}
 
-	return value, true
+	switch {
+	case entry.isEmpty():
+		// redis never keeps empty collections around
+		if ok {
+			shard.removeElement(elem)
+		}
+	case ok:
+		shard.touch(elem)
+		c.reweigh(shard, elem)
+	default:
+		c.addEntry(shard, entry)
+	}
+	return nil
+}
+
+// view runs fn with the entry stored at key (nil if there is none) for commands
+// that only read a collection. Like Get, a hit moves the key to the front
+func (c *LRUCache) view(key, typ string, fn func(entry *cacheEntry)) error {
+	shard := c.getShard(key)
+	shard.stats.gets.Add(1)
+	shard.mutex.Lock()
+	elem, ok := c.readElement(shard, key)
+	if ok && elem.Value.(*cacheEntry).typeName() != typ {
+		shard.mutex.Unlock()
+		return errWrongType
+	}
+
+	var entry *cacheEntry
+	if ok {
+		entry = elem.Value.(*cacheEntry)
+		shard.touch(elem)
+	}
+	fn(entry)
+	shard.mutex.Unlock()
+
+	shard.countLookup(ok)
+	return nil
 }
 
 // stats returns cache statistics
 func (c *LRUCache) Stats() map[string]interface{} {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-
-	totalItems := 0
-	for _, shard := range c.shards {
-		shard.mutex.RLock()
-		totalItems += len(shard.items)
-		shard.mutex.RUnlock()
+	totalItems := c.DBSize()
+	minKeys, maxKeys := totalItems, 0
+	for _, shard := range c.Occupancy() {
+		minKeys, maxKeys = min(minKeys, shard.keys), max(maxKeys, shard.keys)
 	}
+	gets, puts, hits, misses, evictions, expired := c.totals()
 
 	hitRate := 0.0
-	if c.totalGets > 0 {
-		hitRate = float64(c.hitCount) / float64(c.totalGets) * 100.0
+	if gets > 0 {
+		hitRate = float64(hits) / float64(gets) * 100.0
+	}
+
+	admission, admitted, rejected := "none", int64(0), int64(0)
+	if f := c.admission.Load(); f != nil {
+		admission, admitted, rejected = "tinylfu", f.admitted.Load(), f.rejected.Load()
 	}
 
 	return map[string]interface{}{
-		"capacity":    c.capacity,
-		"size":        totalItems,
-		"get_ops":     c.totalGets,
-		"put_ops":     c.totalPuts,
-		"hits":        c.hitCount,
-		"misses":      c.missCount,
-		"hit_rate":    hitRate,
-		"evictions":   c.evictions,
-		"shard_count": c.shardCount,
+		"maxmemory":               c.maxMemory.Load(),
+		"used_memory":             c.usedMemory.Load(),
+		"maxmemory_policy":        c.Policy().name(),
+		"storage_engine":          c.StorageEngine(),
+		"admission_filter":        admission,
+		"window_memory":           c.windowMemory.Load(),
+		"admitted":                admitted,
+		"rejected":                rejected,
+		"size":                    totalItems,
+		"get_ops":                 gets,
+		"put_ops":                 puts,
+		"hits":                    hits,
+		"misses":                  misses,
+		"hit_rate":                hitRate,
+		"evictions":               evictions,
+		"expired":                 expired,
+		"shard_count":             c.shardCount,
+		"changes_since_last_save": c.ChangesSinceSave(),
+		"last_save_time":          c.snapshots.lastSave.Load(),
+		"bgsave_in_progress":      c.snapshots.saving.Load(),
+		"last_save_failed":        c.snapshots.lastFailed.Load(),
+		"aof_enabled":             c.aof != nil,
+		"aof_rewrite_in_progress": c.aof.Rewriting(),
+		"shard_hash":              c.shardHash,
+		"shard_keys_min":          minKeys,
+		"shard_keys_max":          maxKeys,
 	}
 }
 
-// We use a single global cache instance with a large capacity
-// The capacity is set to handle roughly 1 million entries with 256 chars each
-// which should fit within the 2GB RAM constraint while leaving room for the application
-var cache = NewLRUCache(1000000)
+// We use a single global cache instance. Its memory budget defaults to 1GB which fits
+// within the 2GB RAM constraint while leaving room for the application, the MAXMEMORY
+// environment variable (e.g. MAXMEMORY=512mb) changes it
+var cache = newCacheFromEnv()
+
+// argString returns the textual content of a command argument, clients send
+// bulk strings but we also accept simple strings for hand written commands
+func argString(v Value) string {
+	if v.typ == "bulk" {
+		return v.bulk
+	}
+	return v.str
+}
 
 // processCommand handles incoming RESP commands
 func processCommand(value Value) Value {
@@ -221,6 +494,20 @@ func processCommand(value Value) Value {
 		cmd = strings.ToUpper(cmdValue.str)
 	}
 
+	if isWriteCommand(cmd) && cache.readOnly() {
+		return Value{typ: "error", str: errReadOnlyReplica.Error()}
+	}
+
+	if err := checkMemory(cmd); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	// write commands also go to the append only file and the replicas, see propagate.go
+	return cache.propagation.propagate(cmd, value, func() Value { return runCommand(cmd, value) })
+}
+
+// runCommand executes a parsed command
+func runCommand(cmd string, value Value) Value {
 	// Process the command based on what's received
 	switch cmd {
 	case "PING":
@@ -242,38 +529,19 @@ func processCommand(value Value) Value {
 		return Value{typ: "string", str: arg.str}
 
 	case "SET", "PUT":
-		// vaalidate args
-		if len(value.array) != 3 {
-			return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
-		}
-
-		// check validity of key/value
-		var key, val string
-		if value.array[1].typ == "bulk" {
-			key = value.array[1].bulk
-		} else {
-			key = value.array[1].str
-		}
+		return setCommand(cmd, value.array[1:])
 
-		if value.array[2].typ == "bulk" {
-			val = value.array[2].bulk
-		} else {
-			val = value.array[2].str
-		}
+	case "SETNX":
+		return setnxCommand(value.array[1:])
 
-		// validate key and value length constraints
-		if len(key) > 256 || len(val) > 256 {
-			return Value{typ: "error", str: "ERR key or value too long (max 256 chars)"}
-		}
+	case "GETSET":
+		return getsetCommand(value.array[1:])
 
-		// add to cache using our optimized LRU
-		cache.Put(key, val)
+	case "GETDEL":
+		return getdelCommand(value.array[1:])
 
-		// reeturn success
-		if cmd == "PUT" {
-			return Value{typ: "bulk", bulk: `{"status":"OK","message":"Key inserted/updated successfully."}`}
-		}
-		return Value{typ: "string", str: "OK"}
+	case "GETEX":
+		return getexCommand(value.array[1:])
 
 	case "GET":
 		// validate args
@@ -282,34 +550,234 @@ func processCommand(value Value) Value {
 		}
 
 		// Get key
-		var key string
-		if value.array[1].typ == "bulk" {
-			key = value.array[1].bulk
-		} else {
-			key = value.array[1].str
-		}
+		key := argString(value.array[1])
 
 		// get value from our optimized LRU
-		val, exists := cache.Get(key)
+		val, exists, err := cache.Get(key)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
 		if !exists {
 			if cmd == "GET" && strings.HasPrefix(key, "http") {
 				// Handle special HTTP-like GET requests
 				return Value{typ: "bulk", bulk: `{"status":"ERROR","message":"Key not found."}`}
 			}
-			return Value{typ: "null"}
+			return Value{typ: "bulk", null: true}
 		}
 
 		return Value{typ: "bulk", bulk: val}
 
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		return expireCommand(cmd, value.array[1:])
+
+	case "TTL", "PTTL":
+		return ttlCommand(cmd, value.array[1:])
+
+	case "PERSIST":
+		if len(value.array) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'PERSIST' command"}
+		}
+		if cache.Persist(argString(value.array[1])) {
+			return Value{typ: "integer", num: 1}
+		}
+		return Value{typ: "integer", num: 0}
+
+	case "MGET":
+		return mgetCommand(value.array[1:])
+
+	case "MSET", "MSETNX":
+		return msetCommand(cmd, value.array[1:])
+
+	case "APPEND":
+		return appendCommand(value.array[1:])
+
+	case "STRLEN":
+		return strlenCommand(value.array[1:])
+
+	case "GETRANGE", "SUBSTR":
+		return getrangeCommand(cmd, value.array[1:])
+
+	case "SETRANGE":
+		return setrangeCommand(value.array[1:])
+
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		return incrCommand(cmd, value.array[1:])
+
+	case "INCRBYFLOAT":
+		return incrbyfloatCommand(value.array[1:])
+
+	case "HSET", "HMSET":
+		return hsetCommand(cmd, value.array[1:])
+
+	case "HSETNX":
+		return hsetnxCommand(value.array[1:])
+
+	case "HGET":
+		return hgetCommand(value.array[1:])
+
+	case "HMGET":
+		return hmgetCommand(value.array[1:])
+
+	case "HDEL":
+		return hdelCommand(value.array[1:])
+
+	case "HGETALL", "HKEYS", "HVALS":
+		return hgetallCommand(cmd, value.array[1:])
+
+	case "HLEN":
+		return hlenCommand(value.array[1:])
+
+	case "HEXISTS":
+		return hexistsCommand(value.array[1:])
+
+	case "HINCRBY":
+		return hincrbyCommand(value.array[1:])
+
+	case "HINCRBYFLOAT":
+		return hincrbyfloatCommand(value.array[1:])
+
+	case "HSCAN":
+		return hscanCommand(value.array[1:])
+
+	case "LPUSH", "RPUSH", "LPUSHX", "RPUSHX":
+		return pushCommand(cmd, value.array[1:])
+
+	case "LPOP", "RPOP":
+		return popCommand(cmd, value.array[1:])
+
+	case "LRANGE":
+		return lrangeCommand(value.array[1:])
+
+	case "LLEN":
+		return llenCommand(value.array[1:])
+
+	case "LINDEX":
+		return lindexCommand(value.array[1:])
+
+	case "LSET":
+		return lsetCommand(value.array[1:])
+
+	case "LREM":
+		return lremCommand(value.array[1:])
+
+	case "LTRIM":
+		return ltrimCommand(value.array[1:])
+
+	case "LINSERT":
+		return linsertCommand(value.array[1:])
+
+	case "LMOVE", "RPOPLPUSH", "BLPOP", "BRPOP", "BLMOVE", "BRPOPLPUSH":
+		// outside of a client connection the blocking variants never block
+		return moveCommand(nil, cmd, value.array[1:])
+
+	case "SADD", "SREM":
+		return saddCommand(cmd, value.array[1:])
+
+	case "SISMEMBER", "SMISMEMBER":
+		return sismemberCommand(cmd, value.array[1:])
+
+	case "SCARD":
+		return scardCommand(value.array[1:])
+
+	case "SMEMBERS":
+		return smembersCommand(value.array[1:])
+
+	case "SRANDMEMBER", "SPOP":
+		return srandmemberCommand(cmd, value.array[1:])
+
+	case "SMOVE":
+		return smoveCommand(value.array[1:])
+
+	case "SINTER", "SUNION", "SDIFF", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
+		return setAlgebraCommand(cmd, value.array[1:])
+
+	case "SSCAN":
+		return sscanCommand(value.array[1:])
+
+	case "ZADD":
+		return zaddCommand(value.array[1:])
+
+	case "ZINCRBY":
+		return zincrbyCommand(value.array[1:])
+
+	case "ZREM":
+		return zremCommand(value.array[1:])
+
+	case "ZSCORE":
+		return zscoreCommand(value.array[1:])
+
+	case "ZCARD":
+		return zcardCommand(value.array[1:])
+
+	case "ZRANK", "ZREVRANK":
+		return zrankCommand(cmd, value.array[1:])
+
+	case "ZRANGE", "ZREVRANGE", "ZRANGEBYSCORE", "ZREVRANGEBYSCORE", "ZRANGEBYLEX":
+		return zrangeCommand(cmd, value.array[1:])
+
+	case "SCAN":
+		return scanCommand(value.array[1:])
+
+	case "KEYS":
+		return keysCommand(value.array[1:])
+
+	case "DBSIZE":
+		return dbsizeCommand(value.array[1:])
+
+	case "DEL", "UNLINK":
+		return delCommand(cmd, value.array[1:])
+
+	case "EXISTS":
+		return existsCommand(value.array[1:])
+
+	case "TYPE":
+		return typeCommand(value.array[1:])
+
+	case "DUMP":
+		return dumpCommand(value.array[1:])
+
+	case "RESTORE":
+		return restoreCommand(value.array[1:])
+
+	case "RENAME", "RENAMENX":
+		return renameCommand(cmd, value.array[1:])
+
+	case "SAVE", "BGSAVE":
+		return saveCommand(cmd, value.array[1:])
+
+	case "LASTSAVE":
+		return lastsaveCommand(value.array[1:])
+
+	case "BGREWRITEAOF":
+		return bgrewriteaofCommand(value.array[1:])
+
+	case "REPLICAOF", "SLAVEOF":
+		return replicaofCommand(cmd, value.array[1:])
+
+	case "ROLE":
+		return roleCommand(value.array[1:])
+
+	case "INFO":
+		return infoCommand(value.array[1:])
+
+	case "CONFIG":
+		return configCommand(value.array[1:])
+
 	case "STATS":
+		if len(value.array) == 2 && strings.ToUpper(argString(value.array[1])) == "SHARDS" {
+			return shardsCommand()
+		}
+
 		// get cache statistics
 		stats := cache.Stats()
 
 		// format as a simple string
 		statsStr := fmt.Sprintf(
-			"Capacity: %d, Size: %d, Get Ops: %d, Put Ops: %d, Hits: %d, Misses: %d, Hit Rate: %.2f%%, Evictions: %d",
-			stats["capacity"], stats["size"], stats["get_ops"], stats["put_ops"],
-			stats["hits"], stats["misses"], stats["hit_rate"], stats["evictions"],
+			"Max Memory: %d, Used Memory: %d, Policy: %s, Size: %d, Get Ops: %d, Put Ops: %d, Hits: %d, Misses: %d, Hit Rate: %.2f%%, Evictions: %d, Expired: %d, Admission Filter: %s, Admitted: %d, Rejected: %d, Shards: %d, Shard Keys Min: %d, Shard Keys Max: %d",
+			stats["maxmemory"], stats["used_memory"], stats["maxmemory_policy"], stats["size"], stats["get_ops"], stats["put_ops"],
+			stats["hits"], stats["misses"], stats["hit_rate"], stats["evictions"], stats["expired"],
+			stats["admission_filter"], stats["admitted"], stats["rejected"],
+			stats["shard_count"], stats["shard_keys_min"], stats["shard_keys_max"],
 		)
 
 		return Value{typ: "string", str: statsStr}
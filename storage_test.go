@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// newTestCache makes a fresh global cache with the given memory limit for the duration of
+// the test, the commands run by run and processCommand use it
+func newTestCache(t testing.TB, maxMemory int64) *LRUCache {
+	t.Helper()
+	cache = NewLRUCache(maxMemory, 16, "fnv")
+	t.Cleanup(cache.Close)
+	return cache
+}
+
+// benchKeys is the keyspace of the parallel benchmarks
+const benchKeys = 100_000
+
+// newBenchCache returns a cache holding benchKeys keys, without a memory limit
+func newBenchCache(b *testing.B) *LRUCache {
+	c := NewLRUCache(0, 256, "fnv")
+	b.Cleanup(c.Close)
+	for i := 0; i < benchKeys; i++ {
+		c.Put("key:"+strconv.Itoa(i), "value", putOptions{})
+	}
+	return c
+}
+
+// benchKeyNames returns the names of the benchmark keys, so building them stays out of
+// the measured loop
+func benchKeyNames() []string {
+	names := make([]string, benchKeys)
+	for i := range names {
+		names[i] = "key:" + strconv.Itoa(i)
+	}
+	return names
+}
+
+// Run these with -cpu 1,2,4,8. The statistics are per shard atomics and a GET looks its key
+// up under the shard read lock, so goroutines only meet on the lock of a shard they both
+// use and ns/op should keep dropping as CPUs are added. The list engine still takes the
+// write lock to move a hit to the front, readbuffer_test.go compares it with read-buffer
+
+func BenchmarkGetParallel(b *testing.B) {
+	c, names := newBenchCache(b), benchKeyNames()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			c.Get(names[r.Intn(benchKeys)])
+		}
+	})
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	c, names := newBenchCache(b), benchKeyNames()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			c.Put(names[r.Intn(benchKeys)], "value", putOptions{})
+		}
+	})
+}
+
+// BenchmarkMixedParallel is 95% GETs and 5% SETs, the read heavy traffic we see
+func BenchmarkMixedParallel(b *testing.B) {
+	c, names := newBenchCache(b), benchKeyNames()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			key := names[r.Intn(benchKeys)]
+			if r.Intn(100) < 5 {
+				c.Put(key, "value", putOptions{})
+			} else {
+				c.Get(key)
+			}
+		}
+	})
+}
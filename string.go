@@ -0,0 +1,680 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	errSyntax       = errors.New("ERR syntax error")
+	errOverflow     = errors.New("ERR increment or decrement would overflow")
+	errInvalidFloat = errors.New("ERR value is not a valid float")
+	errNaNOrInf     = errors.New("ERR increment would produce NaN or Infinity")
+)
+
+// GetDel returns the value of a key and deletes it in the same critical section
+func (c *LRUCache) GetDel(key string) (string, bool, error) {
+	shard := c.getShard(key)
+	shard.stats.gets.Add(1)
+	shard.mutex.Lock()
+	elem, ok := c.liveElement(shard, key)
+	var value string
+	var err error
+	if ok {
+		if value, err = elem.Value.(*cacheEntry).stringValue(); err == nil {
+			shard.removeElement(elem)
+		}
+	}
+	shard.mutex.Unlock()
+
+	shard.countLookup(ok)
+	return value, ok, err
+}
+
+// GetEx returns the value of a key and updates its TTL at the same time.
+// A non zero expireAt sets a new deadline, persist removes the TTL and
+// with neither of them it behaves like a plain Get
+func (c *LRUCache) GetEx(key string, expireAt int64, persist bool) (string, bool, error) {
+	shard := c.getShard(key)
+	shard.stats.gets.Add(1)
+	shard.mutex.Lock()
+	elem, ok := c.liveElement(shard, key)
+	var value string
+	var err error
+	if ok {
+		value, err = elem.Value.(*cacheEntry).stringValue()
+	}
+	if ok && err == nil {
+		switch {
+		case expireAt != 0 && expireAt <= nowMillis():
+			// a deadline in the past deletes the key, the old value is still returned
+			shard.removeElement(elem)
+		case expireAt != 0:
+			shard.setExpire(elem, expireAt)
+			shard.touch(elem)
+		case persist:
+			shard.setExpire(elem, 0)
+			shard.touch(elem)
+		default:
+			shard.touch(elem)
+		}
+	}
+	shard.mutex.Unlock()
+
+	shard.countLookup(ok)
+	return value, ok, err
+}
+
+// updateString is the read-modify-write primitive for string values. fn gets the current
+// value (exists is false for a missing key) and returns the value to store, all of it
+// under a single shard lock so concurrent updates from other connections can't interleave.
+// The TTL of an existing key is kept, if fn returns an error nothing is written
+func (c *LRUCache) updateString(key string, fn func(old string, exists bool) (string, error)) error {
+	shard := c.getShard(key)
+	shard.stats.puts.Add(1)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	elem, ok := c.liveElement(shard, key)
+	var old string
+	if ok {
+		var err error
+		if old, err = elem.Value.(*cacheEntry).stringValue(); err != nil {
+			return err
+		}
+	}
+
+	value, err := fn(old, ok)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		shard.touch(elem)
+		elem.Value.(*cacheEntry).value = value
+		c.reweigh(shard, elem)
+		return nil
+	}
+	c.addEntry(shard, &cacheEntry{key: key, value: value})
+	return nil
+}
+
+// parseInteger parses a 64 bit integer as strictly as redis does: an optional '-' and
+// digits without leading zeros. strconv also takes "+5" and "007", redis says they are
+// not integers
+func parseInteger(s string) (int64, error) {
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || digits[0] < '0' || digits[0] > '9' || (digits[0] == '0' && s != "0") {
+		return 0, errInvalidInteger
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errInvalidInteger
+	}
+	return n, nil
+}
+
+// IncrBy atomically adds delta to the integer stored at key, a missing key counts as 0
+func (c *LRUCache) IncrBy(key string, delta int64) (int64, error) {
+	var result int64
+	err := c.updateString(key, func(old string, exists bool) (string, error) {
+		var current int64
+		if exists {
+			n, err := parseInteger(old)
+			if err != nil {
+				return "", err
+			}
+			current = n
+		}
+
+		// check for overflow before adding, redis refuses instead of wrapping around
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return "", errOverflow
+		}
+
+		result = current + delta
+		return strconv.FormatInt(result, 10), nil
+	})
+	return result, err
+}
+
+// IncrByFloat atomically adds delta to the number stored at key, a missing key counts as 0
+func (c *LRUCache) IncrByFloat(key string, delta float64) (float64, error) {
+	var result float64
+	err := c.updateString(key, func(old string, exists bool) (string, error) {
+		var current float64
+		if exists {
+			f, err := strconv.ParseFloat(old, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return "", errInvalidFloat
+			}
+			current = f
+		}
+
+		result = current + delta
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return "", errNaNOrInf
+		}
+		return formatFloat(result), nil
+	})
+	return result, err
+}
+
+// Append atomically appends to the string stored at key (creating it if needed)
+// and returns the new length. The result has to stay within maxValueSize
+func (c *LRUCache) Append(key, suffix string) (int, error) {
+	length := 0
+	err := c.updateString(key, func(old string, exists bool) (string, error) {
+		if int64(len(old)+len(suffix)) > maxValueSize.Load() {
+			return "", errValueTooLong()
+		}
+		length = len(old) + len(suffix)
+		return old + suffix, nil
+	})
+	return length, err
+}
+
+// SetRange atomically overwrites part of the string stored at key starting at offset.
+// A missing key counts as an empty string and any gap is padded with zero bytes.
+// It returns the new length of the string
+func (c *LRUCache) SetRange(key string, offset int, value string) (int, error) {
+	length := 0
+	err := c.updateString(key, func(old string, exists bool) (string, error) {
+		// checked before adding, a huge offset would overflow end
+		if int64(offset) > maxValueSize.Load()-int64(len(value)) {
+			return "", errValueTooLong()
+		}
+		end := offset + len(value)
+
+		buf := []byte(old)
+		if end > len(buf) {
+			buf = append(buf, make([]byte, end-len(buf))...)
+		}
+		copy(buf[offset:], value)
+		length = len(buf)
+		return string(buf), nil
+	})
+	return length, err
+}
+
+// getRange returns the substring of s between start and end (both inclusive),
+// with negative indexes counting from the end like in redis GETRANGE
+func getRange(s string, start, end int) string {
+	n := len(s)
+	if start < 0 && end < 0 && start > end {
+		return ""
+	}
+	if start < 0 {
+		start = n + start
+	}
+	if end < 0 {
+		end = n + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end || n == 0 {
+		return ""
+	}
+	return s[start : end+1]
+}
+
+// formatFloat prints a float the way redis does for INCRBYFLOAT, without an exponent
+// and without trailing zeros
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// MGet looks up several keys at once. Keys are grouped by shard and each shard
+// is locked a single time for its whole group. Keys holding something other than
+// a string are reported as missing, like redis does
+func (c *LRUCache) MGet(keys []string) ([]string, []bool) {
+	values := make([]string, len(keys))
+	found := make([]bool, len(keys))
+
+	for idx, positions := range c.groupByShard(keys) {
+		shard := c.shards[idx]
+		hits := 0
+		// write lock since a hit moves the key to the front of the recency list
+		shard.mutex.Lock()
+		for _, pos := range positions {
+			elem, ok := c.readElement(shard, keys[pos])
+			if !ok {
+				continue
+			}
+			value, err := elem.Value.(*cacheEntry).stringValue()
+			if err != nil {
+				continue
+			}
+			values[pos] = value
+			found[pos] = true
+			shard.touch(elem)
+			hits++
+		}
+		shard.mutex.Unlock()
+
+		shard.stats.gets.Add(int64(len(positions)))
+		shard.stats.hits.Add(int64(hits))
+		shard.stats.misses.Add(int64(len(positions) - hits))
+	}
+
+	return values, found
+}
+
+// MSet stores several key-value pairs atomically, clearing their TTLs like SET does.
+// With onlyIfNoneExist nothing is written if any of the keys is already present (MSETNX).
+// All shards involved are locked up front in index order, so no other client can see
+// half of the batch and two batches can't deadlock each other
+func (c *LRUCache) MSet(keys, values []string, onlyIfNoneExist bool) bool {
+	unlock := c.lockKeys(keys...)
+	defer unlock()
+
+	if onlyIfNoneExist {
+		for _, key := range keys {
+			if _, ok := c.liveElement(c.getShard(key), key); ok {
+				return false
+			}
+		}
+	}
+
+	// a key given twice simply ends up with the last value, like in redis
+	for i, key := range keys {
+		shard := c.getShard(key)
+		shard.stats.puts.Add(1)
+		if elem, ok := c.liveElement(shard, key); ok {
+			shard.touch(elem)
+			elem.Value.(*cacheEntry).value = values[i]
+			shard.setExpire(elem, 0)
+			c.reweigh(shard, elem)
+			continue
+		}
+		c.addEntry(shard, &cacheEntry{key: key, value: values[i]})
+	}
+
+	return true
+}
+
+// parseSetOptions parses everything after the key and value of a SET command:
+// [NX|XX] [GET] [EX seconds|PX milliseconds|EXAT unix-time|PXAT unix-time-ms|KEEPTTL]
+// It returns the options for Put and whether the old value was asked for
+func parseSetOptions(args []Value) (putOptions, bool, error) {
+	var opts putOptions
+	get, hasTTL := false, false
+
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(argString(args[i]))
+		switch opt {
+		case "NX":
+			if opts.onlyIfExists {
+				return opts, false, errSyntax
+			}
+			opts.onlyIfMissing = true
+		case "XX":
+			if opts.onlyIfMissing {
+				return opts, false, errSyntax
+			}
+			opts.onlyIfExists = true
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			if hasTTL {
+				return opts, false, errSyntax
+			}
+			opts.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			// only one expiry option per SET, and it can't be mixed with KEEPTTL
+			if hasTTL || opts.keepTTL || i+1 >= len(args) {
+				return opts, false, errSyntax
+			}
+			i++
+			at, err := parseExpireArg(opt, argString(args[i]), "set", false)
+			if err != nil {
+				return opts, false, err
+			}
+			opts.expireAt = at
+			hasTTL = true
+		default:
+			return opts, false, errSyntax
+		}
+	}
+
+	return opts, get, nil
+}
+
+// setCommand handles SET (and the PUT alias used by the http wrapper)
+func setCommand(cmd string, args []Value) Value {
+	// vaalidate args, anything after the value is an option
+	if len(args) < 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	// check validity of key/value
+	key := argString(args[0])
+	val := argString(args[1])
+
+	// validate key and value length constraints
+	if err := checkSize(key, val); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	opts, get, err := parseSetOptions(args[2:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	// add to cache using our optimized LRU, conditions are checked atomically inside Put
+	opts.getOld = get
+	old, existed, written, err := cache.Put(key, val, opts)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	// with GET the reply is always the old value, whether or not we wrote
+	if get {
+		if !existed {
+			return Value{typ: "bulk", null: true}
+		}
+		return Value{typ: "bulk", bulk: old}
+	}
+
+	// NX/XX prevented the write
+	if !written {
+		return Value{typ: "bulk", null: true}
+	}
+
+	// reeturn success
+	if cmd == "PUT" {
+		return Value{typ: "bulk", bulk: `{"status":"OK","message":"Key inserted/updated successfully."}`}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// setnxCommand handles SETNX, which is SET NX with an integer reply
+func setnxCommand(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'SETNX' command"}
+	}
+
+	key, val := argString(args[0]), argString(args[1])
+	if err := checkSize(key, val); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if _, _, written, _ := cache.Put(key, val, putOptions{onlyIfMissing: true}); written {
+		return Value{typ: "integer", num: 1}
+	}
+	return Value{typ: "integer", num: 0}
+}
+
+// getsetCommand handles GETSET, which is SET GET without any other option
+func getsetCommand(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'GETSET' command"}
+	}
+
+	key, val := argString(args[0]), argString(args[1])
+	if err := checkSize(key, val); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	old, existed, _, err := cache.Put(key, val, putOptions{getOld: true})
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !existed {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: old}
+}
+
+// getdelCommand handles GETDEL
+func getdelCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'GETDEL' command"}
+	}
+
+	val, ok, err := cache.GetDel(argString(args[0]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: val}
+}
+
+// getexCommand handles GETEX key [EX seconds|PX milliseconds|EXAT unix-time|PXAT unix-time-ms|PERSIST]
+func getexCommand(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'GETEX' command"}
+	}
+
+	var expireAt int64
+	persist := false
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(argString(args[i]))
+		switch opt {
+		case "PERSIST":
+			if expireAt != 0 {
+				return Value{typ: "error", str: errSyntax.Error()}
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if persist || expireAt != 0 || i+1 >= len(args) {
+				return Value{typ: "error", str: errSyntax.Error()}
+			}
+			i++
+			at, err := parseExpireArg(opt, argString(args[i]), "getex", false)
+			if err != nil {
+				return Value{typ: "error", str: err.Error()}
+			}
+			expireAt = at
+		default:
+			return Value{typ: "error", str: errSyntax.Error()}
+		}
+	}
+
+	val, ok, err := cache.GetEx(argString(args[0]), expireAt, persist)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: val}
+}
+
+// incrCommand handles INCR, DECR, INCRBY and DECRBY
+func incrCommand(cmd string, args []Value) Value {
+	wantArgs := 1
+	if cmd == "INCRBY" || cmd == "DECRBY" {
+		wantArgs = 2
+	}
+	if len(args) != wantArgs {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	delta := int64(1)
+	if wantArgs == 2 {
+		n, err := parseInteger(argString(args[1]))
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		delta = n
+	}
+	if cmd == "DECR" || cmd == "DECRBY" {
+		// -MinInt64 does not fit in an int64
+		if delta == math.MinInt64 {
+			return Value{typ: "error", str: "ERR decrement would overflow"}
+		}
+		delta = -delta
+	}
+
+	result, err := cache.IncrBy(argString(args[0]), delta)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: int(result)}
+}
+
+// incrbyfloatCommand handles INCRBYFLOAT, the reply is a bulk string like in redis
+func incrbyfloatCommand(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'INCRBYFLOAT' command"}
+	}
+
+	delta, err := strconv.ParseFloat(argString(args[1]), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return Value{typ: "error", str: errInvalidFloat.Error()}
+	}
+
+	result, err := cache.IncrByFloat(argString(args[0]), delta)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "bulk", bulk: formatFloat(result)}
+}
+
+// mgetCommand handles MGET, missing keys show up as nil elements in the reply
+func mgetCommand(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'MGET' command"}
+	}
+
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = argString(arg)
+	}
+
+	values, found := cache.MGet(keys)
+	reply := make([]Value, len(keys))
+	for i := range keys {
+		if found[i] {
+			reply[i] = Value{typ: "bulk", bulk: values[i]}
+		} else {
+			reply[i] = Value{typ: "bulk", null: true}
+		}
+	}
+	return Value{typ: "array", array: reply}
+}
+
+// msetCommand handles MSET and MSETNX
+func msetCommand(cmd string, args []Value) Value {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	keys := make([]string, 0, len(args)/2)
+	values := make([]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		key, val := argString(args[i]), argString(args[i+1])
+		// validate everything first so a bad pair doesn't leave half the batch written
+		if err := checkSize(key, val); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		keys = append(keys, key)
+		values = append(values, val)
+	}
+
+	written := cache.MSet(keys, values, cmd == "MSETNX")
+	if cmd == "MSET" {
+		return Value{typ: "string", str: "OK"}
+	}
+	if written {
+		return Value{typ: "integer", num: 1}
+	}
+	return Value{typ: "integer", num: 0}
+}
+
+// appendCommand handles APPEND, the reply is the length of the string after the append
+func appendCommand(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'APPEND' command"}
+	}
+
+	key, suffix := argString(args[0]), argString(args[1])
+	if err := checkSize(key, suffix); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	length, err := cache.Append(key, suffix)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
+
+// strlenCommand handles STRLEN, a missing key has length 0
+func strlenCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'STRLEN' command"}
+	}
+
+	val, _, err := cache.Get(argString(args[0]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: len(val)}
+}
+
+// getrangeCommand handles GETRANGE and its old name SUBSTR
+func getrangeCommand(cmd string, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	start, err1 := strconv.Atoi(argString(args[1]))
+	end, err2 := strconv.Atoi(argString(args[2]))
+	if err1 != nil || err2 != nil {
+		return Value{typ: "error", str: errInvalidInteger.Error()}
+	}
+
+	val, _, err := cache.Get(argString(args[0]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "bulk", bulk: getRange(val, start, end)}
+}
+
+// setrangeCommand handles SETRANGE, the reply is the length of the string after the write
+func setrangeCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'SETRANGE' command"}
+	}
+
+	key, value := argString(args[0]), argString(args[2])
+	offset, err := strconv.Atoi(argString(args[1]))
+	if err != nil {
+		return Value{typ: "error", str: errInvalidInteger.Error()}
+	}
+	if offset < 0 {
+		return Value{typ: "error", str: "ERR offset is out of range"}
+	}
+	if err := checkSize(key, ""); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	// writing nothing never creates the key, the reply is just the current length
+	if value == "" {
+		val, _, err := cache.Get(key)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		return Value{typ: "integer", num: len(val)}
+	}
+
+	length, err := cache.SetRange(key, offset, value)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSetRangeHugeOffset(t *testing.T) {
+	cache = NewLRUCache(0, 4, "fnv")
+
+	// offset+len used to overflow, pass the size check and panic in copy
+	reply := processCommand(command("SETRANGE", "k", "9223372036854775807", "ab"))
+	if reply.typ != "error" || !strings.Contains(reply.str, "string exceeds maximum allowed size") {
+		t.Fatalf("SETRANGE with a huge offset = %+v, want the size error", reply)
+	}
+	if reply := processCommand(command("EXISTS", "k")); reply.num != 0 {
+		t.Fatal("a failed SETRANGE created the key")
+	}
+
+	if reply := processCommand(command("SETRANGE", "k", "2", "ab")); reply.num != 4 {
+		t.Fatalf("SETRANGE k 2 ab = %+v, want 4", reply)
+	}
+	if reply := processCommand(command("GET", "k")); reply.bulk != "\x00\x00ab" {
+		t.Fatalf("GET k = %q", reply.bulk)
+	}
+}
+
+// replyString renders a reply compactly for the command tables of the tests: +OK, :1,
+// $value, $nil, -ERR message, *[a b] and *nil
+func replyString(v Value) string {
+	switch v.typ {
+	case "string":
+		return "+" + v.str
+	case "error":
+		return "-" + v.str
+	case "integer":
+		return ":" + strconv.Itoa(v.num)
+	case "bulk":
+		if v.null {
+			return "$nil"
+		}
+		return "$" + v.bulk
+	case "array":
+		if v.null {
+			return "*nil"
+		}
+		items := make([]string, len(v.array))
+		for i, item := range v.array {
+			items[i] = strings.TrimPrefix(replyString(item), "$")
+		}
+		return "*[" + strings.Join(items, " ") + "]"
+	}
+	return fmt.Sprintf("%+v", v)
+}
+
+// commandTest is a command with the reply it should get, see replyString
+type commandTest struct {
+	args []string
+	want string
+}
+
+// runCommands runs the commands in order against the global cache and checks every reply
+func runCommands(t *testing.T, tests []commandTest) {
+	t.Helper()
+	for _, tt := range tests {
+		if got := replyString(run(tt.args...)); got != tt.want {
+			t.Errorf("%q = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	newTestCache(t, 0)
+	notInteger := "-" + errInvalidInteger.Error()
+	runCommands(t, []commandTest{
+		{[]string{"INCR", "n"}, ":1"}, // a missing key counts as 0
+		{[]string{"SET", "n", "10"}, "+OK"},
+		{[]string{"INCR", "n"}, ":11"},
+		{[]string{"INCRBY", "n", "5"}, ":16"},
+		{[]string{"DECR", "n"}, ":15"},
+		{[]string{"DECRBY", "n", "-5"}, ":20"},
+		{[]string{"INCRBY", "n", "-20"}, ":0"},
+		{[]string{"GET", "n"}, "$0"},
+
+		// only an optional '-' and digits without leading zeros are integers
+		{[]string{"INCRBY", "n", "+5"}, notInteger},
+		{[]string{"INCRBY", "n", "007"}, notInteger},
+		{[]string{"INCRBY", "n", "-0"}, notInteger},
+		{[]string{"INCRBY", "n", "-"}, notInteger},
+		{[]string{"INCRBY", "n", ""}, notInteger},
+		{[]string{"INCRBY", "n", " 5"}, notInteger},
+		{[]string{"INCRBY", "n", "5 "}, notInteger},
+		{[]string{"INCRBY", "n", "5.0"}, notInteger},
+		{[]string{"INCRBY", "n", "1_000"}, notInteger},
+		{[]string{"DECRBY", "n", "0x10"}, notInteger},
+		{[]string{"INCRBY", "n", "9223372036854775808"}, notInteger},
+		{[]string{"SET", "s", "007"}, "+OK"},
+		{[]string{"INCR", "s"}, notInteger},
+		{[]string{"SET", "s", "+1"}, "+OK"},
+		{[]string{"INCR", "s"}, notInteger},
+		{[]string{"SET", "s", "abc"}, "+OK"},
+		{[]string{"DECR", "s"}, notInteger},
+		{[]string{"GET", "s"}, "$abc"},
+
+		// overflow is refused instead of wrapping around
+		{[]string{"SET", "big", "9223372036854775807"}, "+OK"},
+		{[]string{"INCR", "big"}, "-" + errOverflow.Error()},
+		{[]string{"SET", "small", "-9223372036854775808"}, "+OK"},
+		{[]string{"DECR", "small"}, "-" + errOverflow.Error()},
+		{[]string{"DECRBY", "n", "-9223372036854775808"}, "-ERR decrement would overflow"},
+		{[]string{"GET", "big"}, "$9223372036854775807"},
+
+		{[]string{"RPUSH", "list", "x"}, ":1"},
+		{[]string{"INCR", "list"}, "-" + errWrongType.Error()},
+		{[]string{"INCR"}, "-ERR wrong number of arguments for 'INCR' command"},
+		{[]string{"INCRBY", "n"}, "-ERR wrong number of arguments for 'INCRBY' command"},
+
+		{[]string{"HSET", "h", "f", "007"}, ":1"},
+		{[]string{"HINCRBY", "h", "f", "1"}, "-" + errHashNotInteger.Error()},
+		{[]string{"HINCRBY", "h", "g", "+1"}, notInteger},
+		{[]string{"HINCRBY", "h", "g", "-3"}, ":-3"},
+	})
+}
+
+func TestIncrByFloat(t *testing.T) {
+	newTestCache(t, 0)
+	runCommands(t, []commandTest{
+		{[]string{"INCRBYFLOAT", "f", "3"}, "$3"},
+		{[]string{"SET", "f", "10.5"}, "+OK"},
+		{[]string{"INCRBYFLOAT", "f", "0.1"}, "$10.6"},
+		{[]string{"INCRBYFLOAT", "f", "-5"}, "$5.6"},
+		{[]string{"INCRBYFLOAT", "f", "5.0e3"}, "$5005.6"},
+		{[]string{"GET", "f"}, "$5005.6"},
+		{[]string{"SET", "e", "5.0e3"}, "+OK"},
+		{[]string{"INCRBYFLOAT", "e", "200"}, "$5200"},
+		{[]string{"INCRBYFLOAT", "e", "-5200"}, "$0"},
+
+		{[]string{"INCRBYFLOAT", "f", "abc"}, "-" + errInvalidFloat.Error()},
+		{[]string{"INCRBYFLOAT", "f", "inf"}, "-" + errInvalidFloat.Error()},
+		{[]string{"INCRBYFLOAT", "f", "nan"}, "-" + errInvalidFloat.Error()},
+		{[]string{"SET", "s", "abc"}, "+OK"},
+		{[]string{"INCRBYFLOAT", "s", "1"}, "-" + errInvalidFloat.Error()},
+		{[]string{"SET", "g", "1e308"}, "+OK"},
+		{[]string{"INCRBYFLOAT", "g", "1e308"}, "-" + errNaNOrInf.Error()},
+		{[]string{"GET", "g"}, "$1e308"},
+	})
+}
+
+func TestSetOptions(t *testing.T) {
+	newTestCache(t, 0)
+	syntax := "-" + errSyntax.Error()
+	runCommands(t, []commandTest{
+		{[]string{"SET", "k", "v1", "XX"}, "$nil"},
+		{[]string{"EXISTS", "k"}, ":0"},
+		{[]string{"SET", "k", "v1", "NX"}, "+OK"},
+		{[]string{"SET", "k", "v2", "nx"}, "$nil"},
+		{[]string{"GET", "k"}, "$v1"},
+		{[]string{"SET", "k", "v2", "XX"}, "+OK"},
+		{[]string{"GET", "k"}, "$v2"},
+
+		// GET answers with the old value whether or not NX/XX let the write through
+		{[]string{"SET", "k", "v3", "GET"}, "$v2"},
+		{[]string{"SET", "k", "v4", "NX", "GET"}, "$v3"},
+		{[]string{"GET", "k"}, "$v3"},
+		{[]string{"SET", "new", "v", "GET"}, "$nil"},
+		{[]string{"SET", "other", "v", "XX", "GET"}, "$nil"},
+		{[]string{"EXISTS", "other"}, ":0"},
+
+		// KEEPTTL keeps the TTL a plain SET would drop
+		{[]string{"SET", "k", "v", "EX", "100"}, "+OK"},
+		{[]string{"SET", "k", "v", "KEEPTTL"}, "+OK"},
+		{[]string{"TTL", "k"}, ":100"},
+		{[]string{"SET", "k", "v", "XX", "KEEPTTL", "GET"}, "$v"},
+		{[]string{"TTL", "k"}, ":100"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"TTL", "k"}, ":-1"},
+
+		{[]string{"SET", "k", "v", "NX", "XX"}, syntax},
+		{[]string{"SET", "k", "v", "EX", "10", "PX", "100"}, syntax},
+		{[]string{"SET", "k", "v", "EX", "10", "KEEPTTL"}, syntax},
+		{[]string{"SET", "k", "v", "KEEPTTL", "EX", "10"}, syntax},
+		{[]string{"SET", "k", "v", "EX"}, syntax},
+		{[]string{"SET", "k", "v", "FOREVER"}, syntax},
+		{[]string{"SET", "k"}, "-ERR wrong number of arguments for 'SET' command"},
+		{[]string{"GET", "k"}, "$v"},
+
+		{[]string{"RPUSH", "list", "a"}, ":1"},
+		{[]string{"SET", "list", "v", "GET"}, "-" + errWrongType.Error()},
+		{[]string{"TYPE", "list"}, "+list"},
+		{[]string{"SET", "list", "v", "NX"}, "$nil"},
+		{[]string{"SET", "list", "v"}, "+OK"},
+		{[]string{"TYPE", "list"}, "+string"},
+	})
+}
+
+func TestSetVariants(t *testing.T) {
+	newTestCache(t, 0)
+	syntax := "-" + errSyntax.Error()
+	runCommands(t, []commandTest{
+		{[]string{"SETNX", "k", "v1"}, ":1"},
+		{[]string{"SETNX", "k", "v2"}, ":0"},
+		{[]string{"GETSET", "k", "v2"}, "$v1"},
+		{[]string{"GETSET", "fresh", "v"}, "$nil"},
+		{[]string{"GET", "fresh"}, "$v"},
+		{[]string{"GETDEL", "missing"}, "$nil"},
+		{[]string{"GETDEL", "k"}, "$v2"},
+		{[]string{"EXISTS", "k"}, ":0"},
+
+		{[]string{"GETEX", "missing", "EX", "10"}, "$nil"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+		{[]string{"GETEX", "k"}, "$v"},
+		{[]string{"TTL", "k"}, ":-1"},
+		{[]string{"GETEX", "k", "EX", "100"}, "$v"},
+		{[]string{"TTL", "k"}, ":100"},
+		{[]string{"GETEX", "k", "PX", "50000"}, "$v"},
+		{[]string{"TTL", "k"}, ":50"},
+		{[]string{"GETEX", "k", "PERSIST"}, "$v"},
+		{[]string{"TTL", "k"}, ":-1"},
+		{[]string{"GETEX", "k", "EX", "0"}, "-ERR invalid expire time in 'getex' command"},
+		{[]string{"GETEX", "k", "EX", "10", "PERSIST"}, syntax},
+		{[]string{"GETEX", "k", "PX"}, syntax},
+		{[]string{"GETEX", "k", "KEEPTTL"}, syntax},
+		{[]string{"TTL", "k"}, ":-1"},
+
+		{[]string{"RPUSH", "list", "a"}, ":1"},
+		{[]string{"GETSET", "list", "v"}, "-" + errWrongType.Error()},
+		{[]string{"GETDEL", "list"}, "-" + errWrongType.Error()},
+		{[]string{"GETEX", "list", "PERSIST"}, "-" + errWrongType.Error()},
+		{[]string{"SETNX", "list", "v"}, ":0"},
+	})
+}
+
+func TestSetNXIsAtomic(t *testing.T) {
+	newTestCache(t, 0)
+	// many clients racing for the same lock key, exactly one of them gets it
+	const clients = 50
+	var wg sync.WaitGroup
+	var won atomic.Int32
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reply := run("SET", "lock", strconv.Itoa(i), "NX", "PX", "30000"); reply.typ == "string" {
+				won.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := won.Load(); n != 1 {
+		t.Fatalf("%d clients got the lock, want 1", n)
+	}
+}
+
+func TestMultiKeyCommands(t *testing.T) {
+	newTestCache(t, 0)
+	runCommands(t, []commandTest{
+		{[]string{"MSET", "a", "1", "b", "2", "a", "3"}, "+OK"},
+		{[]string{"MGET", "a", "b", "missing", "a"}, "*[3 2 nil 3]"},
+		{[]string{"MSET", "a"}, "-ERR wrong number of arguments for 'MSET' command"},
+		{[]string{"MSET", "a", "1", "b"}, "-ERR wrong number of arguments for 'MSET' command"},
+		{[]string{"MGET"}, "-ERR wrong number of arguments for 'MGET' command"},
+
+		// MSET forgets TTLs like SET does, MGET reports other types as missing
+		{[]string{"SET", "ttl", "v", "EX", "100"}, "+OK"},
+		{[]string{"RPUSH", "list", "x"}, ":1"},
+		{[]string{"MGET", "ttl", "list"}, "*[v nil]"},
+		{[]string{"MSET", "ttl", "w"}, "+OK"},
+		{[]string{"TTL", "ttl"}, ":-1"},
+
+		// MSETNX writes all of the keys or none of them
+		{[]string{"MSETNX", "x", "1", "y", "2", "a", "4"}, ":0"},
+		{[]string{"MGET", "x", "y", "a"}, "*[nil nil 3]"},
+		{[]string{"MSETNX", "x", "1", "y", "2"}, ":1"},
+		{[]string{"MGET", "x", "y"}, "*[1 2]"},
+		{[]string{"MSETNX", "list", "v"}, ":0"},
+		{[]string{"MSETNX", "x"}, "-ERR wrong number of arguments for 'MSETNX' command"},
+
+		// a bad pair is found before anything is written
+		{[]string{"MSET", "p", "1", "q", strings.Repeat("v", 257)}, "-ERR value too long (max 256 bytes)"},
+		{[]string{"EXISTS", "p"}, ":0"},
+	})
+}
+
+func TestMSetNXIsAtomic(t *testing.T) {
+	c := newTestCache(t, 0)
+	// keys spread over several shards, two batches race for them in opposite order
+	var keys []string
+	shards := map[uint32]bool{}
+	for i := 0; len(shards) < 8; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if idx := c.shardIndex(key); !shards[idx] {
+			shards[idx] = true
+			keys = append(keys, key)
+		}
+	}
+	batch := func(value string, keys []string) []string {
+		var args []string
+		for _, key := range keys {
+			args = append(args, key, value)
+		}
+		return append([]string{"MSETNX"}, args...)
+	}
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+
+	for round := 0; round < 200; round++ {
+		run(append([]string{"DEL"}, keys...)...)
+		var wg sync.WaitGroup
+		var won [2]int
+		for i, args := range [][]string{batch("first", keys), batch("second", reversed)} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				won[i] = run(args...).num
+			}()
+		}
+		wg.Wait()
+		if won[0]+won[1] != 1 {
+			t.Fatalf("round %d: %v MSETNX won, want exactly one", round, won)
+		}
+		want := "first"
+		if won[1] == 1 {
+			want = "second"
+		}
+		values := run(append([]string{"MGET"}, keys...)...)
+		for i, value := range values.array {
+			if value.bulk != want {
+				t.Fatalf("round %d: %s = %q after %s won", round, keys[i], value.bulk, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+#!/bin/sh
+# capture_rdb.sh saves the data of the gen_rdb.go fixtures with real redis servers, the
+# dumps land next to the generated files as redis-5.0-server.rdb and redis-7.2-server.rdb
+# and rdb_test.go loads them with the same expected content:
+#
+#	sh testdata/capture_rdb.sh
+#
+# It needs docker and runs the official redis:5.0.14 and redis:7.2.4 images.
+set -eu
+cd "$(dirname "$0")"
+
+capture() {
+	version=$1
+	shift
+	name=gored-rdb-$version
+	docker run -d --rm --name "$name" "redis:$version" redis-server --save '' "$@" >/dev/null
+	trap 'docker stop "$name" >/dev/null 2>&1 || true' EXIT
+	until docker exec "$name" redis-cli PING >/dev/null 2>&1; do sleep 0.2; done
+	docker exec -i "$name" redis-cli >/dev/null
+	docker exec "$name" redis-cli SAVE >/dev/null
+	docker cp "$name:/data/dump.rdb" "redis-${version%.*}-server.rdb"
+	docker stop "$name" >/dev/null
+	trap - EXIT
+}
+
+repeat() {
+	i=0
+	while [ $i -lt "$2" ]; do printf '%s' "$1"; i=$((i + 1)); done
+}
+
+# the keys of redis5() in gen_rdb.go, the encodings are picked by redis itself
+{
+	echo "SET str:raw \"hello world\""
+	echo "SET str:int8 -100"
+	echo "SET str:int16 12345"
+	echo "SET str:int32 -2000000000"
+	echo "SET str:lzf $(repeat abcdefgh 16)"
+	echo "SET str:ttl \"still here\""
+	echo "PEXPIREAT str:ttl 4102444800000"
+	for i in $(seq 0 39); do echo "RPUSH list:quicklist element-$((i % 4))"; done
+	echo "RPUSH list:quicklist 1 200 -70000 tail"
+	echo "SADD set:intset16 3 -2 1000"
+	echo "SADD set:intset64 1 1099511627776 -1125899906842624"
+	for i in $(seq 0 599); do echo "SADD set:plain m$i"; done
+	echo "HSET hash:ziplist name gored port 6379 neg -5"
+	echo "ZADD zset:ziplist 1 a 2.5 b -3 c"
+	awk 'BEGIN { for (i = 0; i < 130; i++) printf "ZADD zset:skiplist %s z%d\n", i / 2, i }'
+} | capture 5.0.14
+
+# the keys of redis72(), the list gets a plain node for its 9000 byte element
+{
+	echo "DEBUG QUICKLIST-PACKED-THRESHOLD 1k"
+	echo "SET str:lzf $(repeat 0123456789 10)"
+	echo "SET str:int 42"
+	echo "RPUSH list:quicklist2 a 100 -4000 70000 b $(repeat x 9000)"
+	echo "HSET hash:listpack field value count 12 big 123456789012"
+	echo "ZADD zset:listpack -1.5 low 0 mid 1e20 high"
+	echo "SADD set:listpack red green blue"
+	echo "SADD set:intset32 70000 -70000 5"
+	for i in $(seq 0 19); do echo "HSET hash:lzf field:$i \"same old value\""; done
+	echo "PEXPIREAT hash:lzf 4102444800000"
+	echo "SET str:plain short"
+} | capture 7.2.4 --maxmemory-policy allkeys-lfu --enable-debug-command yes
@@ -0,0 +1,448 @@
+//go:build ignore
+
+// gen_rdb writes the *-encodings.rdb fixtures of rdb_test.go:
+//
+//	go run testdata/gen_rdb.go
+//
+// They are generated, not saved by a redis server (capture_rdb.sh saves the same data with
+// real servers as the *-server.rdb fixtures), and cover what a server won't save on demand.
+// The files are laid out byte for byte the way redis 5.0 (RDB version 9) and redis 7.2
+// (RDB version 11) save them: the same aux fields, integer encoded strings, strings over
+// 20 bytes LZF compressed when that saves at least 4 bytes, and small collections in
+// ziplists, listpacks and intsets picked with the default *-max-*-entries settings. The
+// encoders below follow the redis sources (ziplist.c, listpack.c, intset.c, lzf_c.c,
+// rdb.c) and share no code with the loader they test.
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	future = 4102444800000 // 2100-01-01, a TTL that doesn't run out during the tests
+	past   = 1000000000000 // 2001-09-09, the key is skipped on load
+)
+
+func main() {
+	for name, data := range map[string][]byte{
+		"redis-5.0-encodings.rdb": redis5(),
+		"redis-7.2-encodings.rdb": redis72(),
+	} {
+		if err := os.WriteFile(filepath.Join("testdata", name), data, 0644); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+}
+
+// redis5 is what redis 5.0.14 saves, with rdbcompression yes and no LRU/LFU policy
+func redis5() []byte {
+	b := []byte("REDIS0009")
+	b = aux(b, "redis-ver", "5.0.14")
+	b = aux(b, "redis-bits", "64")
+	b = aux(b, "ctime", "1700000000")
+	b = aux(b, "used-mem", "866680")
+	b = aux(b, "aof-preamble", "0")
+	b = append(b, 0xFE, 0) // SELECTDB 0
+	b = append(b, 0xFB)    // RESIZEDB
+	b = length(b, 14)
+	b = length(b, 2)
+
+	// strings: raw, integer encoded in 8, 16 and 32 bits, LZF compressed
+	b = key(b, 0, "str:raw", str(nil, "hello world"))
+	b = key(b, 0, "str:int8", str(nil, "-100"))
+	b = key(b, 0, "str:int16", str(nil, "12345"))
+	b = key(b, 0, "str:int32", str(nil, "-2000000000"))
+	b = key(b, 0, "str:lzf", str(nil, strings.Repeat("abcdefgh", 16)))
+	b = append(b, 0xFC)
+	b = binary.LittleEndian.AppendUint64(b, future)
+	b = key(b, 0, "str:ttl", str(nil, "still here"))
+	b = append(b, 0xFC)
+	b = binary.LittleEndian.AppendUint64(b, past)
+	b = key(b, 0, "str:expired", str(nil, "gone"))
+
+	// a quicklist of two ziplist nodes (list-max-ziplist-size -2 is 8kb per node, the
+	// first node is cut short here to get two of them), the first one compresses
+	var first, second []string
+	for i := 0; i < 40; i++ {
+		first = append(first, "element-"+strconv.Itoa(i%4))
+	}
+	second = []string{"1", "200", "-70000", "tail"}
+	b = key(b, 14, "list:quicklist", quicklist(nil, [][]byte{ziplist(first), ziplist(second)}))
+
+	// intsets in 16 and 64 bits
+	b = key(b, 11, "set:intset16", str(nil, string(intset([]int64{3, -2, 1000}))))
+	b = key(b, 11, "set:intset64", str(nil, string(intset([]int64{1, 1 << 40, -(1 << 50)}))))
+	// over set-max-intset-entries (512): a plain set
+	members := make([]string, 0, 600)
+	for i := 0; i < 600; i++ {
+		members = append(members, "m"+strconv.Itoa(i))
+	}
+	setBody := length(nil, uint64(len(members)))
+	for _, m := range members {
+		setBody = str(setBody, m)
+	}
+	b = key(b, 2, "set:plain", setBody)
+
+	// a hash ziplist: field, value, field, value
+	b = key(b, 13, "hash:ziplist", str(nil, string(ziplist([]string{"name", "gored", "port", "6379", "neg", "-5"}))))
+
+	// a zset ziplist: member, score with scores as redis prints them
+	b = key(b, 12, "zset:ziplist", str(nil, string(ziplist([]string{"a", "1", "b", "2.5", "c", "-3"}))))
+	// over zset-max-ziplist-entries (128): a skiplist saved as ZSET_2 with binary scores
+	zsetBody := length(nil, 130)
+	for i := 129; i >= 0; i-- { // redis saves them from the tail, highest score first
+		zsetBody = str(zsetBody, "z"+strconv.Itoa(i))
+		zsetBody = binary.LittleEndian.AppendUint64(zsetBody, math.Float64bits(float64(i)/2))
+	}
+	b = key(b, 5, "zset:skiplist", zsetBody)
+
+	return checksum(append(b, 0xFF))
+}
+
+// redis72 is what redis 7.2.4 saves, with rdbcompression yes and maxmemory-policy
+// allkeys-lfu. The list was pushed after DEBUG QUICKLIST-PACKED-THRESHOLD 1k, the way the
+// redis tests get plain nodes without gigabyte elements
+func redis72() []byte {
+	b := []byte("REDIS0011")
+	b = aux(b, "redis-ver", "7.2.4")
+	b = aux(b, "redis-bits", "64")
+	b = aux(b, "ctime", "1700000000")
+	b = aux(b, "used-mem", "1105096")
+	b = aux(b, "repl-stream-db", "0")
+	b = aux(b, "repl-id", "8f1c7d9a3ab2e5c0f6d4b1a29e7c3f50d8a6b4e2")
+	b = aux(b, "repl-offset", "0")
+	b = aux(b, "aof-base", "0")
+	b = append(b, 0xFE, 0)
+	b = append(b, 0xFB)
+	b = length(b, 9)
+	b = length(b, 1)
+
+	// the LFU counter comes after the expire time, right before the key
+	lfu := func(b []byte, counter byte) []byte { return append(b, 0xF9, counter) }
+
+	b = lfu(b, 5)
+	b = key(b, 0, "str:lzf", str(nil, strings.Repeat("0123456789", 10)))
+	b = lfu(b, 5)
+	b = key(b, 0, "str:int", str(nil, "42"))
+
+	// a quicklist of a packed listpack node and a plain node holding one big element
+	packed := listpack([]string{"a", "100", "-4000", "70000", "b"})
+	big := strings.Repeat("x", 9000)
+	b = lfu(b, 5)
+	b = key(b, 18, "list:quicklist2", quicklist2(nil, []node{{2, packed}, {1, []byte(big)}}))
+
+	b = lfu(b, 5)
+	b = key(b, 16, "hash:listpack", str(nil, string(listpack([]string{"field", "value", "count", "12", "big", "123456789012"}))))
+	b = lfu(b, 5)
+	b = key(b, 17, "zset:listpack", str(nil, string(listpack([]string{"low", "-1.5", "mid", "0", "high", "1e+20"}))))
+	b = lfu(b, 5)
+	b = key(b, 20, "set:listpack", str(nil, string(listpack([]string{"red", "green", "blue"}))))
+	b = lfu(b, 5)
+	b = key(b, 11, "set:intset32", str(nil, string(intset([]int64{70000, -70000, 5}))))
+
+	// a listpack big enough that redis compresses it
+	var fields []string
+	for i := 0; i < 20; i++ {
+		fields = append(fields, "field:"+strconv.Itoa(i), "same old value")
+	}
+	b = append(b, 0xFC)
+	b = binary.LittleEndian.AppendUint64(b, future)
+	b = lfu(b, 5)
+	b = key(b, 16, "hash:lzf", str(nil, string(listpack(fields))))
+	b = lfu(b, 5)
+	b = key(b, 0, "str:plain", str(nil, "short"))
+
+	return checksum(append(b, 0xFF))
+}
+
+// key appends a key of type typ with its already encoded value
+func key(b []byte, typ byte, name string, value []byte) []byte {
+	b = append(b, typ)
+	b = str(b, name)
+	return append(b, value...)
+}
+
+func aux(b []byte, k, v string) []byte {
+	b = append(b, 0xFA)
+	b = str(b, k)
+	return str(b, v)
+}
+
+// length is rdbSaveLen
+func length(b []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, byte(n>>8)|0x40, byte(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0x80), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0x81), n)
+	}
+}
+
+// str is rdbSaveRawString: integers of up to 11 characters that print back the same are
+// saved as integers, longer strings are LZF compressed when it pays off
+func str(b []byte, s string) []byte {
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(n, 10) == s {
+			switch {
+			case n >= math.MinInt8 && n <= math.MaxInt8:
+				return append(b, 0xC0, byte(n))
+			case n >= math.MinInt16 && n <= math.MaxInt16:
+				return binary.LittleEndian.AppendUint16(append(b, 0xC1), uint16(n))
+			case n >= math.MinInt32 && n <= math.MaxInt32:
+				return binary.LittleEndian.AppendUint32(append(b, 0xC2), uint32(n))
+			}
+		}
+	}
+	if len(s) > 20 {
+		if c := lzf([]byte(s)); len(c) <= len(s)-4 {
+			b = append(b, 0xC3)
+			b = length(b, uint64(len(c)))
+			b = length(b, uint64(len(s)))
+			return append(b, c...)
+		}
+	}
+	b = length(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// lzf is lzf_compress of liblzf as redis ships it: a hash of the next 3 bytes finds the
+// last place they were seen, matches become back references, the rest literal runs of up
+// to 32 bytes
+func lzf(in []byte) []byte {
+	const (
+		maxLit = 1 << 5
+		maxOff = 1 << 13
+		maxRef = (1 << 8) + (1 << 3)
+	)
+	var out []byte
+	table := make(map[uint32]int)
+	lit := []byte{}
+	flush := func() {
+		if len(lit) > 0 {
+			out = append(out, byte(len(lit)-1))
+			out = append(out, lit...)
+			lit = lit[:0]
+		}
+	}
+	i := 0
+	for i+2 < len(in) {
+		h := uint32(in[i])<<16 | uint32(in[i+1])<<8 | uint32(in[i+2])
+		ref, ok := table[h]
+		table[h] = i
+		if ok && i-ref-1 < maxOff && ref < i {
+			n := 3
+			for i+n < len(in) && n < maxRef && in[ref+n] == in[i+n] {
+				n++
+			}
+			flush()
+			off := i - ref - 1
+			l := n - 2
+			if l < 7 {
+				out = append(out, byte(l<<5)|byte(off>>8))
+			} else {
+				out = append(out, 7<<5|byte(off>>8), byte(l-7))
+			}
+			out = append(out, byte(off))
+			i += n
+			continue
+		}
+		lit = append(lit, in[i])
+		if len(lit) == maxLit {
+			flush()
+		}
+		i++
+	}
+	for ; i < len(in); i++ {
+		lit = append(lit, in[i])
+		if len(lit) == maxLit {
+			flush()
+		}
+	}
+	flush()
+	return out
+}
+
+// ziplist is ziplistNew plus a ziplistPush to the tail for every entry
+func ziplist(entries []string) []byte {
+	body := []byte{}
+	prevlen, tail := 0, 10
+	for _, e := range entries {
+		tail = 10 + len(body)
+		var entry []byte
+		if prevlen < 254 {
+			entry = append(entry, byte(prevlen))
+		} else {
+			entry = binary.LittleEndian.AppendUint32(append(entry, 0xFE), uint32(prevlen))
+		}
+		if n, err := strconv.ParseInt(e, 10, 64); err == nil && len(e) <= 32 && strconv.FormatInt(n, 10) == e {
+			switch {
+			case n >= 0 && n <= 12:
+				entry = append(entry, 0xF1+byte(n))
+			case n >= math.MinInt8 && n <= math.MaxInt8:
+				entry = append(entry, 0xFE, byte(n))
+			case n >= math.MinInt16 && n <= math.MaxInt16:
+				entry = binary.LittleEndian.AppendUint16(append(entry, 0xC0), uint16(n))
+			case n >= -(1<<23) && n < 1<<23:
+				entry = append(entry, 0xF0, byte(n), byte(n>>8), byte(n>>16))
+			case n >= math.MinInt32 && n <= math.MaxInt32:
+				entry = binary.LittleEndian.AppendUint32(append(entry, 0xD0), uint32(n))
+			default:
+				entry = binary.LittleEndian.AppendUint64(append(entry, 0xE0), uint64(n))
+			}
+		} else {
+			switch l := len(e); {
+			case l < 1<<6:
+				entry = append(entry, byte(l))
+			case l < 1<<14:
+				entry = append(entry, byte(l>>8)|0x40, byte(l))
+			default:
+				entry = binary.BigEndian.AppendUint32(append(entry, 0x80), uint32(l))
+			}
+			entry = append(entry, e...)
+		}
+		prevlen = len(entry)
+		body = append(body, entry...)
+	}
+	zl := binary.LittleEndian.AppendUint32(nil, uint32(10+len(body)+1))
+	zl = binary.LittleEndian.AppendUint32(zl, uint32(tail))
+	zl = binary.LittleEndian.AppendUint16(zl, uint16(len(entries)))
+	zl = append(zl, body...)
+	return append(zl, 0xFF)
+}
+
+// listpack is lpNew plus an lpAppend for every entry
+func listpack(entries []string) []byte {
+	body := []byte{}
+	for _, e := range entries {
+		var entry []byte
+		if n, err := strconv.ParseInt(e, 10, 64); err == nil && len(e) <= 20 && strconv.FormatInt(n, 10) == e {
+			switch {
+			case n >= 0 && n <= 127:
+				entry = []byte{byte(n)}
+			case n >= -4096 && n <= 4095:
+				u := uint16(n) & 0x1FFF
+				entry = []byte{0xC0 | byte(u>>8), byte(u)}
+			case n >= math.MinInt16 && n <= math.MaxInt16:
+				entry = binary.LittleEndian.AppendUint16([]byte{0xF1}, uint16(n))
+			case n >= -(1<<23) && n < 1<<23:
+				entry = []byte{0xF2, byte(n), byte(n >> 8), byte(n >> 16)}
+			case n >= math.MinInt32 && n <= math.MaxInt32:
+				entry = binary.LittleEndian.AppendUint32([]byte{0xF3}, uint32(n))
+			default:
+				entry = binary.LittleEndian.AppendUint64([]byte{0xF4}, uint64(n))
+			}
+		} else {
+			switch l := len(e); {
+			case l < 64:
+				entry = []byte{0x80 | byte(l)}
+			case l < 4096:
+				entry = []byte{0xE0 | byte(l>>8), byte(l)}
+			default:
+				entry = binary.LittleEndian.AppendUint32([]byte{0xF0}, uint32(l))
+			}
+			entry = append(entry, e...)
+		}
+		body = append(body, entry...)
+		body = append(body, backlen(len(entry))...)
+	}
+	lp := binary.LittleEndian.AppendUint32(nil, uint32(6+len(body)+1))
+	lp = binary.LittleEndian.AppendUint16(lp, uint16(len(entries)))
+	lp = append(lp, body...)
+	return append(lp, 0xFF)
+}
+
+// backlen is lpEncodeBacklen, the length of an entry stored to be read backwards
+func backlen(l int) []byte {
+	switch {
+	case l <= 127:
+		return []byte{byte(l)}
+	case l < 16383:
+		return []byte{byte(l >> 7), byte(l&127) | 128}
+	default:
+		return []byte{byte(l >> 14), byte((l>>7)&127) | 128, byte(l&127) | 128}
+	}
+}
+
+// intset is an intset with the smallest encoding that holds every member, sorted
+func intset(members []int64) []byte {
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+	enc := 2
+	for _, m := range members {
+		if m < math.MinInt32 || m > math.MaxInt32 {
+			enc = 8
+		} else if (m < math.MinInt16 || m > math.MaxInt16) && enc < 4 {
+			enc = 4
+		}
+	}
+	b := binary.LittleEndian.AppendUint32(nil, uint32(enc))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(members)))
+	for _, m := range members {
+		switch enc {
+		case 2:
+			b = binary.LittleEndian.AppendUint16(b, uint16(m))
+		case 4:
+			b = binary.LittleEndian.AppendUint32(b, uint32(m))
+		default:
+			b = binary.LittleEndian.AppendUint64(b, uint64(m))
+		}
+	}
+	return b
+}
+
+// quicklist is a QUICKLIST value (RDB 7 to 9): the node count and a ziplist per node
+func quicklist(b []byte, nodes [][]byte) []byte {
+	b = length(b, uint64(len(nodes)))
+	for _, zl := range nodes {
+		b = str(b, string(zl))
+	}
+	return b
+}
+
+// node is a QUICKLIST_2 node, container 2 is a listpack and 1 a single plain element
+type node struct {
+	container uint64
+	data      []byte
+}
+
+// quicklist2 is a QUICKLIST_2 value (RDB 10 on)
+func quicklist2(b []byte, nodes []node) []byte {
+	b = length(b, uint64(len(nodes)))
+	for _, n := range nodes {
+		b = length(b, n.container)
+		b = str(b, string(n.data))
+	}
+	return b
+}
+
+// checksum appends the CRC-64/Jones of b without the usual inversions, little endian
+func checksum(b []byte) []byte {
+	var table [256]uint64
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ 0x95AC9329AC4BC9B5
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	var crc uint64
+	for _, c := range b {
+		crc = table[byte(crc)^c] ^ crc>>8
+	}
+	return binary.LittleEndian.AppendUint64(b, crc)
+}
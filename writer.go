@@ -1,16 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"io"
 	"strconv"
 )
 
+// Writer buffers replies, nothing reaches the client until Flush is called. This lets
+// a connection answer a whole batch of pipelined commands with a single write
 type Writer struct {
-	writer io.Writer
+	writer *bufio.Writer
 }
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: w}
+	return &Writer{writer: bufio.NewWriter(w)}
 }
 
 func (w *Writer) Write(v Value) error {
@@ -18,6 +21,11 @@ func (w *Writer) Write(v Value) error {
 	return err
 }
 
+// Flush sends the buffered replies to the client
+func (w *Writer) Flush() error {
+	return w.writer.Flush()
+}
+
 // Now we ened to write the Marshal, that will convert the Value to bytes representing the RESP response
 // for simple strings we create a byte array and add the String, follow by CRLF
 // without CRLF, the client won't be able to read the response correctly
@@ -30,20 +38,22 @@ func (v Value) Marshal() []byte {
 	case "integer":
 		return append([]byte{':'}, append([]byte(strconv.Itoa(v.num)), '\r', '\n')...)
 	case "bulk":
-		if v.bulk == "" {
+		// only an explicit null is nil, an empty string is a perfectly valid value
+		if v.null {
 			return []byte("$-1\r\n")
 		}
 		length := strconv.Itoa(len(v.bulk))
 		return []byte("$" + length + "\r\n" + v.bulk + "\r\n")
 	case "array":
+		if v.null {
+			return []byte("*-1\r\n")
+		}
 		length := strconv.Itoa(len(v.array))
 		bytes := append([]byte{'*'}, []byte(length+"\r\n")...)
 		for _, item := range v.array {
 			bytes = append(bytes, item.Marshal()...)
 		}
 		return bytes
-	case "null":
-		return []byte("$-1\r\n")
 	default:
 		return []byte{}
 	}
@@ -0,0 +1,813 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+var (
+	errScoreNaN     = errors.New("ERR resulting score is not a number (NaN)")
+	errMinMaxFloat  = errors.New("ERR min or max is not a float")
+	errMinMaxString = errors.New("ERR min or max not valid string range item")
+)
+
+// Sorted sets are kept the way redis keeps them: a dict from member to score for O(1)
+// lookups, plus a skiplist ordered by (score, member) for ranges and ranks. Every link
+// in the skiplist also records its span (how many nodes it jumps over), which is what
+// makes ZRANK and index based ZRANGE O(log n) instead of a walk from the head.
+
+const (
+	zslMaxLevel = 32
+	zslP        = 0.25
+)
+
+type zslLevel struct {
+	forward *zslNode
+	span    int
+}
+
+type zslNode struct {
+	member   string
+	score    float64
+	backward *zslNode
+	level    []zslLevel
+}
+
+type skiplist struct {
+	header *zslNode
+	tail   *zslNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{header: &zslNode{level: make([]zslLevel, zslMaxLevel)}, level: 1}
+}
+
+// before reports whether node n sorts before (score, member)
+func (n *zslNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+func zslRandomLevel() int {
+	level := 1
+	for level < zslMaxLevel && rand.Float64() < zslP {
+		level++
+	}
+	return level
+}
+
+// insert adds a node, the caller makes sure the member isn't in the list already
+func (zsl *skiplist) insert(score float64, member string) {
+	var update [zslMaxLevel]*zslNode
+	var rank [zslMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &zslNode{member: member, score: score, level: make([]zslLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// the levels above the new node now jump over one more node
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+}
+
+// delete removes the node holding (score, member), if there is one
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [zslMaxLevel]*zslNode
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+	return true
+}
+
+// rank returns the 1 based rank of (score, member), or 0 if it isn't in the list
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.before(score, member) || (x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the given 1 based rank
+func (zsl *skiplist) byRank(rank int) *zslNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstInRange returns the first node inside a range, described by two predicates that are
+// monotonic along the list: aboveMin turns true at the start of the range and belowMax turns
+// false after its end. Score and lex ranges both fit this shape
+func (zsl *skiplist) firstInRange(aboveMin, belowMax func(*zslNode) bool) *zslNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !aboveMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !belowMax(x) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange is the mirror image of firstInRange
+func (zsl *skiplist) lastInRange(aboveMin, belowMax func(*zslNode) bool) *zslNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && belowMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !aboveMin(x) {
+		return nil
+	}
+	return x
+}
+
+// zsetValue is the value of a sorted set key
+type zsetValue struct {
+	dict map[string]float64
+	zsl  *skiplist
+}
+
+func newZSet() *zsetValue {
+	return &zsetValue{dict: make(map[string]float64), zsl: newSkiplist()}
+}
+
+// zaddFlags holds the ZADD options that decide whether an element gets written
+type zaddFlags struct {
+	nx, xx, gt, lt, ch bool
+}
+
+// allows reports whether the flags let member be written with newScore
+func (f zaddFlags) allows(exists bool, oldScore, newScore float64) bool {
+	switch {
+	case exists && f.nx, !exists && f.xx:
+		return false
+	case exists && f.gt && newScore <= oldScore:
+		return false
+	case exists && f.lt && newScore >= oldScore:
+		return false
+	}
+	return true
+}
+
+// set writes the score of member, it reports whether the member is new
+func (z *zsetValue) set(member string, score float64) bool {
+	old, exists := z.dict[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.zsl.delete(old, member)
+	}
+	z.zsl.insert(score, member)
+	z.dict[member] = score
+	return !exists
+}
+
+func (z *zsetValue) remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.dict, member)
+	return true
+}
+
+// scoredMember is one element of a ZRANGE reply
+type scoredMember struct {
+	member string
+	score  float64
+}
+
+// scoreBound is one end of a BYSCORE range, "(1.5" is exclusive
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+// lexBound is one end of a BYLEX range: "[a" inclusive, "(a" exclusive, or
+// "-" / "+" for the smallest and biggest possible string (inf -1 and 1)
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int
+}
+
+// zrangeQuery is a parsed ZRANGE (or one of its legacy variants). For REV queries
+// the bounds are already swapped back, so min is always the lower end
+type zrangeQuery struct {
+	by          string // "rank", "score" or "lex"
+	rev         bool
+	start, stop int
+	minScore    scoreBound
+	maxScore    scoreBound
+	minLex      lexBound
+	maxLex      lexBound
+	offset      int
+	count       int // -1 means no limit
+	withScores  bool
+}
+
+// predicates returns the range test functions for a BYSCORE or BYLEX query
+func (q *zrangeQuery) predicates() (aboveMin, belowMax func(*zslNode) bool) {
+	if q.by == "score" {
+		aboveMin = func(n *zslNode) bool {
+			return n.score > q.minScore.value || (!q.minScore.exclusive && n.score == q.minScore.value)
+		}
+		belowMax = func(n *zslNode) bool {
+			return n.score < q.maxScore.value || (!q.maxScore.exclusive && n.score == q.maxScore.value)
+		}
+		return aboveMin, belowMax
+	}
+
+	aboveMin = func(n *zslNode) bool {
+		if q.minLex.inf != 0 {
+			return q.minLex.inf < 0
+		}
+		return n.member > q.minLex.value || (!q.minLex.exclusive && n.member == q.minLex.value)
+	}
+	belowMax = func(n *zslNode) bool {
+		if q.maxLex.inf != 0 {
+			return q.maxLex.inf > 0
+		}
+		return n.member < q.maxLex.value || (!q.maxLex.exclusive && n.member == q.maxLex.value)
+	}
+	return aboveMin, belowMax
+}
+
+// rangeQuery returns the elements selected by q, in reply order
+func (z *zsetValue) rangeQuery(q *zrangeQuery) []scoredMember {
+	var out []scoredMember
+
+	if q.by == "rank" {
+		start, end, ok := listRange(q.start, q.stop, z.zsl.length)
+		if !ok {
+			return nil
+		}
+		var x *zslNode
+		if q.rev {
+			x = z.zsl.byRank(z.zsl.length - start)
+		} else {
+			x = z.zsl.byRank(start + 1)
+		}
+		for n := end - start + 1; n > 0 && x != nil; n-- {
+			out = append(out, scoredMember{x.member, x.score})
+			if q.rev {
+				x = x.backward
+			} else {
+				x = x.level[0].forward
+			}
+		}
+		return out
+	}
+
+	aboveMin, belowMax := q.predicates()
+	var x *zslNode
+	if q.rev {
+		x = z.zsl.lastInRange(aboveMin, belowMax)
+	} else {
+		x = z.zsl.firstInRange(aboveMin, belowMax)
+	}
+
+	next := func(n *zslNode) *zslNode {
+		if q.rev {
+			return n.backward
+		}
+		return n.level[0].forward
+	}
+	for offset := q.offset; x != nil && offset > 0; offset-- {
+		x = next(x)
+	}
+	for count := q.count; x != nil && count != 0; count-- {
+		if (q.rev && !aboveMin(x)) || (!q.rev && !belowMax(x)) {
+			break
+		}
+		out = append(out, scoredMember{x.member, x.score})
+		x = next(x)
+	}
+	return out
+}
+
+// ZAdd sets the scores of members, subject to flags. It replies with the number of new
+// members, or with CH the number of members added or changed
+func (c *LRUCache) ZAdd(key string, scores []float64, members []string, flags zaddFlags) (int, error) {
+	n := 0
+	err := c.mutate(key, "zset", true, func(entry *cacheEntry) error {
+		z := entry.value.(*zsetValue)
+		for i, member := range members {
+			old, exists := z.dict[member]
+			if !flags.allows(exists, old, scores[i]) {
+				continue
+			}
+			if z.set(member, scores[i]) || (flags.ch && old != scores[i]) {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// ZIncrBy adds incr to the score of member (ZINCRBY and ZADD INCR). ok is false
+// when the flags stopped the update
+func (c *LRUCache) ZIncrBy(key, member string, incr float64, flags zaddFlags) (score float64, ok bool, err error) {
+	err = c.mutate(key, "zset", true, func(entry *cacheEntry) error {
+		z := entry.value.(*zsetValue)
+		old, exists := z.dict[member]
+		score = old + incr
+		if math.IsNaN(score) {
+			return errScoreNaN
+		}
+		if !flags.allows(exists, old, score) {
+			return nil
+		}
+		z.set(member, score)
+		ok = true
+		return nil
+	})
+	return score, ok, err
+}
+
+// ZRem removes members and returns how many were removed
+func (c *LRUCache) ZRem(key string, members []string) (int, error) {
+	removed := 0
+	err := c.mutate(key, "zset", false, func(entry *cacheEntry) error {
+		if entry == nil {
+			return nil
+		}
+		z := entry.value.(*zsetValue)
+		for _, member := range members {
+			if z.remove(member) {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// ZScore returns the score of member
+func (c *LRUCache) ZScore(key, member string) (float64, bool, error) {
+	var score float64
+	var ok bool
+	err := c.view(key, "zset", func(entry *cacheEntry) {
+		if entry != nil {
+			score, ok = entry.value.(*zsetValue).dict[member]
+		}
+	})
+	return score, ok, err
+}
+
+// ZCard returns the number of members of the sorted set at key
+func (c *LRUCache) ZCard(key string) (int, error) {
+	n := 0
+	err := c.view(key, "zset", func(entry *cacheEntry) {
+		if entry != nil {
+			n = len(entry.value.(*zsetValue).dict)
+		}
+	})
+	return n, err
+}
+
+// ZRank returns the 0 based rank of member, counted from the highest score when rev is set
+func (c *LRUCache) ZRank(key, member string, rev bool) (int, bool, error) {
+	rank := 0
+	found := false
+	err := c.view(key, "zset", func(entry *cacheEntry) {
+		if entry == nil {
+			return
+		}
+		z := entry.value.(*zsetValue)
+		score, ok := z.dict[member]
+		if !ok {
+			return
+		}
+		rank, found = z.zsl.rank(score, member)-1, true
+		if rev {
+			rank = z.zsl.length - 1 - rank
+		}
+	})
+	return rank, found, err
+}
+
+// ZRange runs a parsed ZRANGE query
+func (c *LRUCache) ZRange(key string, q *zrangeQuery) ([]scoredMember, error) {
+	var out []scoredMember
+	err := c.view(key, "zset", func(entry *cacheEntry) {
+		if entry != nil {
+			out = entry.value.(*zsetValue).rangeQuery(q)
+		}
+	})
+	return out, err
+}
+
+// parseScore parses a score argument, redis accepts inf but never nan
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errInvalidFloat
+	}
+	return f, nil
+}
+
+// formatScore formats a score the way redis prints it, infinities included
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return formatFloat(f)
+}
+
+func parseScoreBound(s string) (scoreBound, error) {
+	var b scoreBound
+	if strings.HasPrefix(s, "(") {
+		b.exclusive, s = true, s[1:]
+	}
+	f, err := parseScore(s)
+	if err != nil {
+		return b, errMinMaxFloat
+	}
+	b.value = f
+	return b, nil
+}
+
+func parseLexBound(s string) (lexBound, error) {
+	switch {
+	case s == "-":
+		return lexBound{inf: -1}, nil
+	case s == "+":
+		return lexBound{inf: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, nil
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], exclusive: true}, nil
+	}
+	return lexBound{}, errMinMaxString
+}
+
+// parseZRange parses ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func parseZRange(args []Value) (*zrangeQuery, error) {
+	q := &zrangeQuery{by: "rank", count: -1}
+	limit := false
+
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(argString(args[i])); {
+		case opt == "BYSCORE":
+			q.by = "score"
+		case opt == "BYLEX":
+			q.by = "lex"
+		case opt == "REV":
+			q.rev = true
+		case opt == "WITHSCORES":
+			q.withScores = true
+		case opt == "LIMIT" && i+2 < len(args):
+			offset, err1 := strconv.Atoi(argString(args[i+1]))
+			count, err2 := strconv.Atoi(argString(args[i+2]))
+			if err1 != nil || err2 != nil {
+				return nil, errInvalidInteger
+			}
+			q.offset, q.count, limit = offset, count, true
+			i += 2
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	if limit && q.by == "rank" {
+		return nil, errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if q.withScores && q.by == "lex" {
+		return nil, errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+	if q.offset < 0 {
+		// like redis, a negative offset selects nothing
+		q.count = 0
+	}
+
+	// with REV the range is given as max then min
+	lo, hi := argString(args[1]), argString(args[2])
+	if q.rev && q.by != "rank" {
+		lo, hi = hi, lo
+	}
+
+	var err error
+	switch q.by {
+	case "rank":
+		var err1, err2 error
+		q.start, err1 = strconv.Atoi(lo)
+		q.stop, err2 = strconv.Atoi(hi)
+		if err1 != nil || err2 != nil {
+			return nil, errInvalidInteger
+		}
+	case "score":
+		if q.minScore, err = parseScoreBound(lo); err != nil {
+			return nil, err
+		}
+		if q.maxScore, err = parseScoreBound(hi); err != nil {
+			return nil, err
+		}
+	case "lex":
+		if q.minLex, err = parseLexBound(lo); err != nil {
+			return nil, err
+		}
+		if q.maxLex, err = parseLexBound(hi); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// zaddCommand handles ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func zaddCommand(args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ZADD' command"}
+	}
+
+	key := argString(args[0])
+	var flags zaddFlags
+	incr := false
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(argString(args[i])) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "GT":
+			flags.gt = true
+		case "LT":
+			flags.lt = true
+		case "CH":
+			flags.ch = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return Value{typ: "error", str: errSyntax.Error()}
+	}
+	if flags.nx && flags.xx {
+		return Value{typ: "error", str: "ERR XX and NX options at the same time are not compatible"}
+	}
+	if (flags.gt && flags.lt) || (flags.nx && (flags.gt || flags.lt)) {
+		return Value{typ: "error", str: "ERR GT, LT, and/or NX options at the same time are not compatible"}
+	}
+	if incr && len(pairs) != 2 {
+		return Value{typ: "error", str: "ERR INCR option supports a single increment-element pair"}
+	}
+
+	scores := make([]float64, len(pairs)/2)
+	members := make([]string, len(pairs)/2)
+	for j := range scores {
+		score, err := parseScore(argString(pairs[2*j]))
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		scores[j], members[j] = score, argString(pairs[2*j+1])
+		if err := checkSize(key, members[j]); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+	}
+
+	if incr {
+		score, ok, err := cache.ZIncrBy(key, members[0], scores[0], flags)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if !ok {
+			return Value{typ: "bulk", null: true}
+		}
+		return Value{typ: "bulk", bulk: formatScore(score)}
+	}
+
+	n, err := cache.ZAdd(key, scores, members, flags)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: n}
+}
+
+// zincrbyCommand handles ZINCRBY key increment member
+func zincrbyCommand(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ZINCRBY' command"}
+	}
+
+	incr, err := parseScore(argString(args[1]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	key, member := argString(args[0]), argString(args[2])
+	if err := checkSize(key, member); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	score, _, err := cache.ZIncrBy(key, member, incr, zaddFlags{})
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "bulk", bulk: formatScore(score)}
+}
+
+// zremCommand handles ZREM
+func zremCommand(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ZREM' command"}
+	}
+
+	members := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		members[i] = argString(arg)
+	}
+
+	n, err := cache.ZRem(argString(args[0]), members)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: n}
+}
+
+// zscoreCommand handles ZSCORE
+func zscoreCommand(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ZSCORE' command"}
+	}
+
+	score, ok, err := cache.ZScore(argString(args[0]), argString(args[1]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "bulk", bulk: formatScore(score)}
+}
+
+// zcardCommand handles ZCARD
+func zcardCommand(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ZCARD' command"}
+	}
+
+	n, err := cache.ZCard(argString(args[0]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: n}
+}
+
+// zrankCommand handles ZRANK and ZREVRANK
+func zrankCommand(cmd string, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	rank, ok, err := cache.ZRank(argString(args[0]), argString(args[1]), cmd == "ZREVRANK")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "bulk", null: true}
+	}
+	return Value{typ: "integer", num: rank}
+}
+
+// zrangeCommand handles ZRANGE and the older ZREVRANGE, ZRANGEBYSCORE, ZREVRANGEBYSCORE
+// and ZRANGEBYLEX, which are rewritten into the equivalent ZRANGE options
+func zrangeCommand(cmd string, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd)}
+	}
+
+	extra := map[string][]string{
+		"ZREVRANGE":        {"REV"},
+		"ZRANGEBYSCORE":    {"BYSCORE"},
+		"ZREVRANGEBYSCORE": {"BYSCORE", "REV"},
+		"ZRANGEBYLEX":      {"BYLEX"},
+	}[cmd]
+	if len(extra) > 0 {
+		rewritten := append([]Value{}, args[:3]...)
+		for _, opt := range extra {
+			rewritten = append(rewritten, Value{typ: "bulk", bulk: opt})
+		}
+		args = append(rewritten, args[3:]...)
+	}
+
+	q, err := parseZRange(args)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	elems, err := cache.ZRange(argString(args[0]), q)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	reply := make([]Value, 0, len(elems))
+	for _, e := range elems {
+		reply = append(reply, Value{typ: "bulk", bulk: e.member})
+		if q.withScores {
+			reply = append(reply, Value{typ: "bulk", bulk: formatScore(e.score)})
+		}
+	}
+	return Value{typ: "array", array: reply}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"cmp"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestZAddFlags(t *testing.T) {
+	newTestCache(t, 0)
+	runCommands(t, []commandTest{
+		{[]string{"ZADD", "z", "1", "a", "2", "b"}, ":2"},
+		{[]string{"ZADD", "z", "5", "a", "3", "c"}, ":1"},
+		{[]string{"ZSCORE", "z", "a"}, "$5"},
+		// CH counts the members whose score changed too
+		{[]string{"ZADD", "z", "CH", "6", "a", "2", "b", "4", "d"}, ":2"},
+
+		{[]string{"ZADD", "z", "NX", "100", "a", "1", "e"}, ":1"},
+		{[]string{"ZSCORE", "z", "a"}, "$6"},
+		{[]string{"ZADD", "z", "XX", "CH", "7", "a", "1", "f"}, ":1"},
+		{[]string{"ZSCORE", "z", "f"}, "$nil"},
+
+		// GT and LT only move a score up or down, and still add new members
+		{[]string{"ZADD", "z", "GT", "CH", "1", "a", "9", "b", "0", "g"}, ":2"},
+		{[]string{"ZSCORE", "z", "a"}, "$7"},
+		{[]string{"ZSCORE", "z", "b"}, "$9"},
+		{[]string{"ZADD", "z", "LT", "CH", "8", "b", "10", "c"}, ":1"},
+		{[]string{"ZSCORE", "z", "b"}, "$8"},
+		{[]string{"ZSCORE", "z", "c"}, "$3"},
+		{[]string{"ZADD", "z", "XX", "GT", "CH", "1", "h"}, ":0"},
+		{[]string{"ZCARD", "z"}, ":6"},
+
+		{[]string{"ZADD", "z", "INCR", "2.5", "a"}, "$9.5"},
+		{[]string{"ZADD", "z", "INCR", "NX", "1", "a"}, "$nil"},
+		{[]string{"ZADD", "z", "INCR", "GT", "-1", "a"}, "$nil"},
+		{[]string{"ZADD", "z", "INCR", "XX", "1", "missing"}, "$nil"},
+		{[]string{"ZINCRBY", "z", "-0.5", "a"}, "$9"},
+		{[]string{"ZINCRBY", "z", "1", "new"}, "$1"},
+		{[]string{"ZADD", "z", "inf", "top", "-inf", "bottom"}, ":2"},
+		{[]string{"ZSCORE", "z", "top"}, "$inf"},
+		{[]string{"ZINCRBY", "z", "-inf", "top"}, "-" + errScoreNaN.Error()},
+
+		{[]string{"ZADD", "z", "NX", "XX", "1", "a"}, "-ERR XX and NX options at the same time are not compatible"},
+		{[]string{"ZADD", "z", "GT", "LT", "1", "a"}, "-ERR GT, LT, and/or NX options at the same time are not compatible"},
+		{[]string{"ZADD", "z", "NX", "GT", "1", "a"}, "-ERR GT, LT, and/or NX options at the same time are not compatible"},
+		{[]string{"ZADD", "z", "INCR", "1", "a", "2", "b"}, "-ERR INCR option supports a single increment-element pair"},
+		{[]string{"ZADD", "z", "1", "a", "2"}, "-" + errSyntax.Error()},
+		{[]string{"ZADD", "z", "nan", "a"}, "-" + errInvalidFloat.Error()},
+		{[]string{"ZADD", "z", "one", "a"}, "-" + errInvalidFloat.Error()},
+		{[]string{"ZADD", "z", "1"}, "-ERR wrong number of arguments for 'ZADD' command"},
+
+		{[]string{"ZREM", "z", "a", "missing", "a"}, ":1"},
+		{[]string{"ZCARD", "z"}, ":8"},
+		{[]string{"ZCARD", "missing"}, ":0"},
+		{[]string{"SET", "s", "v"}, "+OK"},
+		{[]string{"ZADD", "s", "1", "a"}, "-" + errWrongType.Error()},
+		{[]string{"ZRANGE", "s", "0", "-1"}, "-" + errWrongType.Error()},
+	})
+}
+
+func TestZRange(t *testing.T) {
+	newTestCache(t, 0)
+	runCommands(t, []commandTest{
+		{[]string{"ZADD", "z", "1", "a", "2", "b", "2", "c", "3", "d", "4.5", "e"}, ":5"},
+
+		// by rank
+		{[]string{"ZRANGE", "z", "0", "-1"}, "*[a b c d e]"},
+		{[]string{"ZRANGE", "z", "1", "2", "WITHSCORES"}, "*[b 2 c 2]"},
+		{[]string{"ZRANGE", "z", "-2", "100"}, "*[d e]"},
+		{[]string{"ZRANGE", "z", "3", "1"}, "*[]"},
+		{[]string{"ZRANGE", "z", "0", "1", "REV"}, "*[e d]"},
+		{[]string{"ZREVRANGE", "z", "0", "1", "WITHSCORES"}, "*[e 4.5 d 3]"},
+		{[]string{"ZRANGE", "missing", "0", "-1"}, "*[]"},
+		{[]string{"ZRANGE", "z", "0", "x"}, "-" + errInvalidInteger.Error()},
+
+		// by score, with exclusive bounds and infinities
+		{[]string{"ZRANGE", "z", "2", "3", "BYSCORE"}, "*[b c d]"},
+		{[]string{"ZRANGE", "z", "(2", "3", "BYSCORE"}, "*[d]"},
+		{[]string{"ZRANGE", "z", "-inf", "(2", "BYSCORE", "WITHSCORES"}, "*[a 1]"},
+		{[]string{"ZRANGE", "z", "(4", "+inf", "BYSCORE"}, "*[e]"},
+		{[]string{"ZRANGE", "z", "3", "2", "BYSCORE", "REV"}, "*[d c b]"},
+		{[]string{"ZRANGE", "z", "2", "3", "BYSCORE", "REV"}, "*[]"},
+		{[]string{"ZRANGE", "z", "-inf", "inf", "BYSCORE", "LIMIT", "1", "2"}, "*[b c]"},
+		{[]string{"ZRANGE", "z", "-inf", "inf", "BYSCORE", "LIMIT", "1", "-1"}, "*[b c d e]"},
+		{[]string{"ZRANGE", "z", "-inf", "inf", "BYSCORE", "LIMIT", "-1", "2"}, "*[]"},
+		{[]string{"ZRANGE", "z", "+inf", "-inf", "BYSCORE", "REV", "LIMIT", "0", "2"}, "*[e d]"},
+		{[]string{"ZRANGEBYSCORE", "z", "1", "2", "WITHSCORES"}, "*[a 1 b 2 c 2]"},
+		{[]string{"ZREVRANGEBYSCORE", "z", "2", "1"}, "*[c b a]"},
+		{[]string{"ZRANGE", "z", "x", "3", "BYSCORE"}, "-" + errMinMaxFloat.Error()},
+
+		// the rank order is the order a range by score gives
+		{[]string{"ZRANK", "z", "c"}, ":2"},
+		{[]string{"ZREVRANK", "z", "c"}, ":2"},
+		{[]string{"ZREVRANK", "z", "e"}, ":0"},
+		{[]string{"ZRANK", "z", "missing"}, "$nil"},
+
+		{[]string{"ZRANGE", "z", "0", "-1", "LIMIT", "0", "1"}, "-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"},
+		{[]string{"ZRANGE", "z", "0", "-1", "BYSCORE", "LIMIT", "0"}, "-" + errSyntax.Error()},
+		{[]string{"ZRANGE", "z", "0", "-1", "SIDEWAYS"}, "-" + errSyntax.Error()},
+	})
+}
+
+func TestZRangeByLex(t *testing.T) {
+	newTestCache(t, 0)
+	runCommands(t, []commandTest{
+		{[]string{"ZADD", "z", "0", "apple", "0", "banana", "0", "cherry", "0", "date"}, ":4"},
+		{[]string{"ZRANGE", "z", "-", "+", "BYLEX"}, "*[apple banana cherry date]"},
+		{[]string{"ZRANGE", "z", "[banana", "[cherry", "BYLEX"}, "*[banana cherry]"},
+		{[]string{"ZRANGE", "z", "(banana", "+", "BYLEX"}, "*[cherry date]"},
+		{[]string{"ZRANGE", "z", "[b", "(d", "BYLEX"}, "*[banana cherry]"},
+		{[]string{"ZRANGE", "z", "+", "-", "BYLEX", "REV", "LIMIT", "1", "2"}, "*[cherry banana]"},
+		{[]string{"ZRANGEBYLEX", "z", "-", "(banana"}, "*[apple]"},
+		{[]string{"ZRANGE", "z", "banana", "+", "BYLEX"}, "-" + errMinMaxString.Error()},
+		{[]string{"ZRANGE", "z", "-", "+", "BYLEX", "WITHSCORES"}, "-ERR syntax error, WITHSCORES not supported in combination with BYLEX"},
+	})
+}
+
+func TestSkiplistOrder(t *testing.T) {
+	// random inserts, updates and removals, checked against a sorted slice after each step
+	r := rand.New(rand.NewSource(1))
+	z := newZSet()
+	scores := map[string]float64{}
+	for i := 0; i < 5000; i++ {
+		member := "m" + strconv.Itoa(r.Intn(300))
+		if r.Intn(4) == 0 {
+			if _, ok := scores[member]; z.remove(member) != ok {
+				t.Fatalf("step %d: remove(%s) disagrees with the map", i, member)
+			}
+			delete(scores, member)
+			continue
+		}
+		score := float64(r.Intn(50))
+		z.set(member, score)
+		scores[member] = score
+	}
+
+	type pair struct {
+		score  float64
+		member string
+	}
+	var want []pair
+	for member, score := range scores {
+		want = append(want, pair{score, member})
+	}
+	slices.SortFunc(want, func(a, b pair) int {
+		return cmp.Or(cmp.Compare(a.score, b.score), strings.Compare(a.member, b.member))
+	})
+
+	if z.zsl.length != len(want) || len(z.dict) != len(want) {
+		t.Fatalf("skiplist holds %d, dict %d, want %d members", z.zsl.length, len(z.dict), len(want))
+	}
+	for rank, p := range want {
+		node := z.zsl.byRank(rank + 1)
+		if node == nil || node.member != p.member || node.score != p.score {
+			t.Fatalf("rank %d is %+v, want %+v", rank, node, p)
+		}
+		if got := z.zsl.rank(p.score, p.member); got != rank+1 {
+			t.Fatalf("rank(%v) = %d, want %d", p, got, rank+1)
+		}
+	}
+}